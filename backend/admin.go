@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jackc/cli"
+	"gopkg.in/inconshreveable/log15.v2/term"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Administrative commands run in their own process. Their changes are
+// recorded in the event log like any other, so running servers send them to
+// connected clients and close the connections of users that are disabled.
+
+var configFlag = cli.StringFlag{Name: "config, c", Value: "jchat.conf", Usage: "path to config file"}
+
+var userCommand = cli.Command{
+	Name:        "user",
+	Usage:       "manage users",
+	Description: "create, list, disable, unlock, and set the password of users",
+	Subcommands: []cli.Command{
+		{
+			Name:        "create",
+			Usage:       "create a user",
+			Synopsis:    "[command options]",
+			Description: "create a user with an already verified email address. The password is read from standard input.",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.StringFlag{Name: "name", Value: "", Usage: "user name"},
+				cli.StringFlag{Name: "email", Value: "", Usage: "email address"},
+			},
+			Action: UserCreate,
+		},
+		{
+			Name:        "list",
+			Usage:       "list users",
+			Synopsis:    "[command options]",
+			Description: "list all users",
+			Flags:       []cli.Flag{configFlag},
+			Action:      UserList,
+		},
+		{
+			Name:        "disable",
+			Usage:       "disable a user",
+			Synopsis:    "[command options]",
+			Description: "prevent a user from logging in and revoke all of their sessions",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.StringFlag{Name: "email", Value: "", Usage: "email address"},
+			},
+			Action: UserDisable,
+		},
+		{
+			Name:        "set-password",
+			Usage:       "set a user's password",
+			Synopsis:    "[command options]",
+			Description: "set a user's password. The password is read from standard input.",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.StringFlag{Name: "email", Value: "", Usage: "email address"},
+			},
+			Action: UserSetPassword,
+		},
+		{
+			Name:        "lockouts",
+			Usage:       "list failed logins",
+			Synopsis:    "[command options]",
+			Description: "list users that have failed to log in since their last successful login and whether they are locked out",
+			Flags:       []cli.Flag{configFlag},
+			Action:      UserLockouts,
+		},
+		{
+			Name:        "unlock",
+			Usage:       "unlock a user",
+			Synopsis:    "[command options]",
+			Description: "clear a user's failed logins and any lockout",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.StringFlag{Name: "email", Value: "", Usage: "email address"},
+			},
+			Action: UserUnlock,
+		},
+	},
+}
+
+var channelCommand = cli.Command{
+	Name:        "channel",
+	Usage:       "manage channels",
+	Description: "create, rename, archive, and set the owner of channels",
+	Subcommands: []cli.Command{
+		{
+			Name:        "create",
+			Usage:       "create a channel",
+			Synopsis:    "[command options]",
+			Description: "create a channel, optionally owned by the user with the given email address",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.StringFlag{Name: "name", Value: "", Usage: "channel name"},
+				cli.StringFlag{Name: "owner", Value: "", Usage: "email address of channel owner"},
+			},
+			Action: ChannelCreate,
+		},
+		{
+			Name:        "rename",
+			Usage:       "rename a channel",
+			Synopsis:    "[command options]",
+			Description: "rename a channel",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.IntFlag{Name: "id", Value: 0, Usage: "channel ID"},
+				cli.StringFlag{Name: "name", Value: "", Usage: "new channel name"},
+			},
+			Action: ChannelRename,
+		},
+		{
+			Name:        "archive",
+			Usage:       "archive a channel",
+			Synopsis:    "[command options]",
+			Description: "archive a channel regardless of its owner",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.IntFlag{Name: "id", Value: 0, Usage: "channel ID"},
+			},
+			Action: ChannelArchive,
+		},
+		{
+			Name:        "set-owner",
+			Usage:       "set the owner of a channel",
+			Synopsis:    "[command options]",
+			Description: "set the owner of a channel who can then archive, restore, and delete it",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.IntFlag{Name: "id", Value: 0, Usage: "channel ID"},
+				cli.StringFlag{Name: "owner", Value: "", Usage: "email address of new channel owner"},
+			},
+			Action: ChannelSetOwner,
+		},
+	},
+}
+
+var sessionCommand = cli.Command{
+	Name:        "session",
+	Usage:       "manage sessions",
+	Description: "revoke sessions",
+	Subcommands: []cli.Command{
+		{
+			Name:        "revoke",
+			Usage:       "revoke sessions",
+			Synopsis:    "[command options]",
+			Description: "revoke a single session by ID or all sessions of the user with the given email address",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.StringFlag{Name: "id", Value: "", Usage: "session ID"},
+				cli.StringFlag{Name: "email", Value: "", Usage: "email address"},
+			},
+			Action: SessionRevoke,
+		},
+	},
+}
+
+var mailCommand = cli.Command{
+	Name:        "mail",
+	Usage:       "manage mail",
+	Description: "test mail delivery",
+	Subcommands: []cli.Command{
+		{
+			Name:        "test",
+			Usage:       "send a test mail",
+			Synopsis:    "[command options]",
+			Description: "send a test mail using the mail section of the config file",
+			Flags: []cli.Flag{
+				configFlag,
+				cli.StringFlag{Name: "to", Value: "", Usage: "address to send test mail to"},
+			},
+			Action: MailTest,
+		},
+	},
+}
+
+func exitWithError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func requireFlags(c *cli.Context, names ...string) {
+	for _, name := range names {
+		if !c.IsSet(name) {
+			exitWithError(fmt.Errorf("Missing required flag: --%s", name))
+		}
+	}
+}
+
+func loadAdminRepository(c *cli.Context) *PgxRepository {
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	connPoolConfig, err := loadConnPoolConfig(conf)
+	if err != nil {
+		exitWithError(fmt.Errorf("Unable to load database configuration: %v", err))
+	}
+
+	preparedStatements, err := loadPreparedStatements(conf)
+	if err != nil {
+		exitWithError(fmt.Errorf("Unable to load database SQL: %v", err))
+	}
+
+	repo, err := NewPgxRepository(connPoolConfig, preparedStatements)
+	if err != nil {
+		exitWithError(fmt.Errorf("Unable to create PgxRepository: %v", err))
+	}
+
+	return repo
+}
+
+// readPassword reads a password from the first line of r so it never appears
+// in the process list or shell history like a flag would. The prompt is only
+// shown when r is a terminal.
+func readPassword(r *os.File, prompt string) string {
+	if term.IsTty(r.Fd()) {
+		fmt.Fprint(os.Stderr, prompt)
+	}
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		exitWithError(fmt.Errorf("Unable to read password: %v", err))
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+func getUserByEmailFlag(repo *PgxRepository, email string) User {
+	user, err := repo.GetUserByEmail(email)
+	if err == ErrNotFound {
+		exitWithError(fmt.Errorf("No user with email: %s", email))
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+
+	return user
+}
+
+func UserCreate(c *cli.Context) {
+	requireFlags(c, "name", "email")
+
+	if err := ValidateEmail(c.String("email")); err != nil {
+		exitWithError(err)
+	}
+
+	password := readPassword(os.Stdin, "Password: ")
+	if err := ValidatePassword(password); err != nil {
+		exitWithError(err)
+	}
+
+	repo := loadAdminRepository(c)
+
+	user, err := repo.CreateVerifiedUser(c.String("name"), c.String("email"), password)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Created user %d\n", user.ID)
+}
+
+func UserList(c *cli.Context) {
+	repo := loadAdminRepository(c)
+
+	users, err := repo.GetUsers()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tEMAIL\tVERIFIED\tDISABLED")
+	for _, u := range users {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%t\n", u.ID, u.Name, u.Email, u.EmailVerified, u.Disabled)
+	}
+	w.Flush()
+}
+
+func UserDisable(c *cli.Context) {
+	requireFlags(c, "email")
+
+	repo := loadAdminRepository(c)
+	user := getUserByEmailFlag(repo, c.String("email"))
+
+	err := repo.DisableUser(user.ID)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Disabled user %d\n", user.ID)
+}
+
+func UserSetPassword(c *cli.Context) {
+	requireFlags(c, "email")
+
+	password := readPassword(os.Stdin, "New password: ")
+	if err := ValidatePassword(password); err != nil {
+		exitWithError(err)
+	}
+
+	repo := loadAdminRepository(c)
+	user := getUserByEmailFlag(repo, c.String("email"))
+
+	err := repo.SetPassword(user.ID, password)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Set password for user %d\n", user.ID)
+}
+
+func UserLockouts(c *cli.Context) {
+	repo := loadAdminRepository(c)
+
+	failures, err := repo.GetLoginFailures()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tEMAIL\tFAILURES\tLOCKED\tBLOCKED UNTIL")
+	for _, f := range failures {
+		blockedUntil := "-"
+		if f.BlockedUntil.After(now) {
+			blockedUntil = f.BlockedUntil.Format(time.RFC3339)
+		}
+		locked := f.Failures >= maxLoginFailures && f.BlockedUntil.After(now)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%t\t%s\n", f.User.ID, f.User.Name, f.User.Email, f.Failures, locked, blockedUntil)
+	}
+	w.Flush()
+}
+
+func UserUnlock(c *cli.Context) {
+	requireFlags(c, "email")
+
+	repo := loadAdminRepository(c)
+	user := getUserByEmailFlag(repo, c.String("email"))
+
+	err := repo.UnlockAccount(user.ID)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Unlocked user %d\n", user.ID)
+}
+
+func ChannelCreate(c *cli.Context) {
+	requireFlags(c, "name")
+
+	repo := loadAdminRepository(c)
+
+	var ownerID int32
+	if c.IsSet("owner") {
+		ownerID = getUserByEmailFlag(repo, c.String("owner")).ID
+	}
+
+	channelID, err := repo.CreateChannel(c.String("name"), ownerID)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Created channel %d\n", channelID)
+}
+
+func ChannelRename(c *cli.Context) {
+	requireFlags(c, "id", "name")
+
+	repo := loadAdminRepository(c)
+
+	err := repo.RenameChannel(int32(c.Int("id")), c.String("name"))
+	if err == ErrNotFound {
+		exitWithError(fmt.Errorf("No channel with ID: %d", c.Int("id")))
+	}
+	if err == ErrChannelArchived {
+		exitWithError(fmt.Errorf("Channel %d is archived", c.Int("id")))
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Renamed channel %d\n", c.Int("id"))
+}
+
+func ChannelArchive(c *cli.Context) {
+	requireFlags(c, "id")
+
+	repo := loadAdminRepository(c)
+
+	err := repo.ArchiveChannel(int32(c.Int("id")))
+	if err == ErrNotFound {
+		exitWithError(fmt.Errorf("No unarchived channel with ID: %d", c.Int("id")))
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Archived channel %d\n", c.Int("id"))
+}
+
+func ChannelSetOwner(c *cli.Context) {
+	requireFlags(c, "id", "owner")
+
+	repo := loadAdminRepository(c)
+
+	owner := getUserByEmailFlag(repo, c.String("owner"))
+
+	err := repo.SetChannelOwner(int32(c.Int("id")), owner.ID)
+	if err == ErrNotFound {
+		exitWithError(fmt.Errorf("No channel with ID: %d", c.Int("id")))
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Set owner of channel %d to %s\n", c.Int("id"), owner.Email)
+}
+
+func SessionRevoke(c *cli.Context) {
+	if c.IsSet("id") == c.IsSet("email") {
+		exitWithError(errors.New("Exactly one of --id or --email is required"))
+	}
+
+	repo := loadAdminRepository(c)
+
+	if c.IsSet("id") {
+		err := repo.DeleteSession(c.String("id"))
+		if err == ErrNotFound {
+			exitWithError(fmt.Errorf("No session with ID: %s", c.String("id")))
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+
+		fmt.Println("Revoked 1 session")
+		return
+	}
+
+	user := getUserByEmailFlag(repo, c.String("email"))
+
+	count, err := repo.DeleteUserSessions(user.ID)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Revoked %d sessions\n", count)
+}
+
+func MailTest(c *cli.Context) {
+	requireFlags(c, "to")
+
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	logHandler, err := newLogHandler(conf)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	logger, err := newLogger(conf, logHandler)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	mailer, err := newMailer(conf, logger)
+	if err != nil {
+		exitWithError(err)
+	}
+	if mailer == nil {
+		exitWithError(errors.New("Config does not contain a mail section"))
+	}
+
+	err = mailer.SendTestMail(c.String("to"))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Sent test mail to %s\n", c.String("to"))
+}
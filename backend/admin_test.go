@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReadPassword(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		password string
+	}{
+		{"secret123\n", "secret123"},
+		{"secret123\r\nignored\n", "secret123"},
+		{"secret123", "secret123"},
+		{"  spaced out  \n", "  spaced out  "},
+	}
+
+	for _, tt := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString(tt.input)
+		w.Close()
+
+		password := readPassword(r, "Password: ")
+		r.Close()
+
+		if password != tt.password {
+			t.Errorf("readPassword of %q: expected %q, but it was %q", tt.input, tt.password, password)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrShutdownTimeout = errors.New("timed out waiting for client connections to finish")
+
+// ClientConns tracks the active client connections so the server can tell
+// them it is shutting down and wait for them to finish in-flight requests.
+type ClientConns struct {
+	mutex          sync.Mutex
+	wg             sync.WaitGroup
+	closed         bool
+	count          int
+	shuttingDown   chan struct{}
+	reconnectAfter time.Duration
+}
+
+// NewClientConns returns a ClientConns that tells clients to wait
+// reconnectAfter before reconnecting when the server shuts down.
+func NewClientConns(reconnectAfter time.Duration) *ClientConns {
+	return &ClientConns{
+		shuttingDown:   make(chan struct{}),
+		reconnectAfter: reconnectAfter,
+	}
+}
+
+// Serve dispatches conn until it disconnects or the server shuts down. It
+// returns immediately if the server is already shutting down.
+func (cc *ClientConns) Serve(conn *ClientConn) {
+	cc.mutex.Lock()
+	if cc.closed {
+		cc.mutex.Unlock()
+		return
+	}
+	cc.wg.Add(1)
+	cc.count++
+	cc.mutex.Unlock()
+
+	defer func() {
+		cc.mutex.Lock()
+		cc.count--
+		cc.mutex.Unlock()
+		cc.wg.Done()
+	}()
+
+	conn.shuttingDown = cc.shuttingDown
+	conn.reconnectAfter = cc.reconnectAfter
+	conn.Dispatch()
+}
+
+// Count returns the number of active client connections.
+func (cc *ClientConns) Count() int {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.count
+}
+
+// ShuttingDown returns true once Shutdown has been called.
+func (cc *ClientConns) ShuttingDown() bool {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.closed
+}
+
+// Shutdown tells every client connection to finish its in-flight requests
+// and reconnect. It waits up to timeout for them to disconnect.
+func (cc *ClientConns) Shutdown(timeout time.Duration) error {
+	cc.mutex.Lock()
+	if !cc.closed {
+		cc.closed = true
+		close(cc.shuttingDown)
+	}
+	cc.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		cc.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrShutdownTimeout
+	}
+}
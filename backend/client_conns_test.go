@@ -0,0 +1,104 @@
+package main
+
+import (
+	"golang.org/x/net/websocket"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getTestClientConnsServer(t testing.TB, clientConns *ClientConns) *httptest.Server {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		conn := &ClientConn{
+			ws:     ws,
+			logger: logger,
+		}
+
+		clientConns.Serve(conn)
+	}))
+}
+
+func TestClientConnsShutdown(t *testing.T) {
+	t.Parallel()
+
+	clientConns := NewClientConns(3 * time.Second)
+	server := getTestClientConnsServer(t, clientConns)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	for i := 0; clientConns.Count() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("Expected clientConns.Count() to be %d, but it was %d", 1, clientConns.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shutdownErrChan := make(chan error)
+	go func() {
+		shutdownErrChan <- clientConns.Shutdown(time.Second)
+	}()
+
+	var notification struct {
+		Method string `json:"method"`
+		Params struct {
+			ReconnectAfter int64 `json:"reconnect_after_ms"`
+		} `json:"params"`
+	}
+	err := websocket.JSON.Receive(ws, &notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.Method != "server_shutting_down" {
+		t.Errorf("Expected notification.Method to be %s, but it was %s", "server_shutting_down", notification.Method)
+	}
+	if notification.Params.ReconnectAfter != 3000 {
+		t.Errorf("Expected notification.Params.ReconnectAfter to be %d, but it was %d", 3000, notification.Params.ReconnectAfter)
+	}
+
+	select {
+	case err = <-shutdownErrChan:
+		if err != nil {
+			t.Fatalf("clientConns.Shutdown returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("clientConns.Shutdown never returned")
+	}
+
+	if clientConns.Count() != 0 {
+		t.Errorf("Expected clientConns.Count() to be %d, but it was %d", 0, clientConns.Count())
+	}
+
+	// Connections after shutdown are closed immediately
+	ws2 := connectWebSocketClient(t, server)
+	defer ws2.Close()
+	err = websocket.JSON.Receive(ws2, &notification)
+	if err == nil {
+		t.Error("Expected connection after shutdown to be closed, but it was not")
+	}
+}
+
+func TestClientConnsShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	clientConns := NewClientConns(time.Second)
+
+	release := make(chan struct{})
+	clientConns.wg.Add(1)
+	go func() {
+		<-release
+		clientConns.wg.Done()
+	}()
+	defer close(release)
+
+	err := clientConns.Shutdown(50 * time.Millisecond)
+	if err != ErrShutdownTimeout {
+		t.Errorf("Expected clientConns.Shutdown to return %v, but it was %v", ErrShutdownTimeout, err)
+	}
+}
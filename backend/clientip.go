@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of reverse proxies whose X-Forwarded-For
+// header is believed. Without them every client appears to come from the
+// proxy's address, so all clients share the same IP rate limit buckets.
+type TrustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// networks such as "127.0.0.1, 10.0.0.0/8".
+func parseTrustedProxies(s string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("proxy must be an IP address or CIDR network: %s", p)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("proxy must be an IP address or CIDR network: %s", p)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func (proxies TrustedProxies) contains(ip net.IP) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that made req. When the
+// request comes from a trusted proxy X-Forwarded-For is read from the right
+// and the first address that is not a trusted proxy is the client. Entries
+// to the left of it could have been sent by the client and are ignored.
+func (proxies TrustedProxies) ClientIP(req *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !proxies.contains(ip) {
+		return host, nil
+	}
+
+	var forwarded []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			// The proxy that appended this entry is trusted but the entry is
+			// not usable. Blame the last address that is known to be real.
+			return host, nil
+		}
+		host = forwardedIP.String()
+		if !proxies.contains(forwardedIP) {
+			return host, nil
+		}
+	}
+
+	return host, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Parallel()
+
+	proxies, err := parseTrustedProxies("127.0.0.1, 10.0.0.0/8, ::1 ,")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies returned error: %v", err)
+	}
+	expected := []string{"127.0.0.1/32", "10.0.0.0/8", "::1/128"}
+	if len(proxies) != len(expected) {
+		t.Fatalf("Expected %d proxies, but there were %d", len(expected), len(proxies))
+	}
+	for i, network := range proxies {
+		if network.String() != expected[i] {
+			t.Errorf("%d. Expected proxy to be %s, but it was %s", i, expected[i], network)
+		}
+	}
+
+	for _, s := range []string{"localhost", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("Expected parseTrustedProxies(%q) to return error, but it did not", s)
+		}
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	t.Parallel()
+
+	proxies, err := parseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies returned error: %v", err)
+	}
+
+	tests := []struct {
+		proxies       TrustedProxies
+		remoteAddr    string
+		forwardedFor  []string
+		expected      string
+		expectedError bool
+	}{
+		{proxies: nil, remoteAddr: "127.0.0.1:5000", forwardedFor: []string{"203.0.113.1"}, expected: "127.0.0.1"},
+		{proxies: proxies, remoteAddr: "198.51.100.1:5000", forwardedFor: []string{"203.0.113.1"}, expected: "198.51.100.1"},
+		{proxies: proxies, remoteAddr: "127.0.0.1:5000", forwardedFor: nil, expected: "127.0.0.1"},
+		{proxies: proxies, remoteAddr: "127.0.0.1:5000", forwardedFor: []string{"203.0.113.1"}, expected: "203.0.113.1"},
+		{proxies: proxies, remoteAddr: "127.0.0.1:5000", forwardedFor: []string{"192.0.2.1, 203.0.113.1, 10.0.0.2"}, expected: "203.0.113.1"},
+		{proxies: proxies, remoteAddr: "127.0.0.1:5000", forwardedFor: []string{"192.0.2.1", "203.0.113.1"}, expected: "203.0.113.1"},
+		{proxies: proxies, remoteAddr: "127.0.0.1:5000", forwardedFor: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{proxies: proxies, remoteAddr: "127.0.0.1:5000", forwardedFor: []string{"203.0.113.1, bogus, 10.0.0.2"}, expected: "10.0.0.2"},
+		{proxies: proxies, remoteAddr: "bogus", expectedError: true},
+	}
+
+	for i, tt := range tests {
+		req := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		for _, v := range tt.forwardedFor {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+
+		ip, err := tt.proxies.ClientIP(req)
+		if tt.expectedError {
+			if err == nil {
+				t.Errorf("%d. Expected ClientIP to return error, but it did not", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. ClientIP returned error: %v", i, err)
+			continue
+		}
+		if ip != tt.expected {
+			t.Errorf("%d. Expected ClientIP to be %s, but it was %s", i, tt.expected, ip)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	log "gopkg.in/inconshreveable/log15.v2"
+	"time"
+)
+
+const eventPruneInterval = time.Hour
+
+// EventPruner deletes events from the event log once they are older than the
+// retention period. Clients that reconnect after their last event has been
+// deleted must reload everything.
+type EventPruner struct {
+	repo      EventRepository
+	retention time.Duration
+	logger    log.Logger
+	done      chan struct{}
+}
+
+func NewEventPruner(repo EventRepository, retention time.Duration, logger log.Logger) *EventPruner {
+	return &EventPruner{repo: repo, retention: retention, logger: logger}
+}
+
+// Start prunes the event log now and every eventPruneInterval.
+func (p *EventPruner) Start() {
+	p.done = make(chan struct{})
+	go p.run()
+}
+
+func (p *EventPruner) Stop() {
+	close(p.done)
+}
+
+func (p *EventPruner) run() {
+	ticker := time.NewTicker(eventPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		p.Prune()
+
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Prune deletes the events older than the retention period.
+func (p *EventPruner) Prune() {
+	count, err := p.repo.DeleteEventsBefore(time.Now().Add(-p.retention))
+	if err != nil {
+		p.logger.Error("Unable to prune event log", "error", err)
+		return
+	}
+
+	p.logger.Debug("Pruned event log", "count", count)
+}
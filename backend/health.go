@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("server is shutting down")
+
+type ReadyChecker interface {
+	CheckReady(schemaVersion int32) error
+}
+
+// newHealthzHandler reports that the process is alive. It does not check any
+// dependencies.
+func newHealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// newReadyzHandler reports whether the server can handle traffic: it is not
+// shutting down, the database is reachable with all prepared statements, and
+// the schema is at schemaVersion. The check fails if it takes longer than
+// timeout.
+func newReadyzHandler(checker ReadyChecker, schemaVersion int32, clientConns *ClientConns, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+
+		err := checkReady(checker, schemaVersion, clientConns, timeout)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+
+		w.Write([]byte("ok\n"))
+	})
+}
+
+func checkReady(checker ReadyChecker, schemaVersion int32, clientConns *ClientConns, timeout time.Duration) error {
+	if clientConns.ShuttingDown() {
+		return ErrShuttingDown
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- checker.CheckReady(schemaVersion)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(timeout):
+		return errors.New("timed out checking database")
+	}
+}
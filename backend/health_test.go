@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testReadyChecker struct {
+	err   error
+	delay time.Duration
+}
+
+func (c testReadyChecker) CheckReady(schemaVersion int32) error {
+	time.Sleep(c.delay)
+	return c.err
+}
+
+func TestHealthzHandler(t *testing.T) {
+	t.Parallel()
+
+	w := httptest.NewRecorder()
+	newHealthzHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status to be %d, but it was %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	t.Parallel()
+
+	shutDown := NewClientConns(time.Second)
+	shutDown.Shutdown(time.Second)
+
+	tests := []struct {
+		checker     ReadyChecker
+		clientConns *ClientConns
+		status      int
+	}{
+		{testReadyChecker{}, NewClientConns(time.Second), http.StatusOK},
+		{testReadyChecker{err: errors.New("schema is out of date")}, NewClientConns(time.Second), http.StatusServiceUnavailable},
+		{testReadyChecker{delay: time.Second}, NewClientConns(time.Second), http.StatusServiceUnavailable},
+		{testReadyChecker{}, shutDown, http.StatusServiceUnavailable},
+	}
+
+	for i, tt := range tests {
+		handler := newReadyzHandler(tt.checker, 12, tt.clientConns, 50*time.Millisecond)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tt.status {
+			t.Errorf("%d. Expected status to be %d, but it was %d: %s", i, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
@@ -2,4 +2,8 @@ package main
 
 type Mailer interface {
 	SendPasswordResetMail(to, token string) error
+	SendEmailChangeConfirmationMail(to, token string) error
+	SendEmailVerificationMail(to, token string) error
+	SendAccountUnlockMail(to, token string) error
+	SendTestMail(to string) error
 }
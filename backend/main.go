@@ -3,18 +3,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/jackc/cli"
+	"github.com/jackc/jchat/db"
+	"github.com/jackc/jchat/frontend"
+	"github.com/jackc/pgx"
 	"github.com/vaughan0/go-ini"
 	"golang.org/x/net/websocket"
 	log "gopkg.in/inconshreveable/log15.v2"
+	"io/fs"
 	"net/http"
 	"net/http/httputil"
 	"net/smtp"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 const version = "0.0.1"
@@ -23,6 +33,25 @@ type httpConfig struct {
 	listenAddress string
 	listenPort    string
 	staticURL     string
+	staticPath    string
+
+	shutdownTimeout time.Duration
+	reconnectAfter  time.Duration
+	slowRequest     time.Duration
+	allowedOrigins  []string
+	trustedProxies  TrustedProxies
+
+	maxConcurrentRequests int
+
+	pingInterval time.Duration
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+
+	eventRetention time.Duration
+
+	tlsCertFile  string
+	tlsKeyFile   string
+	redirectPort string
 }
 
 func main() {
@@ -41,13 +70,30 @@ func main() {
 			Synopsis:    "[command options]",
 			Description: "run the jchat server",
 			Flags: []cli.Flag{
-				cli.StringFlag{"address, a", "127.0.0.1", "address to listen on"},
-				cli.StringFlag{"port, p", "8080", "port to listen on"},
-				cli.StringFlag{"config, c", "jchat.conf", "path to config file"},
-				cli.StringFlag{"static-url", "", "reverse proxy static asset requests to URL"},
+				cli.StringFlag{Name: "address, a", Value: "127.0.0.1", Usage: "address to listen on"},
+				cli.StringFlag{Name: "port, p", Value: "8080", Usage: "port to listen on"},
+				cli.StringFlag{Name: "config, c", Value: "jchat.conf", Usage: "path to config file"},
+				cli.StringFlag{Name: "static-url", Value: "", Usage: "reverse proxy static asset requests to URL"},
+				cli.StringFlag{Name: "static-path", Value: "", Usage: "serve static assets from path instead of the embedded assets"},
 			},
 			Action: Serve,
 		},
+		{
+			Name:        "migrate",
+			ShortName:   "m",
+			Usage:       "migrate the database",
+			Synopsis:    "[command options]",
+			Description: "migrate the database schema to the latest or given version",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "jchat.conf", Usage: "path to config file"},
+				cli.StringFlag{Name: "destination, d", Value: "last", Usage: "version to migrate to -- last for the latest version"},
+			},
+			Action: Migrate,
+		},
+		userCommand,
+		channelCommand,
+		sessionCommand,
+		mailCommand,
 	}
 
 	app.Run(os.Args)
@@ -68,14 +114,77 @@ func loadConfig(path string) (ini.File, error) {
 	return file, nil
 }
 
-func newLogger(conf ini.File) (log.Logger, error) {
+// newLogHandler builds the handler described by the log section. Records are
+// written to stdout unless a file or syslog tag is configured.
+func newLogHandler(conf ini.File) (log.Handler, error) {
+	var format log.Format
+	switch f, _ := conf.Get("log", "format"); f {
+	case "", "terminal":
+		format = log.TerminalFormat()
+	case "logfmt":
+		format = log.LogfmtFormat()
+	case "json":
+		format = log.JsonFormat()
+	default:
+		return nil, fmt.Errorf("Bad log format: %s", f)
+	}
+
+	var handlers []log.Handler
+
+	if path, _ := conf.Get("log", "file"); path != "" {
+		handler, err := log.FileHandler(path, format)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open log file: %v", err)
+		}
+		handlers = append(handlers, handler)
+	}
+
+	if tag, _ := conf.Get("log", "syslog"); tag != "" {
+		handler, err := log.SyslogHandler(tag, format)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to syslog: %v", err)
+		}
+		handlers = append(handlers, handler)
+	}
+
+	switch len(handlers) {
+	case 0:
+		return log.StreamHandler(os.Stdout, format), nil
+	case 1:
+		return handlers[0], nil
+	default:
+		return log.MultiHandler(handlers...), nil
+	}
+}
+
+func newLogger(conf ini.File, handler log.Handler) (log.Logger, error) {
 	level, _ := conf.Get("log", "level")
 	if level == "" {
 		level = "warn"
 	}
 
 	logger := log.New()
-	setFilterHandler(level, logger, log.StdoutHandler)
+	err := setFilterHandler(level, logger, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	return logger, nil
+}
+
+// newPgxLogger returns a logger for pgx filtered by log.pgx_level. It needs
+// its own root logger because child loggers share their parent's handler.
+func newPgxLogger(conf ini.File, handler log.Handler) (log.Logger, error) {
+	level, _ := conf.Get("log", "pgx_level")
+	if level == "" {
+		level = "warn"
+	}
+
+	logger := log.New("module", "pgx")
+	err := setFilterHandler(level, logger, handler)
+	if err != nil {
+		return nil, err
+	}
 
 	return logger, nil
 }
@@ -100,6 +209,7 @@ func loadHTTPConfig(c *cli.Context, conf ini.File) (httpConfig, error) {
 	config.listenAddress = c.String("address")
 	config.listenPort = c.String("port")
 	config.staticURL = c.String("static-url")
+	config.staticPath = c.String("static-path")
 
 	var ok bool
 	if !c.IsSet("address") {
@@ -114,9 +224,168 @@ func loadHTTPConfig(c *cli.Context, conf ini.File) (httpConfig, error) {
 		}
 	}
 
+	config.shutdownTimeout = 10 * time.Second
+	if s, ok := conf.Get("server", "shutdown_timeout"); ok {
+		var err error
+		config.shutdownTimeout, err = time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- shutdown_timeout: %v", err)
+		}
+	}
+
+	config.reconnectAfter = time.Second
+	if s, ok := conf.Get("server", "reconnect_after"); ok {
+		var err error
+		config.reconnectAfter, err = time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- reconnect_after: %v", err)
+		}
+	}
+
+	config.slowRequest = 500 * time.Millisecond
+	if s, ok := conf.Get("server", "slow_request_threshold"); ok {
+		var err error
+		config.slowRequest, err = time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- slow_request_threshold: %v", err)
+		}
+	}
+
+	config.pingInterval = 30 * time.Second
+	if s, ok := conf.Get("server", "ping_interval"); ok {
+		var err error
+		config.pingInterval, err = time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- ping_interval: %v", err)
+		}
+	}
+
+	config.idleTimeout = 75 * time.Second
+	if s, ok := conf.Get("server", "idle_timeout"); ok {
+		var err error
+		config.idleTimeout, err = time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- idle_timeout: %v", err)
+		}
+	}
+
+	if config.idleTimeout > 0 && config.idleTimeout <= config.pingInterval {
+		return config, errors.New("Config server.idle_timeout must be longer than server.ping_interval")
+	}
+
+	config.writeTimeout = 10 * time.Second
+	if s, ok := conf.Get("server", "write_timeout"); ok {
+		var err error
+		config.writeTimeout, err = time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- write_timeout: %v", err)
+		}
+	}
+
+	config.eventRetention = 24 * time.Hour
+	if s, ok := conf.Get("server", "event_retention"); ok {
+		var err error
+		config.eventRetention, err = time.ParseDuration(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- event_retention: %v", err)
+		}
+		if config.eventRetention <= 0 {
+			return config, fmt.Errorf("Invalid server -- event_retention: must be positive: %s", s)
+		}
+	}
+
+	config.maxConcurrentRequests = defaultMaxConcurrentRequests
+	if s, ok := conf.Get("server", "max_concurrent_requests"); ok {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n < 1 {
+			return config, fmt.Errorf("Invalid server -- max_concurrent_requests: must be a positive integer: %s", s)
+		}
+		config.maxConcurrentRequests = int(n)
+	}
+
+	if s, ok := conf.Get("server", "allowed_origins"); ok {
+		var err error
+		config.allowedOrigins, err = parseAllowedOrigins(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- allowed_origins: %v", err)
+		}
+	}
+
+	if s, ok := conf.Get("server", "trusted_proxies"); ok {
+		var err error
+		config.trustedProxies, err = parseTrustedProxies(s)
+		if err != nil {
+			return config, fmt.Errorf("Invalid server -- trusted_proxies: %v", err)
+		}
+	}
+
+	config.tlsCertFile, _ = conf.Get("server", "tls_cert")
+	config.tlsKeyFile, _ = conf.Get("server", "tls_key")
+	if (config.tlsCertFile == "") != (config.tlsKeyFile == "") {
+		return config, errors.New("Config must contain both server.tls_cert and server.tls_key or neither")
+	}
+
+	config.redirectPort, _ = conf.Get("server", "redirect_port")
+	if config.redirectPort != "" && config.tlsCertFile == "" {
+		return config, errors.New("Config must contain server.tls_cert to use server.redirect_port")
+	}
+
 	return config, nil
 }
 
+var defaultRateLimits = map[string]string{
+	"login":                     "10/1m",
+	"register":                  "5/1h",
+	"request_password_reset":    "5/1h",
+	"change_password":           "10/1m",
+	"change_email":              "5/1h",
+	"resend_verification_email": "5/1h",
+}
+
+// newRateLimiter builds the rate limiter described by the rate_limit section.
+// Limits are kept in memory unless store is database, which must be used
+// when running more than one server. It returns nil if rate limiting is
+// disabled.
+func newRateLimiter(conf ini.File, repo *PgxRepository) (*RateLimiter, error) {
+	if enabled, ok := conf.Get("rate_limit", "enabled"); ok {
+		enabled, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rate_limit -- enabled: %v", err)
+		}
+		if !enabled {
+			return nil, nil
+		}
+	}
+
+	var store RateLimitStore
+	switch s, _ := conf.Get("rate_limit", "store"); s {
+	case "", "memory":
+		store = NewMemoryRateLimitStore()
+	case "database":
+		store = repo
+	default:
+		return nil, fmt.Errorf("Invalid rate_limit -- store: %s", s)
+	}
+
+	limits := make(map[string]RateLimit, len(defaultRateLimits))
+	for method, s := range defaultRateLimits {
+		if configured, ok := conf.Get("rate_limit", method); ok {
+			s = configured
+		}
+		if s == "none" {
+			continue
+		}
+
+		limit, err := ParseRateLimit(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rate_limit -- %s: %v", method, err)
+		}
+		limits[method] = limit
+	}
+
+	return NewRateLimiter(store, limits), nil
+}
+
 func newMailer(conf ini.File, logger log.Logger) (Mailer, error) {
 	mailConf := conf.Section("mail")
 	if len(mailConf) == 0 {
@@ -160,6 +429,157 @@ func newMailer(conf ini.File, logger log.Logger) (Mailer, error) {
 	return mailer, nil
 }
 
+func newUnfurler(conf ini.File, repo Repository, logger log.Logger) (*Unfurler, error) {
+	unfurlConf := conf.Section("unfurl")
+
+	// Unfurling fetches whatever URLs users post so it must be turned on
+	// explicitly
+	var enabled bool
+	if s, ok := unfurlConf["enabled"]; ok {
+		var err error
+		enabled, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid unfurl -- enabled: %v", err)
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	timeout := 5 * time.Second
+	if s, ok := unfurlConf["timeout"]; ok {
+		var err error
+		timeout, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid unfurl -- timeout: %v", err)
+		}
+	}
+
+	maxBytes := int64(512 * 1024)
+	if s, ok := unfurlConf["max_bytes"]; ok {
+		var err error
+		maxBytes, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid unfurl -- max_bytes: %v", err)
+		}
+	}
+
+	var allowPrivateAddresses bool
+	if s, ok := unfurlConf["allow_private_addresses"]; ok {
+		var err error
+		allowPrivateAddresses, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid unfurl -- allow_private_addresses: %v", err)
+		}
+	}
+
+	failureTTL := 10 * time.Minute
+	if s, ok := unfurlConf["failure_ttl"]; ok {
+		var err error
+		failureTTL, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid unfurl -- failure_ttl: %v", err)
+		}
+	}
+
+	logger = logger.New("module", "unfurl")
+
+	unfurler := NewUnfurler(repo, timeout, maxBytes, allowPrivateAddresses, logger)
+	unfurler.FailureTTL = failureTTL
+	return unfurler, nil
+}
+
+func loadMigrations(conf ini.File) ([]Migration, error) {
+	fsys, err := fs.Sub(db.Migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadMigrations(fsys, conf.Section("data"))
+}
+
+func latestSchemaVersion() (int32, error) {
+	fsys, err := fs.Sub(db.Migrations, "migrations")
+	if err != nil {
+		return 0, err
+	}
+
+	return LatestMigrationVersion(fsys)
+}
+
+// getDatabaseSchemaVersion connects as the server does to read the schema
+// version. It does not use the server's connection pool because the pool
+// prepares statements that may not match an old schema.
+func getDatabaseSchemaVersion(connConfig pgx.ConnConfig) (int32, error) {
+	conn, err := pgx.Connect(connConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return getSchemaVersion(conn)
+}
+
+// newMigrator connects to the database as the [migrate] user if one is
+// configured. Migrations create tables and grant privileges to
+// data.app_user so they typically require more privileges than the server.
+func newMigrator(conf ini.File, connConfig pgx.ConnConfig) (*Migrator, error) {
+	migrations, err := loadMigrations(conf)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load migrations: %v", err)
+	}
+
+	if user, ok := conf.Get("migrate", "user"); ok {
+		connConfig.User = user
+		connConfig.Password, _ = conf.Get("migrate", "password")
+	}
+
+	conn, err := pgx.Connect(connConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to database: %v", err)
+	}
+
+	return NewMigrator(conn, migrations), nil
+}
+
+func Migrate(c *cli.Context) {
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		exitWithError(err)
+	}
+
+	connPoolConfig, err := loadConnPoolConfig(conf)
+	if err != nil {
+		exitWithError(fmt.Errorf("Unable to load database configuration: %v", err))
+	}
+
+	migrator, err := newMigrator(conf, connPoolConfig.ConnConfig)
+	if err != nil {
+		exitWithError(err)
+	}
+
+	destination := migrator.LatestVersion()
+	if d := c.String("destination"); d != "last" {
+		n, err := strconv.ParseInt(d, 10, 32)
+		if err != nil {
+			exitWithError(fmt.Errorf("Invalid destination: %v", err))
+		}
+		destination = int32(n)
+	}
+
+	migrator.OnStart = func(m Migration, direction string) {
+		fmt.Printf("Migrating %s: %s\n", direction, m.Name)
+	}
+
+	err = migrator.MigrateTo(destination)
+	migrator.Close()
+	if err != nil {
+		exitWithError(err)
+	}
+
+	fmt.Printf("Database schema is at version %d\n", destination)
+}
+
 func Serve(c *cli.Context) {
 	conf, err := loadConfig(c.String("config"))
 	if err != nil {
@@ -173,7 +593,13 @@ func Serve(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	logger, err := newLogger(conf)
+	logHandler, err := newLogHandler(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf, logHandler)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -181,55 +607,217 @@ func Serve(c *cli.Context) {
 
 	connPoolConfig, err := loadConnPoolConfig(conf)
 	if err != nil {
-		fmt.Println("Unable to load database configuration: %v", err)
+		logger.Crit("Unable to load database configuration", "error", err)
+		os.Exit(1)
+	}
+
+	connPoolConfig.Logger, err = newPgxLogger(conf, logHandler)
+	if err != nil {
+		logger.Crit("Unable to create pgx logger", "error", err)
+		os.Exit(1)
+	}
+
+	schemaVersion, err := latestSchemaVersion()
+	if err != nil {
+		logger.Crit("Unable to load migrations", "error", err)
+		os.Exit(1)
+	}
+
+	currentSchemaVersion, err := getDatabaseSchemaVersion(connPoolConfig.ConnConfig)
+	if err != nil {
+		logger.Crit("Unable to get database schema version", "error", err)
+		os.Exit(1)
+	}
+	if currentSchemaVersion != schemaVersion {
+		logger.Crit("Database schema is not current -- run jchat migrate", "version", currentSchemaVersion, "required", schemaVersion)
 		os.Exit(1)
 	}
 
 	preparedStatements, err := loadPreparedStatements(conf)
 	if err != nil {
-		fmt.Println("Unable to load database SQL: %v", err)
+		logger.Crit("Unable to load database SQL", "error", err)
 		os.Exit(1)
 	}
 
 	repo, err := NewPgxRepository(connPoolConfig, preparedStatements)
 	if err != nil {
-		fmt.Println("Unable to create PgxRepository: %v", err)
+		logger.Crit("Unable to create PgxRepository", "error", err)
+		os.Exit(1)
+	}
+
+	err = repo.ListenForEvents(logger.New("module", "events"))
+	if err != nil {
+		logger.Crit("Unable to listen for events", "error", err)
 		os.Exit(1)
 	}
 
 	mailer, err := newMailer(conf, logger)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		logger.Crit("Unable to create mailer", "error", err)
+		os.Exit(1)
+	}
+
+	rateLimiter, err := newRateLimiter(conf, repo)
+	if err != nil {
+		logger.Crit("Unable to create rate limiter", "error", err)
 		os.Exit(1)
 	}
 
-	if httpConfig.staticURL != "" {
+	unfurler, err := newUnfurler(conf, repo, logger)
+	if err != nil {
+		logger.Crit("Unable to create unfurler", "error", err)
+		os.Exit(1)
+	}
+	if unfurler != nil {
+		unfurler.Start()
+	}
+
+	eventPruner := NewEventPruner(repo, httpConfig.eventRetention, logger.New("module", "events"))
+	eventPruner.Start()
+
+	switch {
+	case httpConfig.staticURL != "":
 		staticURL, err := url.Parse(httpConfig.staticURL)
 		if err != nil {
-			logger.Crit(fmt.Sprintf("Bad static-url: %v", err))
+			logger.Crit("Bad static-url", "error", err)
 			os.Exit(1)
 		}
 		http.Handle("/", httputil.NewSingleHostReverseProxy(staticURL))
+	case httpConfig.staticPath != "":
+		http.Handle("/", http.FileServer(http.Dir(httpConfig.staticPath)))
+	case frontend.Assets != nil:
+		http.Handle("/", http.FileServer(http.FS(frontend.Assets)))
+	default:
+		logger.Warn("No static assets -- build with the assets tag or use --static-url or --static-path")
 	}
 
-	http.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
-		defer ws.Close()
+	clientConns := NewClientConns(httpConfig.reconnectAfter)
 
-		conn := &ClientConn{
-			ws:     ws,
-			repo:   repo,
-			logger: logger,
-			mailer: mailer,
-		}
+	repo.registerPoolMetrics(metrics)
+	http.Handle("/metrics", metrics)
+	http.Handle("/healthz", newHealthzHandler())
+	http.Handle("/readyz", newReadyzHandler(repo, schemaVersion, clientConns, 5*time.Second))
 
-		conn.Dispatch()
-	}))
+	http.Handle("/ws", websocket.Server{
+		Handshake: newOriginHandshake(httpConfig.allowedOrigins, logger),
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			conn := &ClientConn{
+				ws:     ws,
+				repo:   repo,
+				logger: logger,
+				mailer: mailer,
+
+				rateLimiter:           rateLimiter,
+				slowRequestThreshold:  httpConfig.slowRequest,
+				maxConcurrentRequests: httpConfig.maxConcurrentRequests,
+
+				pingInterval: httpConfig.pingInterval,
+				idleTimeout:  httpConfig.idleTimeout,
+				writeTimeout: httpConfig.writeTimeout,
+
+				trustedProxies: httpConfig.trustedProxies,
+			}
+
+			clientConns.Serve(conn)
+		},
+	})
 
 	listenAt := fmt.Sprintf("%s:%s", httpConfig.listenAddress, httpConfig.listenPort)
-	fmt.Printf("Starting to listen on: %s\n", listenAt)
+	logger.Info("Starting to listen", "address", listenAt)
 
-	if err := http.ListenAndServe(listenAt, nil); err != nil {
-		os.Stderr.WriteString("Could not start web server!\n")
-		os.Exit(1)
+	server := &http.Server{Addr: listenAt}
+	serverErrChan := make(chan error, 2)
+
+	var certReloader *CertReloader
+	if httpConfig.tlsCertFile != "" {
+		certReloader, err = NewCertReloader(httpConfig.tlsCertFile, httpConfig.tlsKeyFile)
+		if err != nil {
+			logger.Crit("Unable to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certReloader.GetCertificate}
+
+		go func() {
+			serverErrChan <- server.ListenAndServeTLS("", "")
+		}()
+	} else {
+		go func() {
+			serverErrChan <- server.ListenAndServe()
+		}()
+	}
+
+	var redirectServer *http.Server
+	if httpConfig.redirectPort != "" {
+		redirectServer = &http.Server{
+			Addr:    fmt.Sprintf("%s:%s", httpConfig.listenAddress, httpConfig.redirectPort),
+			Handler: newHTTPSRedirectHandler(httpConfig.listenPort),
+		}
+		logger.Info("Redirecting HTTP to HTTPS", "address", redirectServer.Addr)
+
+		go func() {
+			serverErrChan <- redirectServer.ListenAndServe()
+		}()
 	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+
+waitForShutdown:
+	for {
+		select {
+		case err := <-serverErrChan:
+			logger.Crit("Could not start web server", "error", err)
+			os.Exit(1)
+		case sig := <-signalChan:
+			if sig != syscall.SIGHUP {
+				logger.Info("Shutting down", "signal", sig)
+				break waitForShutdown
+			}
+
+			if certReloader != nil {
+				if err := certReloader.Reload(); err != nil {
+					logger.Error("Unable to reload TLS certificate", "error", err)
+				} else {
+					logger.Info("Reloaded TLS certificate")
+				}
+			}
+		}
+	}
+
+	// Stop accepting connections while client connections finish their
+	// in-flight requests.
+	ctx, cancel := context.WithTimeout(context.Background(), httpConfig.shutdownTimeout)
+	defer cancel()
+	shutdownErrChan := make(chan error, 1)
+	go func() {
+		shutdownErrChan <- server.Shutdown(ctx)
+	}()
+
+	drained := true
+	if err := clientConns.Shutdown(httpConfig.shutdownTimeout); err != nil {
+		logger.Warn("Client connections did not finish", "error", err)
+		drained = false
+	}
+	if err := <-shutdownErrChan; err != nil {
+		logger.Warn("HTTP server did not shut down cleanly", "error", err)
+	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+
+	if unfurler != nil {
+		unfurler.Stop()
+	}
+	eventPruner.Stop()
+	repo.StopListeningForEvents()
+
+	// Closing the pool waits for every acquired connection to be released so
+	// it could hang if client connections are still running.
+	if drained {
+		repo.Close()
+	}
+
+	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RenderMarkdown converts message source text into HTML. Only a small, safe
+// subset of Markdown is supported: fenced code blocks, block quotes, inline
+// code, bold, italics, links, and bare URLs. All other text is HTML escaped so
+// the result can be inserted directly into a page.
+func RenderMarkdown(source string) string {
+	source = strings.Replace(source, "\r\n", "\n", -1)
+	lines := strings.Split(source, "\n")
+
+	buf := &bytes.Buffer{}
+	renderMarkdownBlocks(buf, lines, 0)
+	return buf.String()
+}
+
+var codeFenceLanguageRegexp = regexp.MustCompile(`\A[a-zA-Z0-9_+-]+\z`)
+
+// maxMarkdownQuoteDepth is how deeply block quotes can nest. Deeper '>' are
+// rendered as text so a message cannot recurse without bound.
+const maxMarkdownQuoteDepth = 8
+
+func renderMarkdownBlocks(buf *bytes.Buffer, lines []string, quoteDepth int) {
+	isQuote := func(l string) bool {
+		return quoteDepth < maxMarkdownQuoteDepth && strings.HasPrefix(l, ">")
+	}
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case strings.HasPrefix(line, "```"):
+			language := strings.TrimSpace(line[3:])
+			i++
+
+			var code []string
+			for ; i < len(lines); i++ {
+				if strings.HasPrefix(lines[i], "```") {
+					i++
+					break
+				}
+				code = append(code, lines[i])
+			}
+
+			buf.WriteString("<pre><code")
+			if codeFenceLanguageRegexp.MatchString(language) {
+				buf.WriteString(` class="language-`)
+				buf.WriteString(language)
+				buf.WriteString(`"`)
+			}
+			buf.WriteString(">")
+			buf.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			buf.WriteString("</code></pre>")
+
+		case isQuote(line):
+			var quoted []string
+			for ; i < len(lines) && isQuote(lines[i]); i++ {
+				l := lines[i][1:]
+				if strings.HasPrefix(l, " ") {
+					l = l[1:]
+				}
+				quoted = append(quoted, l)
+			}
+
+			buf.WriteString("<blockquote>")
+			renderMarkdownBlocks(buf, quoted, quoteDepth+1)
+			buf.WriteString("</blockquote>")
+
+		default:
+			buf.WriteString("<p>")
+			for first := true; i < len(lines); i++ {
+				l := lines[i]
+				if strings.TrimSpace(l) == "" || strings.HasPrefix(l, "```") || isQuote(l) {
+					break
+				}
+				if !first {
+					buf.WriteString("<br>")
+				}
+				renderMarkdownInline(buf, l, true)
+				first = false
+			}
+			buf.WriteString("</p>")
+		}
+	}
+}
+
+func renderMarkdownInline(buf *bytes.Buffer, text string, allowLinks bool) {
+	start := 0
+	flush := func(end int) {
+		buf.WriteString(html.EscapeString(text[start:end]))
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+
+		switch {
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+				flush(i)
+				buf.WriteString("<code>")
+				buf.WriteString(html.EscapeString(rest[1 : end+1]))
+				buf.WriteString("</code>")
+				i += end + 2
+				start = i
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**"):
+			if end := strings.Index(rest[2:], "**"); end > 0 {
+				flush(i)
+				buf.WriteString("<strong>")
+				renderMarkdownInline(buf, rest[2:end+2], allowLinks)
+				buf.WriteString("</strong>")
+				i += end + 4
+				start = i
+				continue
+			}
+
+		case rest[0] == '*':
+			if end := strings.IndexByte(rest[1:], '*'); end > 0 {
+				flush(i)
+				buf.WriteString("<em>")
+				renderMarkdownInline(buf, rest[1:end+1], allowLinks)
+				buf.WriteString("</em>")
+				i += end + 2
+				start = i
+				continue
+			}
+
+		case rest[0] == '[' && allowLinks:
+			textEnd := strings.Index(rest, "](")
+			if textEnd > 1 {
+				urlEnd := strings.IndexByte(rest[textEnd+2:], ')')
+				if urlEnd > 0 {
+					if href, ok := sanitizeURL(rest[textEnd+2 : textEnd+2+urlEnd]); ok {
+						flush(i)
+						writeLinkOpen(buf, href)
+						renderMarkdownInline(buf, rest[1:textEnd], false)
+						buf.WriteString("</a>")
+						i += textEnd + 2 + urlEnd + 1
+						start = i
+						continue
+					}
+				}
+			}
+
+		case allowLinks && (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) && isWordBoundary(text, i):
+			end := strings.IndexAny(rest, " \t")
+			if end == -1 {
+				end = len(rest)
+			}
+			end = len(strings.TrimRight(rest[:end], ".,;:!?)'\""))
+			if href, ok := sanitizeURL(rest[:end]); ok {
+				flush(i)
+				writeLinkOpen(buf, href)
+				buf.WriteString(html.EscapeString(rest[:end]))
+				buf.WriteString("</a>")
+				i += end
+				start = i
+				continue
+			}
+		}
+
+		i++
+	}
+
+	flush(len(text))
+}
+
+func writeLinkOpen(buf *bytes.Buffer, href string) {
+	buf.WriteString(`<a href="`)
+	buf.WriteString(html.EscapeString(href))
+	buf.WriteString(`" rel="nofollow noopener" target="_blank">`)
+}
+
+func isWordBoundary(text string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	return strings.IndexByte(" \t([<\"'", text[i-1]) != -1
+}
+
+// sanitizeURL returns the normalized form of rawURL if it is an absolute URL
+// with a scheme that is safe to link to.
+func sanitizeURL(rawURL string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return "", false
+		}
+	case "mailto":
+	default:
+		return "", false
+	}
+
+	return u.String(), true
+}
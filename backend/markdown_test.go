@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		source string
+		html   string
+	}{
+		{"Hello, world", "<p>Hello, world</p>"},
+		{"line one\nline two", "<p>line one<br>line two</p>"},
+		{"para one\n\npara two", "<p>para one</p><p>para two</p>"},
+		{"some **bold** text", "<p>some <strong>bold</strong> text</p>"},
+		{"some *italic* text", "<p>some <em>italic</em> text</p>"},
+		{"use `a < b` here", "<p>use <code>a &lt; b</code> here</p>"},
+		{"```\nfunc main() {\n\t<b>\n}\n```", "<pre><code>func main() {\n\t&lt;b&gt;\n}</code></pre>"},
+		{"```go\nx := 1\n```", `<pre><code class="language-go">x := 1</code></pre>`},
+		{"```\" onclick=\"alert(1)\nx\n```", "<pre><code>x</code></pre>"},
+		{"> quoted\n> text\n\nreply", "<blockquote><p>quoted<br>text</p></blockquote><p>reply</p>"},
+		{"[JChat](http://example.com/a?b=1&c=2)", `<p><a href="http://example.com/a?b=1&amp;c=2" rel="nofollow noopener" target="_blank">JChat</a></p>`},
+		{"see http://example.com.", `<p>see <a href="http://example.com" rel="nofollow noopener" target="_blank">http://example.com</a>.</p>`},
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"[click](javascript:alert(1))", "<p>[click](javascript:alert(1))</p>"},
+		{`[x](http://example.com/"onmouseover="alert(1))`, `<p><a href="http://example.com/%22onmouseover=%22alert%281" rel="nofollow noopener" target="_blank">x</a>)</p>`},
+		{"**unclosed", "<p>**unclosed</p>"},
+		{">>>>>>>>>> deep", strings.Repeat("<blockquote>", maxMarkdownQuoteDepth) + "<p>&gt;&gt; deep</p>" + strings.Repeat("</blockquote>", maxMarkdownQuoteDepth)},
+	}
+
+	for i, tt := range tests {
+		html := RenderMarkdown(tt.source)
+		if html != tt.html {
+			t.Errorf("%d. Expected RenderMarkdown(%q) to return %q, but it was %q", i, tt.source, tt.html, html)
+		}
+	}
+}
+
+func TestRenderMarkdownDeeplyNestedQuotes(t *testing.T) {
+	t.Parallel()
+
+	html := RenderMarkdown(strings.Repeat(">", 1<<20))
+	if strings.Count(html, "<blockquote>") != maxMarkdownQuoteDepth {
+		t.Errorf("Expected %d nested block quotes, but there were %d", maxMarkdownQuoteDepth, strings.Count(html, "<blockquote>"))
+	}
+}
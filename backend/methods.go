@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"runtime/debug"
+	"strconv"
+)
+
+// MethodFunc handles a call to a JSON-RPC method. params is the decoded
+// params or nil if the method does not take any.
+type MethodFunc func(conn *ClientConn, params interface{}) Response
+
+// Method describes a JSON-RPC method that can be called by clients.
+type Method struct {
+	// Params returns a pointer to a new value to decode the request params
+	// into. It is nil if the method takes no params. If the value has a
+	// validate method it is called after decoding.
+	Params func() interface{}
+
+	// RequireAuth rejects calls from connections that have not logged in.
+	RequireAuth bool
+
+	// RequireVerifiedEmail rejects calls from users that have not verified
+	// their email address. It should be used with RequireAuth.
+	RequireVerifiedEmail bool
+
+	// Exclusive methods change the connection's user. They wait for every
+	// request received before them to finish and requests received after
+	// them wait until they are done.
+	Exclusive bool
+
+	// SendsMail methods can send email. Each must have a default rate limit
+	// so it cannot be used to flood someone's inbox.
+	SendsMail bool
+
+	Func MethodFunc
+}
+
+// Call is a single call of a method as it passes through the middleware.
+type Call struct {
+	Name string
+
+	// Method is nil if no method named Name is registered.
+	Method  *Method
+	Request Request
+
+	// Params is set by DecodeParams.
+	Params interface{}
+
+	Trace  *RequestTrace
+	Logger log.Logger
+}
+
+// CallHandler handles a call and returns the response.
+type CallHandler func(conn *ClientConn, call *Call) Response
+
+// Middleware wraps a CallHandler to run code before or after the calls it
+// handles or to handle calls itself.
+type Middleware func(next CallHandler) CallHandler
+
+// validator is implemented by params that can check themselves after they
+// are decoded.
+type validator interface {
+	validate() *Error
+}
+
+// rateLimitKeyer is implemented by params that include the email address
+// that a rate limit should apply to.
+type rateLimitKeyer interface {
+	rateLimitEmail() string
+}
+
+// MethodRegistry maps method names to Methods and calls them through a
+// chain of middleware.
+type MethodRegistry struct {
+	methods    map[string]*Method
+	middleware []Middleware
+	handler    CallHandler
+}
+
+func NewMethodRegistry() *MethodRegistry {
+	return &MethodRegistry{
+		methods: make(map[string]*Method),
+		handler: callMethod,
+	}
+}
+
+// Register adds a method named name. It panics if name is already registered.
+func (r *MethodRegistry) Register(name string, method Method) {
+	if _, ok := r.methods[name]; ok {
+		panic(fmt.Sprintf("method %s is already registered", name))
+	}
+	r.methods[name] = &method
+}
+
+// Use appends middleware to the chain. The first middleware added is the
+// outermost.
+func (r *MethodRegistry) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+
+	r.handler = callMethod
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		r.handler = r.middleware[i](r.handler)
+	}
+}
+
+// Lookup returns the method named name or nil if there is none.
+func (r *MethodRegistry) Lookup(name string) *Method {
+	return r.methods[name]
+}
+
+// Call passes call through the middleware to its method.
+func (r *MethodRegistry) Call(conn *ClientConn, call *Call) Response {
+	return r.handler(conn, call)
+}
+
+// callMethod is the end of every middleware chain.
+func callMethod(conn *ClientConn, call *Call) (response Response) {
+	if call.Method == nil {
+		response.Error = errorWithData(JSONRPCMethodNotFound, call.Name)
+		return response
+	}
+
+	return call.Method.Func(conn, call.Params)
+}
+
+// responseCode returns the error code of response or 0 if it succeeded.
+func responseCode(response Response) int32 {
+	if response.Error != nil {
+		return response.Error.Code
+	}
+	return 0
+}
+
+// TraceRequests gives the rest of the chain a logger and repository that
+// carry the call's context and record its database time in call.Trace.
+func TraceRequests(next CallHandler) CallHandler {
+	return func(conn *ClientConn, call *Call) Response {
+		connLogger, connRepo := conn.logger, conn.repo
+		defer func() { conn.logger, conn.repo = connLogger, connRepo }()
+
+		conn.logger = connLogger.New("method", call.Name, "request_id", string(call.Request.ID), "trace_id", call.Trace.ID)
+		if connRepo != nil {
+			conn.repo = NewTracedRepository(connRepo, call.Trace, conn.logger)
+		}
+		call.Logger = conn.logger
+
+		return next(conn, call)
+	}
+}
+
+// CountRequests records the count and duration of calls by method and
+// response code. Unknown methods are counted together.
+func CountRequests(next CallHandler) CallHandler {
+	return func(conn *ClientConn, call *Call) Response {
+		response := next(conn, call)
+
+		method := call.Name
+		if call.Method == nil {
+			method = "unknown"
+		}
+		code := strconv.FormatInt(int64(responseCode(response)), 10)
+		metrics.Inc("jchat_rpc_requests_total", "method", method, "code", code)
+		metrics.ObserveSince("jchat_rpc_request_duration_seconds", call.Trace.Start, "method", method)
+
+		return response
+	}
+}
+
+// RecoverPanics turns a panic in the rest of the chain into an internal
+// error so one bad request does not take down the connection.
+func RecoverPanics(next CallHandler) CallHandler {
+	return func(conn *ClientConn, call *Call) (response Response) {
+		defer func() {
+			if r := recover(); r != nil {
+				conn.logger.Crit("Panic while handling request", "panic", r, "stack", string(debug.Stack()))
+				response = Response{Error: errorWithData(JSONRPCInternalError, "Internal error")}
+			}
+		}()
+
+		return next(conn, call)
+	}
+}
+
+// RequireAuth enforces the method's RequireAuth and RequireVerifiedEmail.
+func RequireAuth(next CallHandler) CallHandler {
+	return func(conn *ClientConn, call *Call) (response Response) {
+		if call.Method == nil {
+			return next(conn, call)
+		}
+
+		if call.Method.RequireAuth && conn.user.ID == 0 {
+			response.Error = &JSONRPCUnauthenticatedError
+			return response
+		}
+
+		if call.Method.RequireVerifiedEmail {
+			if response.Error = conn.requireVerifiedEmail(); response.Error != nil {
+				return response
+			}
+		}
+
+		return next(conn, call)
+	}
+}
+
+// DecodeParams decodes and validates the request params into the method's
+// params type.
+func DecodeParams(next CallHandler) CallHandler {
+	return func(conn *ClientConn, call *Call) (response Response) {
+		if call.Method == nil || call.Method.Params == nil {
+			return next(conn, call)
+		}
+
+		params := call.Method.Params()
+		err := json.Unmarshal(call.Request.Params, params)
+		if err != nil {
+			response.Error = errorWithData(JSONRPCInvalidParams, err.Error())
+			return response
+		}
+
+		if v, ok := params.(validator); ok {
+			if response.Error = v.validate(); response.Error != nil {
+				return response
+			}
+		}
+
+		call.Params = params
+		return next(conn, call)
+	}
+}
+
+// LimitRate applies the connection's rate limits to the call. It must come
+// after DecodeParams so the email address in the params can be limited.
+func LimitRate(next CallHandler) CallHandler {
+	return func(conn *ClientConn, call *Call) (response Response) {
+		if call.Method == nil {
+			return next(conn, call)
+		}
+
+		var email string
+		if k, ok := call.Params.(rateLimitKeyer); ok {
+			email = k.rateLimitEmail()
+		}
+
+		if response.Error = conn.takeRateLimitToken(call.Name, email); response.Error != nil {
+			return response
+		}
+
+		return next(conn, call)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"testing"
+)
+
+type testEcho struct {
+	Text string `json:"text"`
+}
+
+func (e *testEcho) validate() *Error {
+	if e.Text == "" {
+		return errorWithData(JSONRPCInvalidParams, `Request must include the attribute "text"`)
+	}
+	return nil
+}
+
+func newTestMethodConn() *ClientConn {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	return &ClientConn{logger: logger}
+}
+
+func newTestMethodRegistry() *MethodRegistry {
+	r := NewMethodRegistry()
+	r.Use(TraceRequests, CountRequests, RecoverPanics, RequireAuth, DecodeParams, LimitRate)
+
+	r.Register("echo", Method{
+		Params: func() interface{} { return &testEcho{} },
+		Func: func(conn *ClientConn, params interface{}) (response Response) {
+			response.Result = params.(*testEcho).Text
+			return response
+		},
+	})
+	r.Register("whoami", Method{
+		RequireAuth: true,
+		Func: func(conn *ClientConn, params interface{}) (response Response) {
+			response.Result = conn.user.ID
+			return response
+		},
+	})
+	r.Register("panic", Method{
+		Func: func(conn *ClientConn, params interface{}) Response {
+			panic("boom")
+		},
+	})
+
+	return r
+}
+
+func callTestMethod(r *MethodRegistry, conn *ClientConn, method, params string) Response {
+	call := &Call{
+		Name:    method,
+		Method:  r.Lookup(method),
+		Request: Request{Method: method, Params: json.RawMessage(params), ID: json.RawMessage("1")},
+		Trace:   NewRequestTrace(),
+		Logger:  conn.logger,
+	}
+	return r.Call(conn, call)
+}
+
+func TestMethodRegistryCall(t *testing.T) {
+	t.Parallel()
+
+	r := newTestMethodRegistry()
+
+	tests := []struct {
+		user   User
+		method string
+		params string
+		result interface{}
+		code   int32
+	}{
+		{method: "echo", params: `{"text":"hello"}`, result: "hello"},
+		{method: "echo", params: `{"text":""}`, code: JSONRPCInvalidParams.Code},
+		{method: "echo", params: `{"text":42}`, code: JSONRPCInvalidParams.Code},
+		{method: "whoami", params: `{}`, code: JSONRPCUnauthenticatedError.Code},
+		{user: User{ID: 7}, method: "whoami", params: `{}`, result: int32(7)},
+		{method: "panic", params: `{}`, code: JSONRPCInternalError.Code},
+		{method: "missing", params: `{}`, code: JSONRPCMethodNotFound.Code},
+	}
+
+	for i, tt := range tests {
+		conn := newTestMethodConn()
+		conn.user = tt.user
+
+		response := callTestMethod(r, conn, tt.method, tt.params)
+		if code := responseCode(response); code != tt.code {
+			t.Errorf("%d. Expected error code %d, but it was %d", i, tt.code, code)
+			continue
+		}
+		if response.Result != tt.result {
+			t.Errorf("%d. Expected result %v, but it was %v", i, tt.result, response.Result)
+		}
+	}
+}
+
+func TestMethodRegistryMiddlewareOrder(t *testing.T) {
+	t.Parallel()
+
+	var order []string
+	record := func(name string) Middleware {
+		return func(next CallHandler) CallHandler {
+			return func(conn *ClientConn, call *Call) Response {
+				order = append(order, name)
+				return next(conn, call)
+			}
+		}
+	}
+
+	r := NewMethodRegistry()
+	r.Use(record("first"), record("second"))
+	r.Use(record("third"))
+	r.Register("noop", Method{
+		Func: func(conn *ClientConn, params interface{}) Response {
+			order = append(order, "method")
+			return Response{}
+		},
+	})
+
+	callTestMethod(r, newTestMethodConn(), "noop", `{}`)
+
+	expected := []string{"first", "second", "third", "method"}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected calls %v, but they were %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("Expected calls %v, but they were %v", expected, order)
+		}
+	}
+}
+
+func TestMethodRegistryRestoresConnLogger(t *testing.T) {
+	t.Parallel()
+
+	r := newTestMethodRegistry()
+	conn := newTestMethodConn()
+	connLogger := conn.logger
+
+	callTestMethod(r, conn, "panic", `{}`)
+
+	if conn.logger != connLogger {
+		t.Fatal("Expected conn.logger to be restored after the call, but it was not")
+	}
+}
+
+func TestMethodRegistryRegisterDuplicatePanics(t *testing.T) {
+	t.Parallel()
+
+	r := NewMethodRegistry()
+	r.Register("noop", Method{})
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected registering a duplicate method to panic, but it did not")
+		}
+	}()
+	r.Register("noop", Method{})
+}
+
+func TestDefaultMethodsRequireAuth(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"init_chat", "post_message", "create_channel", "rename_channel", "delete_channel", "change_password"} {
+		response := callTestMethod(defaultMethods, newTestMethodConn(), name, `{}`)
+		if code := responseCode(response); code != JSONRPCUnauthenticatedError.Code {
+			t.Errorf("Expected %s to return error code %d, but it was %d", name, JSONRPCUnauthenticatedError.Code, code)
+		}
+	}
+}
+
+func TestDefaultRateLimitsCoverMethodsThatSendMail(t *testing.T) {
+	t.Parallel()
+
+	for name, method := range defaultMethods.methods {
+		if !method.SendsMail {
+			continue
+		}
+		if _, ok := defaultRateLimits[name]; !ok {
+			t.Errorf("Expected %s to have a default rate limit because it sends mail, but it did not", name)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics is the registry the server exposes at /metrics.
+var metrics = NewMetrics()
+
+var defaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func init() {
+	metrics.Describe("jchat_websocket_connections", "gauge", "Number of active websocket connections.")
+	metrics.Describe("jchat_websocket_timeouts_total", "counter", "Number of websocket connections closed because a read or write timed out.")
+	metrics.Describe("jchat_websocket_event_overflows_total", "counter", "Number of websocket connections closed because they fell too far behind on notifications.")
+	metrics.Describe("jchat_rpc_requests_total", "counter", "Number of JSON-RPC requests by method and error code. Code 0 is success.")
+	metrics.Describe("jchat_rpc_request_duration_seconds", "histogram", "JSON-RPC request latency by method.")
+	metrics.Describe("jchat_notification_dispatches_pending", "gauge", "Number of notifications waiting to be delivered to all listeners by signal.")
+	metrics.Describe("jchat_unfurl_queue_depth", "gauge", "Number of posted messages waiting to be unfurled.")
+	metrics.Describe("jchat_db_pool_connections", "gauge", "Number of database connections by state.")
+	metrics.Describe("jchat_db_pool_max_connections", "gauge", "Maximum number of database connections.")
+	metrics.Describe("jchat_mails_sent_total", "counter", "Number of mails sent by kind and outcome.")
+}
+
+type metricDesc struct {
+	typ  string
+	help string
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Metrics is a minimal registry of counters, gauges, and histograms that can
+// be scraped by Prometheus. Labels are given as alternating names and values.
+type Metrics struct {
+	mutex      sync.Mutex
+	descs      map[string]metricDesc
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+	gaugeFuncs map[string]map[string]func() float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		descs:      make(map[string]metricDesc),
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+		gaugeFuncs: make(map[string]map[string]func() float64),
+	}
+}
+
+// Describe sets the type and help text for the metric name.
+func (m *Metrics) Describe(name, typ, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.descs[name] = metricDesc{typ: typ, help: help}
+}
+
+// Add adds delta to the counter or gauge name.
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	key := formatLabels(labels)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][key] += delta
+}
+
+// Inc adds 1 to the counter or gauge name.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Dec subtracts 1 from the gauge name.
+func (m *Metrics) Dec(name string, labels ...string) {
+	m.Add(name, -1, labels...)
+}
+
+// Observe records value in the histogram name.
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	key := formatLabels(labels)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	h := m.histograms[name][key]
+	if h == nil {
+		h = &histogram{buckets: defaultHistogramBuckets, counts: make([]uint64, len(defaultHistogramBuckets))}
+		m.histograms[name][key] = h
+	}
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince records the seconds elapsed since start in the histogram name.
+func (m *Metrics) ObserveSince(name string, start time.Time, labels ...string) {
+	m.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// GaugeFunc registers f to be called for the value of the gauge name each
+// time the metrics are scraped. It replaces any previous f with the same
+// labels.
+func (m *Metrics) GaugeFunc(name string, f func() float64, labels ...string) {
+	key := formatLabels(labels)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.gaugeFuncs[name] == nil {
+		m.gaugeFuncs[name] = make(map[string]func() float64)
+	}
+	m.gaugeFuncs[name][key] = f
+}
+
+// Value returns the current value of the counter or gauge name.
+func (m *Metrics) Value(name string, labels ...string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.values[name][formatLabels(labels)]
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(buf *bytes.Buffer) {
+	m.mutex.Lock()
+	gaugeValues := make(map[string]map[string]float64)
+	gaugeFuncs := make(map[string]map[string]func() float64)
+	for name, fs := range m.gaugeFuncs {
+		gaugeFuncs[name] = make(map[string]func() float64, len(fs))
+		for key, f := range fs {
+			gaugeFuncs[name][key] = f
+		}
+	}
+	m.mutex.Unlock()
+
+	// Gauge funcs may acquire other locks so call them without holding ours
+	for name, fs := range gaugeFuncs {
+		gaugeValues[name] = make(map[string]float64, len(fs))
+		for key, f := range fs {
+			gaugeValues[name][key] = f()
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := make(map[string]bool)
+	for name := range m.values {
+		names[name] = true
+	}
+	for name := range m.histograms {
+		names[name] = true
+	}
+	for name := range gaugeValues {
+		names[name] = true
+	}
+
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	for _, name := range sortedNames {
+		if desc, ok := m.descs[name]; ok {
+			fmt.Fprintf(buf, "# HELP %s %s\n", name, desc.help)
+			fmt.Fprintf(buf, "# TYPE %s %s\n", name, desc.typ)
+		}
+
+		values := make(map[string]float64)
+		for key, v := range m.values[name] {
+			values[key] = v
+		}
+		for key, v := range gaugeValues[name] {
+			values[key] = v
+		}
+		for _, key := range sortedKeys(values) {
+			fmt.Fprintf(buf, "%s%s %s\n", name, key, formatFloat(values[key]))
+		}
+
+		hs := m.histograms[name]
+		keys := make([]string, 0, len(hs))
+		for key := range hs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h := hs[key]
+			for i, upperBound := range h.buckets {
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", name, addLabel(key, "le", formatFloat(upperBound)), h.counts[i])
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", name, addLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", name, key, formatFloat(h.sum))
+			fmt.Fprintf(buf, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelValueReplacer.Replace(labels[i+1])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func addLabel(key, name, value string) string {
+	label := fmt.Sprintf(`%s="%s"`, name, value)
+	if key == "" {
+		return "{" + label + "}"
+	}
+	return key[:len(key)-1] + "," + label + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	t.Parallel()
+
+	m := NewMetrics()
+	m.Describe("test_requests_total", "counter", "Number of requests.")
+	m.Describe("test_latency_seconds", "histogram", "Request latency.")
+
+	m.Inc("test_requests_total", "method", "login", "code", "0")
+	m.Inc("test_requests_total", "method", "login", "code", "0")
+	m.Inc("test_requests_total", "method", `say "hi"`, "code", "4001")
+	m.Add("test_connections", 3)
+	m.Dec("test_connections")
+	m.GaugeFunc("test_queue_depth", func() float64 { return 7 })
+	m.Observe("test_latency_seconds", 0.03, "method", "login")
+	m.Observe("test_latency_seconds", 20, "method", "login")
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+	output := buf.String()
+
+	expectedLines := []string{
+		"# HELP test_requests_total Number of requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{method="login",code="0"} 2`,
+		`test_requests_total{method="say \"hi\"",code="4001"} 1`,
+		"test_connections 2",
+		"test_queue_depth 7",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{method="login",le="0.025"} 0`,
+		`test_latency_seconds_bucket{method="login",le="0.05"} 1`,
+		`test_latency_seconds_bucket{method="login",le="10"} 1`,
+		`test_latency_seconds_bucket{method="login",le="+Inf"} 2`,
+		`test_latency_seconds_sum{method="login"} 20.03`,
+		`test_latency_seconds_count{method="login"} 2`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected output to contain %q, but it did not:\n%s", line, output)
+		}
+	}
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	m := NewMetrics()
+	m.Inc("test_total")
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("Expected Content-Type to be text/plain, but it was %s", contentType)
+	}
+	if body := w.Body.String(); body != "test_total 1\n" {
+		t.Errorf("Expected body to be %q, but it was %q", "test_total 1\n", body)
+	}
+}
+
+func TestClientConnCountsRequests(t *testing.T) {
+	server := getTestWsServer(t, nil)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	before := metrics.Value("jchat_rpc_requests_total", "method", "unknown", "code", "-32601")
+
+	request := struct {
+		Method string `json:"method"`
+		ID     int32  `json:"id"`
+	}{Method: "no_such_method", ID: 1}
+	err := websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response Response
+	err = websocket.JSON.Receive(ws, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := metrics.Value("jchat_rpc_requests_total", "method", "unknown", "code", "-32601")
+	if after != before+1 {
+		t.Errorf("Expected jchat_rpc_requests_total to increase by 1, but it went from %v to %v", before, after)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jackc/pgx"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// versionTable is compatible with the table tern uses so databases that were
+// migrated with tern can be migrated by jchat.
+const versionTable = "schema_version"
+
+const migrationSeparator = "---- create above / drop below ----"
+
+var migrationFileRegexp = regexp.MustCompile(`\A(\d+)_.+\.sql\z`)
+
+type Migration struct {
+	Sequence int32
+	Name     string
+	UpSQL    string
+	DownSQL  string
+}
+
+// LoadMigrations reads the migrations in the root of fsys and renders each as
+// a text/template with data. Migrations must be numbered consecutively from 1.
+func LoadMigrations(fsys fs.FS, data map[string]string) ([]Migration, error) {
+	migrations, err := findMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range migrations {
+		m := &migrations[i]
+
+		body, err := fs.ReadFile(fsys, m.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		tmpl, err := template.New(m.Name).Option("missingkey=error").Parse(string(body))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := &bytes.Buffer{}
+		err = tmpl.Execute(buf, data)
+		if err != nil {
+			return nil, err
+		}
+
+		parts := strings.SplitN(buf.String(), migrationSeparator, 2)
+		m.UpSQL = strings.TrimSpace(parts[0])
+		if len(parts) == 2 {
+			m.DownSQL = strings.TrimSpace(parts[1])
+		}
+	}
+
+	return migrations, nil
+}
+
+// LatestMigrationVersion returns the version the migrations in the root of
+// fsys migrate to without reading or rendering them.
+func LatestMigrationVersion(fsys fs.FS) (int32, error) {
+	migrations, err := findMigrations(fsys)
+	if err != nil {
+		return 0, err
+	}
+
+	return int32(len(migrations)), nil
+}
+
+// findMigrations returns the migrations in the root of fsys in order with only
+// Sequence and Name set.
+func findMigrations(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(paths))
+
+	for _, p := range paths {
+		name := path.Base(p)
+		m := migrationFileRegexp.FindStringSubmatch(name)
+		if m == nil {
+			return nil, fmt.Errorf("Invalid migration file name: %s", name)
+		}
+
+		n, err := strconv.ParseInt(m[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid migration file name: %s", name)
+		}
+
+		migrations = append(migrations, Migration{Sequence: int32(n), Name: name})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Sequence < migrations[j].Sequence })
+
+	for i, m := range migrations {
+		if m.Sequence != int32(i+1) {
+			return nil, fmt.Errorf("Missing migration %d -- found %s instead", i+1, m.Name)
+		}
+	}
+
+	return migrations, nil
+}
+
+type Migrator struct {
+	conn       *pgx.Conn
+	Migrations []Migration
+
+	// OnStart is called before each migration is run if it is not nil.
+	OnStart func(m Migration, direction string)
+}
+
+func NewMigrator(conn *pgx.Conn, migrations []Migration) *Migrator {
+	return &Migrator{conn: conn, Migrations: migrations}
+}
+
+// GetCurrentVersion returns the version of the database schema. A database
+// that has never been migrated is at version 0.
+func (m *Migrator) GetCurrentVersion() (version int32, err error) {
+	return getSchemaVersion(m.conn)
+}
+
+func getSchemaVersion(q queryRower) (version int32, err error) {
+	err = q.QueryRow("select version from " + versionTable).Scan(&version)
+	if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "42P01" {
+		return 0, nil
+	}
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+
+	return version, err
+}
+
+// LatestVersion returns the version the database will be at after all
+// migrations have been run.
+func (m *Migrator) LatestVersion() int32 {
+	return int32(len(m.Migrations))
+}
+
+// MigrateTo runs migrations up or down until the database is at
+// targetVersion. Each migration runs in its own transaction.
+func (m *Migrator) MigrateTo(targetVersion int32) error {
+	if targetVersion < 0 || m.LatestVersion() < targetVersion {
+		return fmt.Errorf("Destination version %d is outside the valid range of 0 to %d", targetVersion, m.LatestVersion())
+	}
+
+	err := m.ensureVersionTable()
+	if err != nil {
+		return err
+	}
+
+	currentVersion, err := m.GetCurrentVersion()
+	if err != nil {
+		return err
+	}
+	if m.LatestVersion() < currentVersion {
+		return fmt.Errorf("Database schema is at version %d which is newer than the latest known version %d", currentVersion, m.LatestVersion())
+	}
+
+	for currentVersion != targetVersion {
+		var migration Migration
+		var sql, direction string
+		var nextVersion int32
+
+		if currentVersion < targetVersion {
+			migration = m.Migrations[currentVersion]
+			sql, direction, nextVersion = migration.UpSQL, "up", currentVersion+1
+		} else {
+			migration = m.Migrations[currentVersion-1]
+			sql, direction, nextVersion = migration.DownSQL, "down", currentVersion-1
+			if sql == "" {
+				return fmt.Errorf("Migration %s is irreversible", migration.Name)
+			}
+		}
+
+		if m.OnStart != nil {
+			m.OnStart(migration, direction)
+		}
+
+		err = m.runMigration(sql, currentVersion, nextVersion)
+		if err != nil {
+			return fmt.Errorf("Migration %s %s failed: %v", migration.Name, direction, err)
+		}
+
+		currentVersion = nextVersion
+	}
+
+	return nil
+}
+
+func (m *Migrator) runMigration(sql string, currentVersion, nextVersion int32) error {
+	tx, err := m.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the version row so concurrent migrators cannot both run the same
+	// migration.
+	var lockedVersion int32
+	err = tx.QueryRow("select version from " + versionTable + " for update").Scan(&lockedVersion)
+	if err != nil {
+		return err
+	}
+	if lockedVersion != currentVersion {
+		return fmt.Errorf("Database schema version changed from %d to %d by another migrator", currentVersion, lockedVersion)
+	}
+
+	_, err = tx.Exec(sql)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("update "+versionTable+" set version=$1", nextVersion)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) ensureVersionTable() error {
+	_, err := m.conn.Exec(fmt.Sprintf(`
+		create table if not exists %s(version int4 not null);
+
+		insert into %s(version)
+		select 0
+		where 0=(select count(*) from %s);
+	`, versionTable, versionTable, versionTable))
+	return err
+}
+
+func (m *Migrator) Close() error {
+	return m.conn.Close()
+}
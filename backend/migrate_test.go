@@ -0,0 +1,256 @@
+package main
+
+import (
+	"github.com/jackc/pgx"
+	"github.com/vaughan0/go-ini"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const migrateTestSchema = "jchat_migrate_test"
+
+// getMigrateTestConn connects to the test database as the migrate user if
+// one is configured. The connection uses an empty schema of its own so test
+// migrations cannot touch the tables of the other tests.
+func getMigrateTestConn(t testing.TB) *pgx.Conn {
+	conf, err := ini.LoadFile("../jchat.test.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connPoolConfig, err := loadConnPoolConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connConfig := connPoolConfig.ConnConfig
+	if user, ok := conf.Get("migrate", "user"); ok {
+		connConfig.User = user
+		connConfig.Password, _ = conf.Get("migrate", "password")
+	}
+
+	conn, err := pgx.Connect(connConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sql := range []string{
+		"drop schema if exists " + migrateTestSchema + " cascade",
+		"create schema " + migrateTestSchema,
+		"set search_path to " + migrateTestSchema,
+	} {
+		if _, err := conn.Exec(sql); err != nil {
+			conn.Close()
+			t.Fatalf("Exec unexpectedly failed with %v: %v", sql, err)
+		}
+	}
+
+	return conn
+}
+
+func closeMigrateTestConn(t testing.TB, conn *pgx.Conn) {
+	if _, err := conn.Exec("drop schema " + migrateTestSchema + " cascade"); err != nil {
+		t.Errorf("Unable to drop schema %s: %v", migrateTestSchema, err)
+	}
+	conn.Close()
+}
+
+func migrateTestTableExists(t testing.TB, conn *pgx.Conn, name string) bool {
+	var exists bool
+	err := conn.QueryRow("select to_regclass($1) is not null", migrateTestSchema+"."+name).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestLoadMigrations(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"002_second.sql": {Data: []byte("grant select on foo to {{.app_user}};\n\n---- create above / drop below ----\n\nrevoke select on foo from {{.app_user}};\n")},
+		"001_first.sql":  {Data: []byte("create table foo(id int);\n---- create above / drop below ----\ndrop table foo;\n")},
+	}
+
+	migrations, err := LoadMigrations(fsys, map[string]string{"app_user": "jchat"})
+	if err != nil {
+		t.Fatalf("LoadMigrations returned error: %v", err)
+	}
+
+	expected := []Migration{
+		{Sequence: 1, Name: "001_first.sql", UpSQL: "create table foo(id int);", DownSQL: "drop table foo;"},
+		{Sequence: 2, Name: "002_second.sql", UpSQL: "grant select on foo to jchat;", DownSQL: "revoke select on foo from jchat;"},
+	}
+	if len(migrations) != len(expected) {
+		t.Fatalf("Expected %d migrations, but there were %d", len(expected), len(migrations))
+	}
+	for i := range expected {
+		if migrations[i] != expected[i] {
+			t.Errorf("%d. Expected migration to be %v, but it was %v", i, expected[i], migrations[i])
+		}
+	}
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		fsys fstest.MapFS
+		err  string
+	}{
+		{fstest.MapFS{"001_first.sql": {}, "003_third.sql": {}}, "Missing migration 2"},
+		{fstest.MapFS{"first.sql": {}}, "Invalid migration file name"},
+		{fstest.MapFS{"001_first.sql": {Data: []byte("grant all on foo to {{.missing}}")}}, "missing"},
+	}
+
+	for i, tt := range tests {
+		_, err := LoadMigrations(tt.fsys, map[string]string{"app_user": "jchat"})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%d. Expected LoadMigrations to return error containing %q, but it was %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestLoadEmbeddedMigrations(t *testing.T) {
+	t.Parallel()
+
+	conf := ini.File{"data": {"app_user": "jchat"}}
+
+	migrations, err := loadMigrations(conf)
+	if err != nil {
+		t.Fatalf("loadMigrations returned error: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Expected embedded migrations, but there were none")
+	}
+
+	for _, m := range migrations {
+		if m.DownSQL == "" {
+			t.Errorf("Expected migration %s to be reversible, but it was not", m.Name)
+		}
+	}
+}
+
+func TestLatestMigrationVersion(t *testing.T) {
+	t.Parallel()
+
+	// Templates are not rendered so missing data is not an error
+	fsys := fstest.MapFS{
+		"002_second.sql": {Data: []byte("grant select on foo to {{.app_user}};")},
+		"001_first.sql":  {Data: []byte("create table foo(id int);")},
+	}
+
+	version, err := LatestMigrationVersion(fsys)
+	if err != nil {
+		t.Fatalf("LatestMigrationVersion returned error: %v", err)
+	}
+	if version != 2 {
+		t.Errorf("Expected LatestMigrationVersion to return %d, but it was %d", 2, version)
+	}
+
+	_, err = LatestMigrationVersion(fstest.MapFS{"001_first.sql": {}, "003_third.sql": {}})
+	if err == nil || !strings.Contains(err.Error(), "Missing migration 2") {
+		t.Errorf("Expected LatestMigrationVersion with missing migration to return error, but it was %v", err)
+	}
+}
+
+func TestMigratorMigrateTo(t *testing.T) {
+	conn := getMigrateTestConn(t)
+	defer closeMigrateTestConn(t, conn)
+
+	migrator := NewMigrator(conn, []Migration{
+		{Sequence: 1, Name: "001_first.sql", UpSQL: "create table first(id int);", DownSQL: "drop table first;"},
+		{Sequence: 2, Name: "002_second.sql", UpSQL: "create table second(id int);", DownSQL: "drop table second;"},
+	})
+
+	var started []string
+	migrator.OnStart = func(m Migration, direction string) {
+		started = append(started, direction+" "+m.Name)
+	}
+
+	err := migrator.MigrateTo(2)
+	if err != nil {
+		t.Fatalf("migrator.MigrateTo returned error: %v", err)
+	}
+
+	version, err := migrator.GetCurrentVersion()
+	if err != nil {
+		t.Fatalf("migrator.GetCurrentVersion returned error: %v", err)
+	}
+	if version != 2 {
+		t.Errorf("Expected version to be %d after migrating up, but it was %d", 2, version)
+	}
+	if !migrateTestTableExists(t, conn, "first") || !migrateTestTableExists(t, conn, "second") {
+		t.Error("Expected migrating up to create tables first and second, but it did not")
+	}
+
+	err = migrator.MigrateTo(0)
+	if err != nil {
+		t.Fatalf("migrator.MigrateTo returned error: %v", err)
+	}
+
+	version, err = migrator.GetCurrentVersion()
+	if err != nil {
+		t.Fatalf("migrator.GetCurrentVersion returned error: %v", err)
+	}
+	if version != 0 {
+		t.Errorf("Expected version to be %d after migrating down, but it was %d", 0, version)
+	}
+	if migrateTestTableExists(t, conn, "first") || migrateTestTableExists(t, conn, "second") {
+		t.Error("Expected migrating down to drop tables first and second, but it did not")
+	}
+
+	expected := []string{"up 001_first.sql", "up 002_second.sql", "down 002_second.sql", "down 001_first.sql"}
+	if !reflect.DeepEqual(started, expected) {
+		t.Errorf("Expected migrations to run in order %v, but they were %v", expected, started)
+	}
+}
+
+func TestMigratorMigrateToIrreversible(t *testing.T) {
+	conn := getMigrateTestConn(t)
+	defer closeMigrateTestConn(t, conn)
+
+	migrator := NewMigrator(conn, []Migration{
+		{Sequence: 1, Name: "001_first.sql", UpSQL: "create table first(id int);", DownSQL: "drop table first;"},
+		{Sequence: 2, Name: "002_second.sql", UpSQL: "create table second(id int);"},
+	})
+
+	err := migrator.MigrateTo(2)
+	if err != nil {
+		t.Fatalf("migrator.MigrateTo returned error: %v", err)
+	}
+
+	err = migrator.MigrateTo(0)
+	if err == nil || !strings.Contains(err.Error(), "002_second.sql is irreversible") {
+		t.Fatalf("Expected migrator.MigrateTo past irreversible migration to return error, but it was %v", err)
+	}
+
+	version, err := migrator.GetCurrentVersion()
+	if err != nil {
+		t.Fatalf("migrator.GetCurrentVersion returned error: %v", err)
+	}
+	if version != 2 {
+		t.Errorf("Expected version to stay at %d, but it was %d", 2, version)
+	}
+	if !migrateTestTableExists(t, conn, "second") {
+		t.Error("Expected table second to still exist, but it did not")
+	}
+}
+
+func TestMigratorMigrateToOutOfRange(t *testing.T) {
+	t.Parallel()
+
+	// The target is checked before the database is used
+	migrator := NewMigrator(nil, []Migration{
+		{Sequence: 1, Name: "001_first.sql", UpSQL: "create table first(id int);", DownSQL: "drop table first;"},
+	})
+
+	for _, target := range []int32{-1, 2} {
+		err := migrator.MigrateTo(target)
+		if err == nil || !strings.Contains(err.Error(), "outside the valid range of 0 to 1") {
+			t.Errorf("Expected migrator.MigrateTo(%d) to return out of range error, but it was %v", target, err)
+		}
+	}
+}
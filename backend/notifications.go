@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// The params of notifications about repository changes are built here so
+// the params recorded in the event log are the ones sent to clients.
+
+type channelNotification struct {
+	ID               int32   `json:"id"`
+	Name             string  `json:"name"`
+	Topic            string  `json:"topic"`
+	Description      string  `json:"description"`
+	OwnerID          int32   `json:"owner_id"`
+	PinnedMessageIDs []int64 `json:"pinned_message_ids"`
+}
+
+func newChannelNotification(channel Channel) channelNotification {
+	return channelNotification{
+		ID:               channel.ID,
+		Name:             channel.Name,
+		Topic:            channel.Topic,
+		Description:      channel.Description,
+		OwnerID:          channel.OwnerID,
+		PinnedMessageIDs: channel.PinnedMessageIDs,
+	}
+}
+
+type userIDNotification struct {
+	ID int32 `json:"id"`
+}
+
+type channelIDNotification struct {
+	ID int32 `json:"id"`
+}
+
+type messagePostedNotification struct {
+	ID           int64  `json:"id"`
+	ChannelID    int32  `json:"channel_id"`
+	AuthorID     int32  `json:"author_id"`
+	Body         string `json:"body"`
+	BodyHTML     string `json:"body_html"`
+	CreationTime int64  `json:"creation_time"`
+}
+
+func newMessagePostedNotification(message Message) messagePostedNotification {
+	return messagePostedNotification{
+		ID:           message.ID,
+		ChannelID:    message.ChannelID,
+		AuthorID:     message.AuthorID,
+		Body:         message.Body,
+		BodyHTML:     message.BodyHTML,
+		CreationTime: message.Time.Unix(),
+	}
+}
+
+type linkPreviewNotification struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	ImageURL    string `json:"image_url"`
+	SiteName    string `json:"site_name"`
+}
+
+type messageUnfurledNotification struct {
+	MessageID    int64                     `json:"message_id"`
+	ChannelID    int32                     `json:"channel_id"`
+	LinkPreviews []linkPreviewNotification `json:"link_previews"`
+}
+
+func newMessageUnfurledNotification(unfurl MessageUnfurl) messageUnfurledNotification {
+	n := messageUnfurledNotification{
+		MessageID:    unfurl.MessageID,
+		ChannelID:    unfurl.ChannelID,
+		LinkPreviews: make([]linkPreviewNotification, len(unfurl.Previews)),
+	}
+	for i, p := range unfurl.Previews {
+		n.LinkPreviews[i] = linkPreviewNotification(p)
+	}
+	return n
+}
+
+type userNotification struct {
+	ID   int32  `json:"id"`
+	Name string `json:"name"`
+}
+
+func newUserNotification(user User) userNotification {
+	return userNotification{ID: user.ID, Name: user.Name}
+}
+
+// eventNotificationParams returns the params of event with an event_id member
+// added so the client can say which event it received last when it resumes
+// its session.
+func eventNotificationParams(event Event) json.RawMessage {
+	params := bytes.TrimSpace(event.Params)
+	if len(params) < 2 || params[0] != '{' {
+		return event.Params
+	}
+
+	rest := bytes.TrimSpace(params[1:])
+
+	buf := make([]byte, 0, len(params)+32)
+	buf = append(buf, `{"event_id":`...)
+	buf = strconv.AppendInt(buf, event.ID, 10)
+	if rest[0] != '}' {
+		buf = append(buf, ',')
+	}
+	buf = append(buf, rest...)
+
+	return json.RawMessage(buf)
+}
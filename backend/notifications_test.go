@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEventNotificationParams(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		params string
+		result string
+	}{
+		{`{"id":7,"name":"General"}`, `{"event_id":42,"id":7,"name":"General"}`},
+		{`{ "id": 7 }`, `{"event_id":42,"id": 7 }`},
+		{`{}`, `{"event_id":42}`},
+		{`{ }`, `{"event_id":42}`},
+	}
+
+	for i, tt := range tests {
+		result := eventNotificationParams(Event{ID: 42, Params: json.RawMessage(tt.params)})
+		if string(result) != tt.result {
+			t.Errorf("%d. Expected params %s to become %s, but it was %s", i, tt.params, tt.result, result)
+			continue
+		}
+		if !json.Valid(result) {
+			t.Errorf("%d. Expected %s to be valid JSON, but it was not", i, result)
+		}
+	}
+}
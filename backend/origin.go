@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseAllowedOrigins parses a comma separated list of origins such as
+// "https://chat.example.com, http://localhost:4000".
+func parseAllowedOrigins(s string) ([]string, error) {
+	var origins []string
+
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("origin must be a scheme and host: %s", o)
+		}
+		origins = append(origins, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+
+	return origins, nil
+}
+
+// newOriginHandshake returns a websocket handshake that only accepts browsers
+// on allowedOrigins. This stops other sites from opening a socket with a
+// logged in user's cookies and session. If allowedOrigins is empty the Origin
+// must be the host the request was made to.
+func newOriginHandshake(allowedOrigins []string, logger log.Logger) func(*websocket.Config, *http.Request) error {
+	return func(config *websocket.Config, req *http.Request) error {
+		origin, err := websocket.Origin(config, req)
+		if err == nil && origin == nil {
+			err = errors.New("null origin")
+		}
+		if err != nil {
+			logger.Warn("Rejected websocket with bad origin", "origin", req.Header.Get("Origin"), "remote_addr", req.RemoteAddr, "error", err)
+			return err
+		}
+		config.Origin = origin
+
+		if !originAllowed(origin, req, allowedOrigins) {
+			logger.Warn("Rejected websocket from disallowed origin", "origin", origin.String(), "remote_addr", req.RemoteAddr)
+			return fmt.Errorf("origin not allowed: %s", origin)
+		}
+
+		return nil
+	}
+}
+
+func originAllowed(origin *url.URL, req *http.Request, allowedOrigins []string) bool {
+	if len(allowedOrigins) == 0 {
+		return strings.EqualFold(origin.Host, req.Host)
+	}
+
+	o := strings.ToLower(origin.Scheme + "://" + origin.Host)
+	for _, allowed := range allowedOrigins {
+		if o == allowed {
+			return true
+		}
+	}
+
+	return false
+}
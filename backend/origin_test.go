@@ -0,0 +1,76 @@
+package main
+
+import (
+	"golang.org/x/net/websocket"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAllowedOrigins(t *testing.T) {
+	t.Parallel()
+
+	origins, err := parseAllowedOrigins("https://Chat.example.com, http://localhost:4567/ ,")
+	if err != nil {
+		t.Fatalf("parseAllowedOrigins returned error: %v", err)
+	}
+	expected := []string{"https://chat.example.com", "http://localhost:4567"}
+	if !reflect.DeepEqual(origins, expected) {
+		t.Errorf("Expected origins to be %v, but it was %v", expected, origins)
+	}
+
+	for _, s := range []string{"chat.example.com", "https://chat.example.com/path"} {
+		if _, err := parseAllowedOrigins(s); err == nil {
+			t.Errorf("Expected parseAllowedOrigins(%q) to return error, but it did not", s)
+		}
+	}
+}
+
+func TestOriginHandshake(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	newServer := func(allowedOrigins []string) *httptest.Server {
+		return httptest.NewServer(websocket.Server{
+			Handshake: newOriginHandshake(allowedOrigins, logger),
+			Handler:   func(ws *websocket.Conn) { ws.Close() },
+		})
+	}
+
+	sameHostServer := newServer(nil)
+	defer sameHostServer.Close()
+	listServer := newServer([]string{"https://chat.example.com"})
+	defer listServer.Close()
+
+	tests := []struct {
+		server  *httptest.Server
+		origin  string
+		allowed bool
+	}{
+		{sameHostServer, sameHostServer.URL, true},
+		{sameHostServer, "https://evil.example.com", false},
+		{sameHostServer, "null", false},
+		{listServer, "https://chat.example.com", true},
+		{listServer, "https://CHAT.example.com", true},
+		{listServer, "http://chat.example.com", false},
+		{listServer, listServer.URL, false},
+	}
+
+	for i, tt := range tests {
+		url := strings.Replace(tt.server.URL, "http", "ws", 1)
+		ws, err := websocket.Dial(url, "", tt.origin)
+		if tt.allowed && err != nil {
+			t.Errorf("%d. Expected origin %s to be allowed, but dial failed: %v", i, tt.origin, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("%d. Expected origin %s to be rejected, but it was allowed", i, tt.origin)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+	}
+}
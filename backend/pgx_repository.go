@@ -3,16 +3,22 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/jackc/jchat/db"
 	"github.com/jackc/pgx"
 	"github.com/vaughan0/go-ini"
+	log "gopkg.in/inconshreveable/log15.v2"
 	"io"
-	"io/ioutil"
+	"io/fs"
+	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func loadConnPoolConfig(conf ini.File) (pgx.ConnPoolConfig, error) {
@@ -45,15 +51,24 @@ func loadConnPoolConfig(conf ini.File) (pgx.ConnPoolConfig, error) {
 	}, nil
 }
 
+// loadPreparedStatements loads the SQL embedded in the binary unless
+// database.sql_path is configured, in which case it is read from disk.
 func loadPreparedStatements(conf ini.File) (map[string]string, error) {
+	var fsys fs.FS
+	var err error
+
 	sqlPath, _ := conf.Get("database", "sql_path")
-	if sqlPath == "" {
-		return nil, errors.New("Config must contain database.sql_path but it does not")
+	if sqlPath != "" {
+		sqlPath = strings.TrimRight(sqlPath, string(filepath.Separator))
+		fsys = os.DirFS(sqlPath)
+	} else {
+		fsys, err = fs.Sub(db.SQL, "sql")
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	sqlPath = strings.TrimRight(sqlPath, string(filepath.Separator))
-
-	filePaths, err := filepath.Glob(filepath.Join(sqlPath, "*.sql"))
+	filePaths, err := fs.Glob(fsys, "*.sql")
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +84,7 @@ func loadPreparedStatements(conf ini.File) (map[string]string, error) {
 	preparedStatements := make(map[string]string, len(filePaths))
 
 	for _, p := range filePaths {
-		body, err := ioutil.ReadFile(p)
+		body, err := fs.ReadFile(fsys, p)
 		if err != nil {
 			return nil, err
 		}
@@ -81,11 +96,32 @@ func loadPreparedStatements(conf ini.File) (map[string]string, error) {
 }
 
 type PgxRepository struct {
-	pool                 *pgx.ConnPool
-	userCreatedSignal    UserSignal
-	channelCreatedSignal ChannelSignal
-	channelRenamedSignal ChannelSignal
-	messagePostedSignal  MessageSignal
+	pool                  *pgx.ConnPool
+	connConfig            pgx.ConnConfig
+	userCreatedSignal     UserSignal
+	channelCreatedSignal  ChannelSignal
+	messagePostedSignal   MessageSignal
+	messageUnfurledSignal MessageUnfurlSignal
+	eventSignal           EventSignal
+
+	// pendingDispatches are the signals waiting to be dispatched.
+	// dispatchReady is signalled when some are added.
+	dispatchMutex     sync.Mutex
+	pendingDispatches []signalDispatch
+	dispatchReady     chan struct{}
+
+	// stopListening is closed to stop the listener started by
+	// ListenForEvents.
+	stopListening chan struct{}
+
+	rateLimitSweepMutex sync.Mutex
+	rateLimitSweepTime  time.Time
+}
+
+// signalDispatch is a signal waiting to be dispatched.
+type signalDispatch struct {
+	signal string
+	f      func()
 }
 
 func NewPgxRepository(config pgx.ConnPoolConfig, preparedStatements map[string]string) (*PgxRepository, error) {
@@ -105,13 +141,30 @@ func NewPgxRepository(config pgx.ConnPoolConfig, preparedStatements map[string]s
 		return nil, err
 	}
 
-	return &PgxRepository{pool: pool}, nil
+	repo := &PgxRepository{
+		pool:          pool,
+		connConfig:    config.ConnConfig,
+		dispatchReady: make(chan struct{}, 1),
+	}
+	go repo.dispatchSignals()
+
+	return repo, nil
+}
+
+// Close closes the connection pool. It waits until all acquired connections
+// are released.
+func (repo *PgxRepository) Close() {
+	repo.pool.Close()
 }
 
 func (repo *PgxRepository) MessagePostedSignal() *MessageSignal {
 	return &repo.messagePostedSignal
 }
 
+func (repo *PgxRepository) MessageUnfurledSignal() *MessageUnfurlSignal {
+	return &repo.messageUnfurledSignal
+}
+
 func (repo *PgxRepository) UserCreatedSignal() *UserSignal {
 	return &repo.userCreatedSignal
 }
@@ -120,28 +173,47 @@ func (repo *PgxRepository) ChannelCreatedSignal() *ChannelSignal {
 	return &repo.channelCreatedSignal
 }
 
-func (repo *PgxRepository) ChannelRenamedSignal() *ChannelSignal {
-	return &repo.channelRenamedSignal
+func (repo *PgxRepository) EventSignal() *EventSignal {
+	return &repo.eventSignal
 }
 
 func (repo *PgxRepository) CreateUser(name, email, password string) (user User, err error) {
+	return repo.createUser(name, email, password, false)
+}
+
+// CreateVerifiedUser creates a user whose email address is already verified.
+func (repo *PgxRepository) CreateVerifiedUser(name, email, password string) (user User, err error) {
+	return repo.createUser(name, email, password, true)
+}
+
+func (repo *PgxRepository) createUser(name, email, password string, emailVerified bool) (user User, err error) {
 	digest, salt, err := DigestPassword(password)
 	if err != nil {
 		return user, err
 	}
 
-	err = repo.pool.QueryRow(
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
 		"create_user",
 		name,
 		email,
 		digest,
 		salt,
-	).Scan(&user.ID, &user.Name, &user.Email)
+		emailVerified,
+	).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled)
 	if err != nil {
-		return user, err
+		return user, duplicationError(err)
 	}
 
-	go repo.userCreatedSignal.Dispatch(user)
+	err = repo.commitEvent(tx, "user_created", newUserNotification(user), func() { repo.userCreatedSignal.Dispatch(user) })
+	if err != nil {
+		return user, err
+	}
 
 	return user, nil
 }
@@ -149,7 +221,21 @@ func (repo *PgxRepository) CreateUser(name, email, password string) (user User,
 func (repo *PgxRepository) GetUser(userID int32) (user User, err error) {
 	err = repo.pool.QueryRow("get_user",
 		userID,
-	).Scan(&user.ID, &user.Name, &user.Email)
+	).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled)
+	if err == pgx.ErrNoRows {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+func (repo *PgxRepository) GetUserByEmail(email string) (user User, err error) {
+	err = repo.pool.QueryRow("get_user_by_email",
+		email,
+	).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled)
 	if err == pgx.ErrNoRows {
 		return user, ErrNotFound
 	}
@@ -160,12 +246,32 @@ func (repo *PgxRepository) GetUser(userID int32) (user User, err error) {
 	return user, nil
 }
 
+func (repo *PgxRepository) GetUsers() (users []User, err error) {
+	rows, err := repo.pool.Query("get_users")
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var u User
+		rows.Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.Disabled)
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// Login returns the user with email and password. Failed logins delay
+// further attempts for the account and eventually lock it. See
+// loginFailureDelay.
 func (repo *PgxRepository) Login(email, password string) (user User, err error) {
 	var digest, salt []byte
+	var failures int32
+	var blockedSeconds float64
 
 	err = repo.pool.QueryRow("login",
 		email,
-	).Scan(&user.ID, &user.Name, &user.Email, &digest, &salt)
+	).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled, &digest, &salt, &failures, &blockedSeconds)
 	if err == pgx.ErrNoRows {
 		return user, ErrNotFound
 	}
@@ -173,13 +279,81 @@ func (repo *PgxRepository) Login(email, password string) (user User, err error)
 		return user, err
 	}
 
+	if blockedSeconds > 0 {
+		return user, LoginThrottledError{
+			RetryAfter: time.Duration(blockedSeconds * float64(time.Second)),
+			Locked:     failures >= maxLoginFailures,
+		}
+	}
+
 	if !PasswordMatch(password, digest, salt) {
+		var delay time.Duration
+		failures, delay, err = repo.recordLoginFailure(user.ID)
+		if err != nil {
+			return user, err
+		}
+
+		if failures >= maxLoginFailures {
+			return user, AccountLockedError{UserID: user.ID, RetryAfter: delay}
+		}
 		return user, ErrNotFound
 	}
 
+	if failures > 0 {
+		_, err = repo.pool.Exec("reset_login_failures", user.ID)
+		if err != nil {
+			return user, err
+		}
+	}
+
 	return user, nil
 }
 
+// recordLoginFailure counts a failed login for userID and blocks further
+// logins for the delay that many failures earn. The count is incremented in
+// the database so concurrent failures are all counted.
+func (repo *PgxRepository) recordLoginFailure(userID int32) (failures int32, delay time.Duration, err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("record_login_failure", userID).Scan(&failures)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	delay = loginFailureDelay(failures)
+	_, err = tx.Exec("set_login_blocked_until", userID, delay.Seconds())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return failures, delay, tx.Commit()
+}
+
+// CheckPassword returns ErrNotFound unless password is the password of the
+// user. Unlike Login it neither records failures nor honors lockouts, so it is
+// only for confirming the password of an already logged in user and must be
+// rate limited by the caller.
+func (repo *PgxRepository) CheckPassword(userID int32, password string) error {
+	var digest, salt []byte
+	err := repo.pool.QueryRow("get_password_digest", userID).Scan(&digest, &salt)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if !PasswordMatch(password, digest, salt) {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
 func (repo *PgxRepository) SetPassword(userID int32, password string) (err error) {
 	digest, salt, err := DigestPassword(password)
 	if err != nil {
@@ -197,25 +371,62 @@ func (repo *PgxRepository) SetPassword(userID int32, password string) (err error
 	return nil
 }
 
-func (repo *PgxRepository) CreatePasswordResetToken(email string, requestIP string) (token string, err error) {
-	var userID int32
-	err = repo.pool.QueryRow("get_user_by_email", email).Scan(&userID)
+// DisableUser prevents userID from logging in and revokes all of its
+// sessions.
+func (repo *PgxRepository) DisableUser(userID int32) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	commandTag, err := tx.Exec("disable_user", userID)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	_, err = tx.Exec("delete_user_sessions", userID)
+	if err != nil {
+		return err
+	}
+
+	// Servers close the user's open connections when they see the event
+	return repo.commitEvent(tx, "user_disabled", userIDNotification{ID: userID}, nil)
+}
+
+func (repo *PgxRepository) SetName(userID int32, name string) (user User, err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("set_user_name", userID, name).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled)
 	if err == pgx.ErrNoRows {
-		return "", ErrNotFound
+		return user, ErrNotFound
 	}
 	if err != nil {
-		return "", err
+		return user, duplicationError(err)
 	}
 
-	tokenBytes := make([]byte, 16)
-	_, err = rand.Read(tokenBytes)
+	return user, repo.commitUserUpdated(tx, user)
+}
+
+func (repo *PgxRepository) CreatePasswordResetToken(email string, requestIP string) (token string, err error) {
+	user, err := repo.GetUserByEmail(email)
 	if err != nil {
 		return "", err
 	}
 
-	token = hex.EncodeToString(tokenBytes)
+	token, err = generateToken()
+	if err != nil {
+		return "", err
+	}
 
-	_, err = repo.pool.Exec("create_password_reset", token, userID, requestIP)
+	_, err = repo.pool.Exec("create_password_reset", token, user.ID, requestIP)
 	if err != nil {
 		return "", err
 	}
@@ -245,6 +456,140 @@ func (repo *PgxRepository) SetPasswordByToken(token, password string, completion
 	return nil
 }
 
+// CreateEmailChangeToken does not check whether email is taken so that the
+// response does not reveal which addresses are registered. SetEmailByToken
+// returns a DuplicationError instead.
+func (repo *PgxRepository) CreateEmailChangeToken(userID int32, email string, requestIP string) (token string, err error) {
+	token, err = generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = repo.pool.Exec("create_email_change", token, userID, email, requestIP)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (repo *PgxRepository) SetEmailByToken(token string, completionIP string) (user User, err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("set_email_from_email_change", completionIP, token).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled)
+	if err == pgx.ErrNoRows {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, duplicationError(err)
+	}
+
+	return user, repo.commitUserUpdated(tx, user)
+}
+
+// commitUserUpdated records that user was updated in tx, commits it and
+// dispatches the change.
+func (repo *PgxRepository) commitUserUpdated(tx *pgx.Tx, user User) error {
+	return repo.commitEvent(tx, "user_updated", newUserNotification(user), nil)
+}
+
+func (repo *PgxRepository) CreateEmailVerificationToken(userID int32, requestIP string) (token string, err error) {
+	token, err = generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = repo.pool.Exec("create_email_verification", token, userID, requestIP)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (repo *PgxRepository) SetEmailVerifiedByToken(token string, completionIP string) (user User, err error) {
+	err = repo.pool.QueryRow("set_email_verified_from_email_verification", completionIP, token).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled)
+	if err == pgx.ErrNoRows {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+func (repo *PgxRepository) SetEmailVerified(userID int32) (err error) {
+	commandTag, err := repo.pool.Exec("set_email_verified", userID)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (repo *PgxRepository) CreateAccountUnlockToken(userID int32, requestIP string) (token string, err error) {
+	token, err = generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = repo.pool.Exec("create_account_unlock", token, userID, requestIP)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (repo *PgxRepository) UnlockAccountByToken(token string, completionIP string) (user User, err error) {
+	err = repo.pool.QueryRow("unlock_account_from_account_unlock", completionIP, token).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.Disabled)
+	if err == pgx.ErrNoRows {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+func (repo *PgxRepository) UnlockAccount(userID int32) (err error) {
+	commandTag, err := repo.pool.Exec("reset_login_failures", userID)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (repo *PgxRepository) GetLoginFailures() (failures []UserLoginFailures, err error) {
+	rows, err := repo.pool.Query("get_login_failures")
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var f UserLoginFailures
+		var blockedUntil pgx.NullTime
+		rows.Scan(&f.User.ID, &f.User.Name, &f.User.Email, &f.Failures, &blockedUntil)
+		f.BlockedUntil = blockedUntil.Time
+		failures = append(failures, f)
+	}
+
+	return failures, rows.Err()
+}
+
 func (repo *PgxRepository) CreateSession(userID int32) (sessionID string, err error) {
 	sessionBytes := make([]byte, 16)
 	_, err = io.ReadFull(rand.Reader, sessionBytes)
@@ -279,6 +624,15 @@ func (repo *PgxRepository) DeleteSession(sessionID string) (err error) {
 	return nil
 }
 
+func (repo *PgxRepository) DeleteUserSessions(userID int32) (count int64, err error) {
+	commandTag, err := repo.pool.Exec("delete_user_sessions", userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return commandTag.RowsAffected(), nil
+}
+
 func (repo *PgxRepository) GetUserIDBySessionID(sessionID string) (userID int32, err error) {
 	sessionBytes, err := hex.DecodeString(sessionID)
 	if err != nil {
@@ -297,62 +651,353 @@ func (repo *PgxRepository) GetUserIDBySessionID(sessionID string) (userID int32,
 }
 
 func (repo *PgxRepository) CreateChannel(name string, userID int32) (channelID int32, err error) {
-	err = repo.pool.QueryRow("create_channel", name).Scan(&channelID)
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("create_channel", name, userID).Scan(&channelID)
 	if err != nil {
 		return 0, err
 	}
 
-	go repo.channelCreatedSignal.Dispatch(Channel{ID: channelID, Name: name})
+	channel := Channel{ID: channelID, Name: name, OwnerID: userID, PinnedMessageIDs: []int64{}}
+	err = repo.commitEvent(tx, "channel_created", newChannelNotification(channel), func() { repo.channelCreatedSignal.Dispatch(channel) })
+	if err != nil {
+		return 0, err
+	}
 
 	return channelID, nil
 }
 
 func (repo *PgxRepository) RenameChannel(channelID int32, name string) (err error) {
-	commandTag, err := repo.pool.Exec("rename_channel", channelID, name)
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	commandTag, err := tx.Exec("rename_channel", channelID, name)
 	if err != nil {
 		return err
 	}
 	if commandTag.RowsAffected() == 0 {
-		return ErrNotFound
+		return unchangeableChannelError(tx, channelID)
 	}
 
-	go repo.channelRenamedSignal.Dispatch(Channel{ID: channelID, Name: name})
-
-	return nil
+	return repo.commitChannelUpdated(tx, channelID)
 }
 
-func (repo *PgxRepository) GetChannels() (channels []Channel, err error) {
-	channels = make([]Channel, 0, 8)
-	rows, _ := repo.pool.Query("get_channels")
+func (repo *PgxRepository) SetChannelTopic(channelID int32, topic, description string) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	for rows.Next() {
-		var c Channel
-		rows.Scan(&c.ID, &c.Name)
-		channels = append(channels, c)
+	commandTag, err := tx.Exec("set_channel_topic", channelID, topic, description)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return unchangeableChannelError(tx, channelID)
 	}
 
-	return channels, rows.Err()
+	return repo.commitChannelUpdated(tx, channelID)
 }
 
-func (repo *PgxRepository) PostMessage(channelID int32, authorID int32, body string) (messageID int64, err error) {
-	message := Message{ChannelID: channelID, AuthorID: authorID, Body: body}
-	err = repo.pool.QueryRow("post_message", channelID, authorID, body).Scan(&message.ID, &message.Time)
+func (repo *PgxRepository) SetChannelOwner(channelID, ownerID int32) (err error) {
+	tx, err := repo.pool.Begin()
 	if err != nil {
-		return 0, err
+		return err
 	}
+	defer tx.Rollback()
 
-	go repo.messagePostedSignal.Dispatch(message)
+	commandTag, err := tx.Exec("set_channel_owner", channelID, ownerID)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 
-	return message.ID, nil
+	return repo.commitChannelUpdated(tx, channelID)
 }
 
-func (repo *PgxRepository) GetMessages(channelID int32, beforeMessageID int32, maxCount int32) (messages []Message, err error) {
-	messages = make([]Message, 0, 8)
-	rows, _ := repo.pool.Query("get_messages", channelID)
-
-	for rows.Next() {
-		var m Message
-		rows.Scan(&m.ID, &m.AuthorID, &m.Body, &m.Time)
+// unchangeableChannelError returns why channelID could not be changed:
+// ErrChannelArchived if it is archived and ErrNotFound otherwise.
+func unchangeableChannelError(q queryRower, channelID int32) error {
+	channel, err := getChannel(q, channelID)
+	if err != nil {
+		return err
+	}
+	if channel.Archived {
+		return ErrChannelArchived
+	}
+	return ErrNotFound
+}
+
+// unchangeableMessageError returns why the pins of messageID could not be
+// changed: ErrChannelArchived if its channel is archived and ErrNotFound
+// otherwise.
+func unchangeableMessageError(q queryRower, messageID int64) error {
+	message, err := getMessage(q, messageID)
+	if err != nil {
+		return err
+	}
+	return unchangeableChannelError(q, message.ChannelID)
+}
+
+// commitChannelUpdated records that channelID was updated in tx, commits it
+// and dispatches the change.
+func (repo *PgxRepository) commitChannelUpdated(tx *pgx.Tx, channelID int32) error {
+	channel, err := getChannel(tx, channelID)
+	if err != nil {
+		return err
+	}
+
+	return repo.commitEvent(tx, "channel_updated", newChannelNotification(channel), nil)
+}
+
+// queryRower is implemented by *pgx.ConnPool and *pgx.Tx.
+type queryRower interface {
+	QueryRow(sql string, args ...interface{}) *pgx.Row
+}
+
+func (repo *PgxRepository) GetChannel(channelID int32) (channel Channel, err error) {
+	return getChannel(repo.pool, channelID)
+}
+
+func getChannel(q queryRower, channelID int32) (channel Channel, err error) {
+	err = q.QueryRow("get_channel", channelID).Scan(
+		&channel.ID,
+		&channel.Name,
+		&channel.Topic,
+		&channel.Description,
+		&channel.OwnerID,
+		&channel.Archived,
+		&channel.PinnedMessageIDs,
+	)
+	if err == pgx.ErrNoRows {
+		return channel, ErrNotFound
+	}
+	if err != nil {
+		return channel, err
+	}
+
+	return channel, nil
+}
+
+func (repo *PgxRepository) GetChannels() (channels []Channel, err error) {
+	return repo.getChannels("get_channels")
+}
+
+func (repo *PgxRepository) GetArchivedChannels() (channels []Channel, err error) {
+	return repo.getChannels("get_archived_channels")
+}
+
+func (repo *PgxRepository) getChannels(sql string) (channels []Channel, err error) {
+	channels = make([]Channel, 0, 8)
+	rows, _ := repo.pool.Query(sql)
+
+	for rows.Next() {
+		var c Channel
+		rows.Scan(&c.ID, &c.Name, &c.Topic, &c.Description, &c.OwnerID, &c.Archived, &c.PinnedMessageIDs)
+		channels = append(channels, c)
+	}
+
+	return channels, rows.Err()
+}
+
+func (repo *PgxRepository) ArchiveChannel(channelID int32) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	commandTag, err := tx.Exec("archive_channel", channelID)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	err = repo.commitEvent(tx, "channel_archived", channelIDNotification{ID: channelID}, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (repo *PgxRepository) UnarchiveChannel(channelID int32) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	commandTag, err := tx.Exec("unarchive_channel", channelID)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	channel, err := getChannel(tx, channelID)
+	if err != nil {
+		return err
+	}
+
+	err = repo.commitEvent(tx, "channel_unarchived", newChannelNotification(channel), nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (repo *PgxRepository) DeleteChannel(channelID int32) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("delete_channel_messages", channelID)
+	if err != nil {
+		return err
+	}
+
+	commandTag, err := tx.Exec("delete_channel", channelID)
+	if err != nil {
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	err = repo.commitEvent(tx, "channel_deleted", channelIDNotification{ID: channelID}, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (repo *PgxRepository) PinMessage(messageID int64, userID int32) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var channelID int32
+	err = tx.QueryRow("pin_message", messageID, userID).Scan(&channelID)
+	if err == pgx.ErrNoRows {
+		return unchangeableMessageError(tx, messageID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return repo.commitChannelUpdated(tx, channelID)
+}
+
+func (repo *PgxRepository) UnpinMessage(messageID int64) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var channelID int32
+	err = tx.QueryRow("unpin_message", messageID).Scan(&channelID)
+	if err == pgx.ErrNoRows {
+		return unchangeableMessageError(tx, messageID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return repo.commitChannelUpdated(tx, channelID)
+}
+
+func (repo *PgxRepository) PostMessage(channelID int32, authorID int32, body, clientNonce string) (message Message, err error) {
+	message = Message{ChannelID: channelID, AuthorID: authorID, Body: body, BodyHTML: RenderMarkdown(body)}
+
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("post_message", channelID, authorID, message.Body, message.BodyHTML, clientNonce).Scan(&message.ID, &message.Time)
+	if err == pgx.ErrNoRows {
+		// Nothing was inserted either because the nonce was already used or
+		// because the channel cannot be posted to. A retry gets the original
+		// message even if the channel was archived since.
+		if clientNonce != "" {
+			original, err := getMessageByClientNonce(tx, authorID, clientNonce)
+			if err != ErrNotFound {
+				return original, err
+			}
+		}
+		if _, err := getChannel(tx, channelID); err != nil {
+			return Message{}, err
+		}
+		return Message{}, ErrChannelArchived
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	err = repo.commitEvent(tx, "message_posted", newMessagePostedNotification(message), func() { repo.messagePostedSignal.Dispatch(message) })
+	if err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+func getMessageByClientNonce(q queryRower, authorID int32, clientNonce string) (message Message, err error) {
+	return scanMessage(q.QueryRow("get_message_by_client_nonce", authorID, clientNonce))
+}
+
+func (repo *PgxRepository) GetMessage(messageID int64) (message Message, err error) {
+	return getMessage(repo.pool, messageID)
+}
+
+func getMessage(q queryRower, messageID int64) (message Message, err error) {
+	return scanMessage(q.QueryRow("get_message", messageID))
+}
+
+func scanMessage(row *pgx.Row) (message Message, err error) {
+	err = row.Scan(
+		&message.ID,
+		&message.ChannelID,
+		&message.AuthorID,
+		&message.Body,
+		&message.BodyHTML,
+		&message.Time,
+	)
+	if err == pgx.ErrNoRows {
+		return Message{}, ErrNotFound
+	}
+	return message, err
+}
+
+func (repo *PgxRepository) GetMessages(channelID int32, beforeMessageID int32, maxCount int32) (messages []Message, err error) {
+	messages = make([]Message, 0, 8)
+	rows, _ := repo.pool.Query("get_messages", channelID)
+
+	for rows.Next() {
+		var m Message
+		rows.Scan(&m.ID, &m.AuthorID, &m.Body, &m.BodyHTML, &m.Time)
 		messages = append(messages, m)
 	}
 
@@ -363,3 +1008,409 @@ func (repo *PgxRepository) GetInit(userID int32) (json []byte, err error) {
 	err = repo.pool.QueryRow("get_init").Scan(&json)
 	return json, err
 }
+
+func (repo *PgxRepository) GetLinkPreview(url string) (preview LinkPreview, err error) {
+	err = repo.pool.QueryRow("get_link_preview", url).Scan(
+		&preview.URL,
+		&preview.Title,
+		&preview.Description,
+		&preview.ImageURL,
+		&preview.SiteName,
+	)
+	if err == pgx.ErrNoRows {
+		return preview, ErrNotFound
+	}
+	if err != nil {
+		return preview, err
+	}
+
+	return preview, nil
+}
+
+func (repo *PgxRepository) SaveLinkPreview(preview LinkPreview) (err error) {
+	_, err = repo.pool.Exec("save_link_preview",
+		preview.URL,
+		preview.Title,
+		preview.Description,
+		preview.ImageURL,
+		preview.SiteName,
+	)
+	return err
+}
+
+func (repo *PgxRepository) UnfurlMessage(unfurl MessageUnfurl) (err error) {
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, p := range unfurl.Previews {
+		_, err = tx.Exec("create_message_link_preview", unfurl.MessageID, p.URL, int16(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = repo.commitEvent(tx, "message_unfurled", newMessageUnfurledNotification(unfurl), func() { repo.messageUnfurledSignal.Dispatch(unfurl) })
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (repo *PgxRepository) GetEventsAfter(eventID int64, maxCount int32) (events []Event, err error) {
+	rows, err := repo.pool.Query("get_events_after", eventID, maxCount)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var e Event
+		var params []byte
+		rows.Scan(&e.ID, &e.Method, &params, &e.Time)
+		e.Params = json.RawMessage(params)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (repo *PgxRepository) GetEventRange() (firstID, lastID int64, err error) {
+	err = repo.pool.QueryRow("get_event_range").Scan(&firstID, &lastID)
+	return firstID, lastID, err
+}
+
+func (repo *PgxRepository) DeleteEventsBefore(t time.Time) (count int64, err error) {
+	commandTag, err := repo.pool.Exec("delete_old_events", t)
+	if err != nil {
+		return 0, err
+	}
+
+	return commandTag.RowsAffected(), nil
+}
+
+// commitEvent records an event with params in tx and commits it. The commit
+// notifies every process listening for events, which dispatch the event
+// signal. dispatch, if not nil, dispatches the typed signal for the change in
+// this process only.
+func (repo *PgxRepository) commitEvent(tx *pgx.Tx, method string, params interface{}, dispatch func()) error {
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("insert_event", method, string(paramsJSON))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("notify_events")
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if dispatch != nil {
+		repo.dispatch(method, dispatch)
+	}
+
+	return nil
+}
+
+// eventListenerTimeout is how long the event listener waits for a
+// notification before checking whether it has been stopped.
+const eventListenerTimeout = time.Second
+
+// eventListenerRetryDelay is how long the event listener waits to reconnect
+// after losing its database connection.
+const eventListenerRetryDelay = 5 * time.Second
+
+// eventListenerBatchSize is how many events the event listener reads at once.
+const eventListenerBatchSize = 1000
+
+// ListenForEvents dispatches the event signal for every event committed from
+// now on, whether by this process or another such as an admin command or
+// another server. Events are read from the log and dispatched in ID order so
+// none are skipped. It returns once it is listening.
+func (repo *PgxRepository) ListenForEvents(logger log.Logger) error {
+	conn, err := repo.connectEventListener()
+	if err != nil {
+		return err
+	}
+
+	_, lastID, err := repo.GetEventRange()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	repo.stopListening = make(chan struct{})
+	go repo.listenForEvents(conn, lastID, logger)
+
+	return nil
+}
+
+// StopListeningForEvents stops the listener started by ListenForEvents. It
+// may dispatch one more batch of events before it stops.
+func (repo *PgxRepository) StopListeningForEvents() {
+	close(repo.stopListening)
+}
+
+// connectEventListener returns a connection listening for notifications of
+// new events. It is separate from the pool because it is held for as long as
+// the listener runs.
+func (repo *PgxRepository) connectEventListener() (*pgx.Conn, error) {
+	conn, err := pgx.Connect(repo.connConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Listen("events")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (repo *PgxRepository) listenForEvents(conn *pgx.Conn, lastID int64, logger log.Logger) {
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	// behind is set when events may have been committed that have not been
+	// dispatched, such as after a failed read or a reconnect.
+	var behind bool
+
+	for {
+		select {
+		case <-repo.stopListening:
+			return
+		default:
+		}
+
+		if conn == nil {
+			var err error
+			conn, err = repo.connectEventListener()
+			if err != nil {
+				logger.Error("Unable to listen for events", "error", err)
+				select {
+				case <-time.After(eventListenerRetryDelay):
+				case <-repo.stopListening:
+					return
+				}
+				continue
+			}
+			behind = true
+		}
+
+		if !behind {
+			_, err := conn.WaitForNotification(eventListenerTimeout)
+			if err == pgx.ErrNotificationTimeout {
+				continue
+			}
+			if err != nil {
+				logger.Error("Lost event listener connection", "error", err)
+				conn.Close()
+				conn = nil
+				continue
+			}
+		}
+
+		var err error
+		lastID, err = repo.dispatchEventsAfter(lastID)
+		behind = err != nil
+		if behind {
+			logger.Error("Unable to read events", "error", err)
+			select {
+			case <-time.After(eventListenerRetryDelay):
+			case <-repo.stopListening:
+				return
+			}
+		}
+	}
+}
+
+// dispatchEventsAfter dispatches the event signal for each event after
+// lastID. It returns the ID of the last event dispatched.
+func (repo *PgxRepository) dispatchEventsAfter(lastID int64) (int64, error) {
+	for {
+		events, err := repo.GetEventsAfter(lastID, eventListenerBatchSize)
+		if err != nil {
+			return lastID, err
+		}
+
+		for _, event := range events {
+			repo.eventSignal.Dispatch(event)
+			lastID = event.ID
+		}
+
+		if len(events) < eventListenerBatchSize {
+			return lastID, nil
+		}
+	}
+}
+
+// TakeRateLimitToken takes a token from the bucket named key. Buckets are
+// locked while they are updated so the limit holds across servers.
+func (repo *PgxRepository) TakeRateLimitToken(key string, limit RateLimit) (retryAfter time.Duration, err error) {
+	err = repo.sweepRateLimitBuckets(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := repo.pool.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("create_rate_limit_bucket", key, float64(limit.Burst))
+	if err != nil {
+		return 0, err
+	}
+
+	var tokens, elapsedSeconds float64
+	err = tx.QueryRow("get_rate_limit_bucket", key).Scan(&tokens, &elapsedSeconds)
+	if err != nil {
+		return 0, err
+	}
+
+	tokens, retryAfter = limit.take(tokens, time.Duration(elapsedSeconds*float64(time.Second)))
+
+	_, err = tx.Exec("set_rate_limit_bucket", key, tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return retryAfter, nil
+}
+
+// sweepRateLimitBuckets deletes buckets that have not been touched for
+// rateLimitBucketTTL. It does nothing if it already ran in the last
+// rateLimitSweepInterval.
+func (repo *PgxRepository) sweepRateLimitBuckets(now time.Time) error {
+	repo.rateLimitSweepMutex.Lock()
+	if now.Sub(repo.rateLimitSweepTime) < rateLimitSweepInterval {
+		repo.rateLimitSweepMutex.Unlock()
+		return nil
+	}
+	repo.rateLimitSweepTime = now
+	repo.rateLimitSweepMutex.Unlock()
+
+	_, err := repo.pool.Exec("delete_stale_rate_limit_buckets", now.Add(-rateLimitBucketTTL))
+	return err
+}
+
+// CheckReady returns an error unless a database connection with all prepared
+// statements can be acquired and the schema is at schemaVersion.
+func (repo *PgxRepository) CheckReady(schemaVersion int32) error {
+	// AfterConnect prepares every statement so acquiring a connection proves
+	// they are loaded.
+	conn, err := repo.pool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer repo.pool.Release(conn)
+
+	version, err := getSchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if version != schemaVersion {
+		return fmt.Errorf("schema is at version %d but version %d is required", version, schemaVersion)
+	}
+
+	return nil
+}
+
+// dispatch queues f, which should dispatch a signal, so the caller is not
+// blocked by listeners. Queued signals are dispatched one at a time in the
+// order they were queued so listeners see changes in the order they were
+// made. Pending dispatches are tracked by signal name.
+func (repo *PgxRepository) dispatch(signal string, f func()) {
+	metrics.Inc("jchat_notification_dispatches_pending", "signal", signal)
+
+	repo.dispatchMutex.Lock()
+	repo.pendingDispatches = append(repo.pendingDispatches, signalDispatch{signal: signal, f: f})
+	repo.dispatchMutex.Unlock()
+
+	select {
+	case repo.dispatchReady <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchSignals dispatches queued signals in order. Listeners must receive
+// promptly because every other signal waits for them.
+func (repo *PgxRepository) dispatchSignals() {
+	for range repo.dispatchReady {
+		repo.dispatchMutex.Lock()
+		dispatches := repo.pendingDispatches
+		repo.pendingDispatches = nil
+		repo.dispatchMutex.Unlock()
+
+		for _, d := range dispatches {
+			d.f()
+			metrics.Dec("jchat_notification_dispatches_pending", "signal", d.signal)
+		}
+	}
+}
+
+// registerPoolMetrics reports the connection pool stats as gauges.
+func (repo *PgxRepository) registerPoolMetrics(m *Metrics) {
+	m.GaugeFunc("jchat_db_pool_connections", func() float64 {
+		stat := repo.pool.Stat()
+		return float64(stat.CurrentConnections - stat.AvailableConnections)
+	}, "state", "in_use")
+	m.GaugeFunc("jchat_db_pool_connections", func() float64 {
+		return float64(repo.pool.Stat().AvailableConnections)
+	}, "state", "available")
+	m.GaugeFunc("jchat_db_pool_max_connections", func() float64 {
+		return float64(repo.pool.Stat().MaxConnections)
+	})
+}
+
+// generateToken returns a random token suitable for including in links
+// mailed to users.
+func generateToken() (string, error) {
+	tokenBytes := make([]byte, 16)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// duplicationError converts unique constraint violations on the users table
+// into DuplicationErrors. Other errors are returned unchanged.
+func duplicationError(err error) error {
+	pgErr, ok := err.(pgx.PgError)
+	if !ok || pgErr.Code != "23505" {
+		return err
+	}
+
+	switch pgErr.ConstraintName {
+	case "users_email_unq":
+		return DuplicationError{Field: "email"}
+	case "users_name_unq":
+		return DuplicationError{Field: "name"}
+	default:
+		return err
+	}
+}
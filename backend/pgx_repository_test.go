@@ -3,7 +3,10 @@ package main
 import (
 	"github.com/jackc/pgx"
 	"github.com/vaughan0/go-ini"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func getPgxRepository(t testing.TB) *PgxRepository {
@@ -38,12 +41,51 @@ func getPgxRepository(t testing.TB) *PgxRepository {
 	}
 
 	mustExec(t, "delete from messages")
+	mustExec(t, "delete from link_previews")
 	mustExec(t, "delete from channels")
 	mustExec(t, "delete from users")
+	mustExec(t, "delete from rate_limit_buckets")
+	mustExec(t, "delete from events")
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	err = repo.ListenForEvents(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(repo.StopListeningForEvents)
 
 	return repo
 }
 
+func TestLoadPreparedStatements(t *testing.T) {
+	t.Parallel()
+
+	embedded, err := loadPreparedStatements(ini.File{})
+	if err != nil {
+		t.Fatalf("loadPreparedStatements returned error: %v", err)
+	}
+
+	onDisk, err := loadPreparedStatements(ini.File{"database": {"sql_path": "../db/sql"}})
+	if err != nil {
+		t.Fatalf("loadPreparedStatements returned error: %v", err)
+	}
+
+	if len(embedded) == 0 || len(embedded) != len(onDisk) {
+		t.Fatalf("Expected embedded and on disk prepared statements to match, but there were %d and %d", len(embedded), len(onDisk))
+	}
+	for name, sql := range onDisk {
+		if embedded[name] != sql {
+			t.Errorf("Expected embedded %s to be %q, but it was %q", name, sql, embedded[name])
+		}
+	}
+
+	_, err = loadPreparedStatements(ini.File{"database": {"sql_path": "missing"}})
+	if err == nil {
+		t.Error("Expected loadPreparedStatements with missing sql_path to return error, but it did not")
+	}
+}
+
 func TestPgxRepositoryCreateAndLoginCycle(t *testing.T) {
 	repo := getPgxRepository(t)
 	testUserRepositoryCreateAndLoginCycle(t, repo)
@@ -54,11 +96,56 @@ func TestPgxRepositoryGetUser(t *testing.T) {
 	testUserRepositoryGetUser(t, repo)
 }
 
+func TestPgxRepositoryCreateVerifiedUser(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryCreateVerifiedUser(t, repo)
+}
+
 func TestPgxRepositorySetPassword(t *testing.T) {
 	repo := getPgxRepository(t)
 	testUserRepositorySetPassword(t, repo)
 }
 
+func TestPgxRepositoryCheckPassword(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryCheckPassword(t, repo)
+}
+
+func TestPgxRepositorySetName(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositorySetName(t, repo)
+}
+
+func TestPgxRepositoryEmailChangeLifeCycle(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryEmailChangeLifeCycle(t, repo)
+}
+
+func TestPgxRepositoryEmailVerificationLifeCycle(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryEmailVerificationLifeCycle(t, repo)
+}
+
+func TestPgxRepositoryGetUsers(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryGetUsers(t, repo)
+}
+
+func TestPgxRepositoryDisableUser(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryDisableUser(t, repo, repo)
+}
+
+func TestPgxRepositoryLoginFailures(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryLoginFailures(t, repo)
+}
+
+func TestPgxRepositoryConcurrentLoginFailures(t *testing.T) {
+	repo := getPgxRepository(t)
+	testUserRepositoryConcurrentLoginFailures(t, repo)
+}
+
 func TestPgxRepositorySession(t *testing.T) {
 	repo := getPgxRepository(t)
 	user, err := repo.CreateUser("test", "test@example.com", "secret")
@@ -79,6 +166,50 @@ func TestPgxRepositoryChat(t *testing.T) {
 	testChatRepository(t, repo, user.ID)
 }
 
+func TestPgxRepositoryChannelTopicAndPins(t *testing.T) {
+	repo := getPgxRepository(t)
+	user, err := repo.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Create unexpectedly failed: %v", err)
+	}
+
+	testChatRepositoryChannelTopicAndPins(t, repo, user.ID)
+}
+
+func TestPgxRepositoryArchiveAndDeleteChannel(t *testing.T) {
+	repo := getPgxRepository(t)
+	user, err := repo.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Create unexpectedly failed: %v", err)
+	}
+
+	testChatRepositoryArchiveAndDeleteChannel(t, repo, user.ID)
+}
+
+func TestPgxRepositorySetChannelOwner(t *testing.T) {
+	repo := getPgxRepository(t)
+	user, err := repo.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Create unexpectedly failed: %v", err)
+	}
+
+	testChatRepositorySetChannelOwner(t, repo, user.ID)
+}
+
+func TestPgxRepositoryPostMessageClientNonce(t *testing.T) {
+	repo := getPgxRepository(t)
+	user, err := repo.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Create unexpectedly failed: %v", err)
+	}
+	otherUser, err := repo.CreateUser("other", "other@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Create unexpectedly failed: %v", err)
+	}
+
+	testChatRepositoryPostMessageClientNonce(t, repo, user.ID, otherUser.ID)
+}
+
 func TestPgxRepositoryMessagePostedNotifier(t *testing.T) {
 	repo := getPgxRepository(t)
 	user, err := repo.CreateUser("test", "test@example.com", "secret")
@@ -98,3 +229,116 @@ func TestPgxRepositoryChannelCreatedSignaler(t *testing.T) {
 	repo := getPgxRepository(t)
 	testChannelCreatedSignaler(t, repo, repo, repo)
 }
+
+func TestPgxRepositoryEventRepository(t *testing.T) {
+	repo := getPgxRepository(t)
+	user, err := repo.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Create unexpectedly failed: %v", err)
+	}
+
+	testEventRepository(t, repo, repo, user.ID)
+}
+
+func TestPgxRepositoryEventSignalOrder(t *testing.T) {
+	repo := getPgxRepository(t)
+	user, err := repo.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Create unexpectedly failed: %v", err)
+	}
+
+	testEventSignalOrder(t, repo, repo, user.ID)
+}
+
+func TestPgxRepositoryLinkPreview(t *testing.T) {
+	repo := getPgxRepository(t)
+	testLinkPreviewRepository(t, repo)
+}
+
+func TestPgxRepositoryDispatchesEventsCommittedElsewhere(t *testing.T) {
+	repo := getPgxRepository(t)
+	// other stands in for an admin command or another server
+	other := getPgxRepository(t)
+
+	user, err := other.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("other.CreateUser returned error: %v", err)
+	}
+
+	c := make(chan Event)
+	repo.EventSignal().Add(c)
+	defer repo.EventSignal().Remove(c)
+
+	_, err = other.CreateChannel("Test", user.ID)
+	if err != nil {
+		t.Fatalf("other.CreateChannel returned error: %v", err)
+	}
+
+	for {
+		select {
+		case event := <-c:
+			if event.Method == "channel_created" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected channel_created committed by another repository to be dispatched, but it was not")
+		}
+	}
+}
+
+func TestPgxRepositoryRateLimitStore(t *testing.T) {
+	repo := getPgxRepository(t)
+	testRateLimitStore(t, repo)
+}
+
+func TestPgxRepositorySweepsStaleRateLimitBuckets(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.pool.Exec("insert into rate_limit_buckets(key, tokens, update_time) values('test:stale', 0, now() - interval '2 hours'), ('test:fresh', 0, now())")
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	_, err = repo.TakeRateLimitToken("test:other", RateLimit{Burst: 1, Period: time.Minute})
+	if err != nil {
+		t.Fatalf("TakeRateLimitToken returned error: %v", err)
+	}
+
+	var keys []string
+	rows, err := repo.pool.Query("select key from rate_limit_buckets order by key")
+	if err != nil {
+		t.Fatalf("Query returned error: %v", err)
+	}
+	for rows.Next() {
+		var key string
+		rows.Scan(&key)
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		t.Fatalf("rows.Err returned error: %v", rows.Err())
+	}
+
+	expected := []string{"test:fresh", "test:other"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected buckets %v after sweep, but they were %v", expected, keys)
+	}
+}
+
+func TestPgxRepositoryCheckReady(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	migrations, err := loadMigrations(ini.File{"data": {"app_user": "jchat"}})
+	if err != nil {
+		t.Fatalf("loadMigrations returned error: %v", err)
+	}
+
+	err = repo.CheckReady(int32(len(migrations)))
+	if err != nil {
+		t.Errorf("repo.CheckReady returned error: %v", err)
+	}
+
+	err = repo.CheckReady(int32(len(migrations)) + 1)
+	if err == nil {
+		t.Error("Expected repo.CheckReady with future schema version to return error, but it did not")
+	}
+}
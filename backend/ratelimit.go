@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket that holds up to Burst tokens and refills
+// completely over Period.
+type RateLimit struct {
+	Burst  int32
+	Period time.Duration
+}
+
+// ParseRateLimit parses a rate limit in the form "burst/period" such as
+// "10/1m".
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("rate limit must be in the form burst/period: %s", s)
+	}
+
+	burst, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil || burst < 1 {
+		return RateLimit{}, fmt.Errorf("rate limit burst must be a positive integer: %s", s)
+	}
+
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit period must be a positive duration: %s", s)
+	}
+
+	return RateLimit{Burst: int32(burst), Period: period}, nil
+}
+
+// refillInterval is the time it takes for one token to be added to the bucket.
+func (l RateLimit) refillInterval() time.Duration {
+	return l.Period / time.Duration(l.Burst)
+}
+
+// take refills a bucket holding tokens that was last updated elapsed ago and
+// tries to take a token from it. It returns the tokens left in the bucket and
+// how long to wait before a token is available. retryAfter is zero if a token
+// was taken.
+func (l RateLimit) take(tokens float64, elapsed time.Duration) (remaining float64, retryAfter time.Duration) {
+	tokens += float64(elapsed) / float64(l.refillInterval())
+	if tokens > float64(l.Burst) {
+		tokens = float64(l.Burst)
+	}
+
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+
+	return tokens, time.Duration((1 - tokens) * float64(l.refillInterval()))
+}
+
+// RateLimitStore holds token buckets.
+type RateLimitStore interface {
+	// TakeRateLimitToken takes a token from the bucket named key. It returns
+	// how long to wait before a token is available or zero if a token was
+	// taken.
+	TakeRateLimitToken(key string, limit RateLimit) (retryAfter time.Duration, err error)
+}
+
+type memoryRateLimitBucket struct {
+	tokens     float64
+	updateTime time.Time
+}
+
+const (
+	// rateLimitBucketTTL is how long a bucket is kept after it was last
+	// touched. A bucket left alone that long is full again for any limit with
+	// a shorter period.
+	rateLimitBucketTTL = time.Hour
+
+	// rateLimitSweepInterval is how often stores remove stale buckets.
+	rateLimitSweepInterval = time.Minute
+)
+
+// MemoryRateLimitStore holds token buckets in process memory. It is only
+// suitable for a single server.
+type MemoryRateLimitStore struct {
+	mutex     sync.Mutex
+	buckets   map[string]*memoryRateLimitBucket
+	sweepTime time.Time
+	now       func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]*memoryRateLimitBucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryRateLimitStore) TakeRateLimitToken(key string, limit RateLimit) (time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryRateLimitBucket{tokens: float64(limit.Burst), updateTime: now}
+		s.buckets[key] = bucket
+	}
+
+	var retryAfter time.Duration
+	bucket.tokens, retryAfter = limit.take(bucket.tokens, now.Sub(bucket.updateTime))
+	bucket.updateTime = now
+
+	return retryAfter, nil
+}
+
+// sweep removes buckets that have not been touched for rateLimitBucketTTL.
+// Rate limits with longer periods are slightly more lenient as a result.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.sweepTime) < rateLimitSweepInterval {
+		return
+	}
+	s.sweepTime = now
+
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.updateTime) > rateLimitBucketTTL {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// RateLimiter applies per method rate limits to the IP addresses, email
+// addresses and users making requests.
+type RateLimiter struct {
+	store  RateLimitStore
+	limits map[string]RateLimit
+}
+
+// NewRateLimiter returns a RateLimiter that applies limits keyed by method
+// name. Methods without a limit are not rate limited.
+func NewRateLimiter(store RateLimitStore, limits map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{store: store, limits: limits}
+}
+
+// Take takes a token from the bucket for method and each of keys. It returns
+// the longest time to wait before every bucket has a token or zero if the
+// request is allowed.
+func (rl *RateLimiter) Take(method string, keys ...string) (time.Duration, error) {
+	limit, ok := rl.limits[method]
+	if !ok {
+		return 0, nil
+	}
+
+	var maxRetryAfter time.Duration
+	for _, key := range keys {
+		retryAfter, err := rl.store.TakeRateLimitToken(method+":"+key, limit)
+		if err != nil {
+			return 0, err
+		}
+		if retryAfter > maxRetryAfter {
+			maxRetryAfter = retryAfter
+		}
+	}
+
+	return maxRetryAfter, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		s        string
+		expected RateLimit
+		ok       bool
+	}{
+		{"10/1m", RateLimit{Burst: 10, Period: time.Minute}, true},
+		{" 5 / 1h ", RateLimit{Burst: 5, Period: time.Hour}, true},
+		{"10", RateLimit{}, false},
+		{"0/1m", RateLimit{}, false},
+		{"10/0s", RateLimit{}, false},
+		{"ten/1m", RateLimit{}, false},
+	}
+
+	for i, tt := range tests {
+		limit, err := ParseRateLimit(tt.s)
+		if tt.ok != (err == nil) {
+			t.Errorf("%d. ParseRateLimit(%q) returned error %v", i, tt.s, err)
+			continue
+		}
+		if limit != tt.expected {
+			t.Errorf("%d. Expected ParseRateLimit(%q) to return %v, but it was %v", i, tt.s, tt.expected, limit)
+		}
+	}
+}
+
+func testRateLimitStore(t *testing.T, store RateLimitStore) {
+	limit := RateLimit{Burst: 2, Period: time.Hour}
+
+	for i := 0; i < 2; i++ {
+		retryAfter, err := store.TakeRateLimitToken("test:a", limit)
+		if err != nil {
+			t.Fatalf("TakeRateLimitToken returned error: %v", err)
+		}
+		if retryAfter != 0 {
+			t.Errorf("%d. Expected token to be taken, but retryAfter was %v", i, retryAfter)
+		}
+	}
+
+	retryAfter, err := store.TakeRateLimitToken("test:a", limit)
+	if err != nil {
+		t.Fatalf("TakeRateLimitToken returned error: %v", err)
+	}
+	if retryAfter <= 0 || retryAfter > 30*time.Minute {
+		t.Errorf("Expected retryAfter to be within 30m, but it was %v", retryAfter)
+	}
+
+	retryAfter, err = store.TakeRateLimitToken("test:b", limit)
+	if err != nil {
+		t.Fatalf("TakeRateLimitToken returned error: %v", err)
+	}
+	if retryAfter != 0 {
+		t.Errorf("Expected token to be taken from other bucket, but retryAfter was %v", retryAfter)
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	t.Parallel()
+
+	testRateLimitStore(t, NewMemoryRateLimitStore())
+}
+
+func TestMemoryRateLimitStoreRefill(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	limit := RateLimit{Burst: 2, Period: time.Minute}
+
+	store.TakeRateLimitToken("a", limit)
+	store.TakeRateLimitToken("a", limit)
+
+	retryAfter, _ := store.TakeRateLimitToken("a", limit)
+	if retryAfter != 30*time.Second {
+		t.Errorf("Expected retryAfter to be %v, but it was %v", 30*time.Second, retryAfter)
+	}
+
+	now = now.Add(30 * time.Second)
+	retryAfter, _ = store.TakeRateLimitToken("a", limit)
+	if retryAfter != 0 {
+		t.Errorf("Expected token to be refilled, but retryAfter was %v", retryAfter)
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	t.Parallel()
+
+	rl := NewRateLimiter(NewMemoryRateLimitStore(), map[string]RateLimit{
+		"login": {Burst: 1, Period: time.Minute},
+	})
+
+	retryAfter, _ := rl.Take("login", "ip:127.0.0.1", "email:a@example.com")
+	if retryAfter != 0 {
+		t.Errorf("Expected first login to be allowed, but retryAfter was %v", retryAfter)
+	}
+
+	retryAfter, _ = rl.Take("login", "ip:127.0.0.1", "email:b@example.com")
+	if retryAfter == 0 {
+		t.Error("Expected second login from same IP to be rate limited, but it was not")
+	}
+
+	retryAfter, _ = rl.Take("register", "ip:127.0.0.1")
+	if retryAfter != 0 {
+		t.Errorf("Expected method without limit to be allowed, but retryAfter was %v", retryAfter)
+	}
+}
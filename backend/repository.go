@@ -4,12 +4,62 @@ import (
 	"bytes"
 	"code.google.com/p/go.crypto/scrypt"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
 var ErrNotFound = errors.New("not found")
+var ErrChannelArchived = errors.New("channel is archived")
+
+// After freeLoginFailures consecutive failed logins each further failure
+// delays the next attempt for the account, starting at loginFailureBaseDelay
+// and doubling every time. After maxLoginFailures the account is locked for
+// accountLockoutDuration or until it is unlocked by email or by an
+// administrator.
+const freeLoginFailures = 3
+const maxLoginFailures = 10
+const loginFailureBaseDelay = time.Second
+const accountLockoutDuration = time.Hour
+
+// loginFailureDelay returns how long an account must wait to log in again
+// after failures consecutive failed logins.
+func loginFailureDelay(failures int32) time.Duration {
+	if failures <= freeLoginFailures {
+		return 0
+	}
+	if failures >= maxLoginFailures {
+		return accountLockoutDuration
+	}
+	return loginFailureBaseDelay << uint(failures-freeLoginFailures-1)
+}
+
+// LoginThrottledError is returned by Login when an account must wait before
+// trying again because of earlier failed logins.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool // Locked is true if the account is locked out
+}
+
+func (e LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("account is locked for %v", e.RetryAfter)
+	}
+	return fmt.Sprintf("login is delayed for %v", e.RetryAfter)
+}
+
+// AccountLockedError is returned by the failed Login that locks an account so
+// the caller can offer a way to unlock it.
+type AccountLockedError struct {
+	UserID     int32
+	RetryAfter time.Duration
+}
+
+func (e AccountLockedError) Error() string {
+	return fmt.Sprintf("account is locked for %v", e.RetryAfter)
+}
 
 type DuplicationError struct {
 	Field string // Field or fields that caused the rejection
@@ -21,12 +71,31 @@ func (e DuplicationError) Error() string {
 
 type UserRepository interface {
 	GetUser(userID int32) (user User, err error)
+	GetUserByEmail(email string) (user User, err error)
+	GetUsers() (users []User, err error)
 	CreateUser(name, email, password string) (user User, err error)
+	CreateVerifiedUser(name, email, password string) (user User, err error)
 	Login(email, password string) (user User, err error)
+	CheckPassword(userID int32, password string) (err error)
 	SetPassword(userID int32, password string) (err error)
+	DisableUser(userID int32) (err error)
+
+	SetName(userID int32, name string) (user User, err error)
 
 	CreatePasswordResetToken(email string, requestIP string) (token string, err error)
 	SetPasswordByToken(token, password string, completionIP string) error
+
+	CreateEmailChangeToken(userID int32, email string, requestIP string) (token string, err error)
+	SetEmailByToken(token string, completionIP string) (user User, err error)
+
+	CreateEmailVerificationToken(userID int32, requestIP string) (token string, err error)
+	SetEmailVerifiedByToken(token string, completionIP string) (user User, err error)
+	SetEmailVerified(userID int32) (err error)
+
+	CreateAccountUnlockToken(userID int32, requestIP string) (token string, err error)
+	UnlockAccountByToken(token string, completionIP string) (user User, err error)
+	UnlockAccount(userID int32) (err error)
+	GetLoginFailures() (failures []UserLoginFailures, err error)
 }
 
 type UserCreatedSignaler interface {
@@ -35,15 +104,30 @@ type UserCreatedSignaler interface {
 
 // +gen signal
 type User struct {
-	ID    int32
-	Name  string
-	Email string
+	ID            int32
+	Name          string
+	Email         string
+	EmailVerified bool
+	Disabled      bool
+}
+
+// UserLoginFailures is a user that has failed to log in since its last
+// successful login.
+type UserLoginFailures struct {
+	User         User
+	Failures     int32
+	BlockedUntil time.Time
 }
 
 // +gen signal
 type Channel struct {
-	ID   int32
-	Name string
+	ID               int32
+	Name             string
+	Topic            string
+	Description      string
+	OwnerID          int32
+	Archived         bool
+	PinnedMessageIDs []int64
 }
 
 // +gen signal
@@ -52,44 +136,107 @@ type Message struct {
 	ChannelID int32
 	AuthorID  int32
 	Body      string
+	BodyHTML  string
 	Time      time.Time
 }
 
+// +gen signal
+type MessageUnfurl struct {
+	MessageID int64
+	ChannelID int32
+	Previews  []LinkPreview
+}
+
+// Event is a notification recorded in the event log. IDs increase in the
+// order events are committed so a client that knows the last event it
+// received can be sent the ones it missed. Params is a JSON object.
+// +gen signal
+type Event struct {
+	ID     int64
+	Method string
+	Params json.RawMessage
+	Time   time.Time
+}
+
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+}
+
 type SessionRepository interface {
 	CreateSession(userID int32) (sessionID string, err error)
 	DeleteSession(sessionID string) (err error)
+	DeleteUserSessions(userID int32) (count int64, err error)
 	GetUserIDBySessionID(sessionID string) (userID int32, err error)
 }
 
 type ChatRepository interface {
 	CreateChannel(name string, userID int32) (channelID int32, err error)
 	RenameChannel(channelID int32, name string) (err error)
+	SetChannelTopic(channelID int32, topic, description string) (err error)
+	SetChannelOwner(channelID, ownerID int32) (err error)
+	GetChannel(channelID int32) (channel Channel, err error)
 	GetChannels() (channels []Channel, err error)
-	PostMessage(channelID int32, authorID int32, body string) (messageID int64, err error)
+	GetArchivedChannels() (channels []Channel, err error)
+	ArchiveChannel(channelID int32) (err error)
+	UnarchiveChannel(channelID int32) (err error)
+	DeleteChannel(channelID int32) (err error)
+	PinMessage(messageID int64, userID int32) (err error)
+	UnpinMessage(messageID int64) (err error)
+	// PostMessage returns the message already posted by authorID with
+	// clientNonce instead of posting it again. An empty clientNonce never
+	// matches.
+	PostMessage(channelID int32, authorID int32, body, clientNonce string) (message Message, err error)
+	GetMessage(messageID int64) (message Message, err error)
 	GetMessages(channelID int32, beforeMessageID int32, maxCount int32) (messages []Message, err error)
 	GetInit(userID int32) (json []byte, err error)
 }
 
-type ChannelCreatedSignaler interface {
-	ChannelCreatedSignal() *ChannelSignal
+type LinkPreviewRepository interface {
+	GetLinkPreview(url string) (preview LinkPreview, err error)
+	SaveLinkPreview(preview LinkPreview) (err error)
+	UnfurlMessage(unfurl MessageUnfurl) (err error)
+}
+
+type EventRepository interface {
+	GetEventsAfter(eventID int64, maxCount int32) (events []Event, err error)
+	// GetEventRange returns the IDs of the oldest and newest events in the
+	// log. Both are zero if it is empty.
+	GetEventRange() (firstID, lastID int64, err error)
+	// DeleteEventsBefore deletes events recorded before t except the newest.
+	DeleteEventsBefore(t time.Time) (count int64, err error)
 }
 
-type ChannelRenamedSignaler interface {
-	ChannelRenamedSignal() *ChannelSignal
+type EventSignaler interface {
+	EventSignal() *EventSignal
+}
+
+type ChannelCreatedSignaler interface {
+	ChannelCreatedSignal() *ChannelSignal
 }
 
 type MessagePostedSignaler interface {
 	MessagePostedSignal() *MessageSignal
 }
 
+type MessageUnfurledSignaler interface {
+	MessageUnfurledSignal() *MessageUnfurlSignal
+}
+
 type Repository interface {
 	UserRepository
 	UserCreatedSignaler
 	SessionRepository
 	ChatRepository
 	ChannelCreatedSignaler
-	ChannelRenamedSignaler
 	MessagePostedSignaler
+	LinkPreviewRepository
+	MessageUnfurledSignaler
+	EventRepository
+	EventSignaler
 }
 
 func DigestPassword(password string) (digest, salt []byte, err error) {
@@ -116,6 +263,19 @@ func PasswordMatch(password string, validDigest, salt []byte) bool {
 	return bytes.Equal(digest, validDigest)
 }
 
+func ValidateEmail(email string) error {
+	if email == "" {
+		return errors.New(`Request must include the attribute "email"`)
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 1 || at == len(email)-1 || strings.ContainsAny(email, " \t\r\n<>") {
+		return errors.New(`"email" must be a valid email address`)
+	}
+
+	return nil
+}
+
 func ValidatePassword(password string) error {
 	if len(password) < 8 {
 		return errors.New("password must be at least 8 characters")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 )
@@ -54,6 +55,29 @@ func testUserRepositoryGetUser(t *testing.T, repo UserRepository) {
 	}
 }
 
+func testUserRepositoryCreateVerifiedUser(t *testing.T, repo UserRepository) {
+	createdUser, err := repo.CreateVerifiedUser("tester", "tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateVerifiedUser returned error: %v", err)
+	}
+	if !createdUser.EmailVerified {
+		t.Errorf("Expected created user to have a verified email, but it did not")
+	}
+
+	foundUser, err := repo.GetUser(createdUser.ID)
+	if err != nil {
+		t.Fatalf("repo.GetUser returned error: %v", err)
+	}
+	if createdUser != foundUser {
+		t.Fatalf("Expected repo.GetUser to return %v, but it returned %v", createdUser, foundUser)
+	}
+
+	_, err = repo.CreateVerifiedUser("other", "tester@example.com", "secret")
+	if err, ok := err.(DuplicationError); !ok || err.Field != "email" {
+		t.Fatalf("Expected repo.CreateVerifiedUser with taken email to return email DuplicationError, but it returned %v", err)
+	}
+}
+
 func testUserRepositorySetPassword(t *testing.T, repo UserRepository) {
 	user, err := repo.CreateUser("tester", "tester@example.com", "oldpassword")
 	if err != nil {
@@ -83,6 +107,35 @@ func testUserRepositorySetPassword(t *testing.T, repo UserRepository) {
 	}
 }
 
+func testUserRepositoryCheckPassword(t *testing.T, repo UserRepository) {
+	user, err := repo.CreateUser("tester", "tester@example.com", "password")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	for i := 0; i < maxLoginFailures; i++ {
+		err = repo.CheckPassword(user.ID, "wrong")
+		if err != ErrNotFound {
+			t.Fatalf("%d. Expected repo.CheckPassword with wrong password to return ErrNotFound, but it returned: %v", i, err)
+		}
+	}
+
+	err = repo.CheckPassword(user.ID, "password")
+	if err != nil {
+		t.Fatalf("repo.CheckPassword returned error: %v", err)
+	}
+
+	_, err = repo.Login("tester@example.com", "password")
+	if err != nil {
+		t.Fatalf("Expected CheckPassword failures not to affect Login, but it returned: %v", err)
+	}
+
+	err = repo.CheckPassword(user.ID+1, "password")
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.CheckPassword with missing user to return ErrNotFound, but it returned: %v", err)
+	}
+}
+
 func testUserRepositoryResetPasswordsLifeCycle(t *testing.T, repo UserRepository) {
 	_, err := repo.CreatePasswordResetToken("missing@example.com", "127.0.0.1")
 	if err != ErrNotFound {
@@ -149,6 +202,21 @@ func testSessionRepository(t *testing.T, repo SessionRepository, userID int32) {
 	if err != ErrNotFound {
 		t.Fatalf("Expected repo.GetUserIDBySessionID to return ErrNotFound, but returned error: %v", err)
 	}
+
+	for i := 0; i < 2; i++ {
+		_, err = repo.CreateSession(userID)
+		if err != nil {
+			t.Fatalf("repo.Create returned error: %v", err)
+		}
+	}
+
+	count, err := repo.DeleteUserSessions(userID)
+	if err != nil {
+		t.Fatalf("repo.DeleteUserSessions returned error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected repo.DeleteUserSessions to delete %d sessions, but it was %d", 2, count)
+	}
 }
 
 func testChatRepository(t *testing.T, repo ChatRepository, userID int32) {
@@ -192,7 +260,7 @@ func testChatRepository(t *testing.T, repo ChatRepository, userID int32) {
 		t.Errorf("Expected repo.GetMessages to return %d messages, but it was %d", 0, len(messages))
 	}
 
-	messageID, err := repo.PostMessage(channelID, userID, "Hello, world")
+	message, err := repo.PostMessage(channelID, userID, "Hello, world", "")
 	if err != nil {
 		t.Fatalf("repo.PostMessage returned error: %v", err)
 	}
@@ -204,8 +272,8 @@ func testChatRepository(t *testing.T, repo ChatRepository, userID int32) {
 	if len(channels) != 1 {
 		t.Errorf("Expected repo.GetMessages to return %d messages, but it was %d", 1, len(messages))
 	}
-	if messages[0].ID != messageID {
-		t.Errorf("Expect message to have ID %d, but it was %d", messageID, messages[0].ID)
+	if messages[0].ID != message.ID {
+		t.Errorf("Expect message to have ID %d, but it was %d", message.ID, messages[0].ID)
 	}
 	if messages[0].AuthorID != userID {
 		t.Errorf("Expect message to have AuthorID %d, but it was %d", userID, messages[0].AuthorID)
@@ -213,6 +281,9 @@ func testChatRepository(t *testing.T, repo ChatRepository, userID int32) {
 	if messages[0].Body != "Hello, world" {
 		t.Errorf("Expect message to have Body %s, but it was %s", "Hello, world", messages[0].Body)
 	}
+	if messages[0].BodyHTML != "<p>Hello, world</p>" {
+		t.Errorf("Expect message to have BodyHTML %s, but it was %s", "<p>Hello, world</p>", messages[0].BodyHTML)
+	}
 }
 
 func testMessagePostedNotifier(t *testing.T, signaler MessagePostedSignaler, repo ChatRepository, userID int32) {
@@ -231,7 +302,7 @@ func testMessagePostedNotifier(t *testing.T, signaler MessagePostedSignaler, rep
 		finished <- true
 	}()
 
-	messageID, err := repo.PostMessage(channelID, userID, "Hello, world")
+	posted, err := repo.PostMessage(channelID, userID, "Hello, **world**", "")
 	if err != nil {
 		t.Fatalf("repo.PostMessage returned error: %v", err)
 	}
@@ -242,8 +313,8 @@ func testMessagePostedNotifier(t *testing.T, signaler MessagePostedSignaler, rep
 		t.Fatal("Never received message on channel c")
 	}
 
-	if message.ID != messageID {
-		t.Errorf("Expected message.ID to be %v, but it was %v", messageID, message.ID)
+	if message.ID != posted.ID {
+		t.Errorf("Expected message.ID to be %v, but it was %v", posted.ID, message.ID)
 	}
 	if message.ChannelID != channelID {
 		t.Errorf("Expected message.ChannelID to be %v, but it was %v", channelID, message.ChannelID)
@@ -251,14 +322,17 @@ func testMessagePostedNotifier(t *testing.T, signaler MessagePostedSignaler, rep
 	if message.AuthorID != userID {
 		t.Errorf("Expected message.AuthorID to be %v, but it was %v", userID, message.AuthorID)
 	}
-	if message.Body != "Hello, world" {
-		t.Errorf("Expected message.Body to be %v, but it was %v", "Hello, world", message.Body)
+	if message.Body != "Hello, **world**" {
+		t.Errorf("Expected message.Body to be %v, but it was %v", "Hello, **world**", message.Body)
+	}
+	if message.BodyHTML != "<p>Hello, <strong>world</strong></p>" {
+		t.Errorf("Expected message.BodyHTML to be %v, but it was %v", "<p>Hello, <strong>world</strong></p>", message.BodyHTML)
 	}
 
 	signaler.MessagePostedSignal().Remove(c)
 
 	// If the Unlisten didn't work this will hang
-	_, err = repo.PostMessage(channelID, userID, "Goodbye, world")
+	_, err = repo.PostMessage(channelID, userID, "Goodbye, world", "")
 	if err != nil {
 		t.Fatalf("repo.PostMessage returned error: %v", err)
 	}
@@ -342,3 +416,783 @@ func testChannelCreatedSignaler(t *testing.T, signaler ChannelCreatedSignaler, c
 		t.Fatalf("chatRepo.CreateChannel returned error: %v", err)
 	}
 }
+
+func testLinkPreviewRepository(t *testing.T, repo LinkPreviewRepository) {
+	_, err := repo.GetLinkPreview("http://example.com")
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.GetLinkPreview to return ErrNotFound, but it was %v", err)
+	}
+
+	preview := LinkPreview{
+		URL:         "http://example.com",
+		Title:       "Example",
+		Description: "An example site",
+		ImageURL:    "http://example.com/logo.png",
+		SiteName:    "Example Inc",
+	}
+
+	err = repo.SaveLinkPreview(preview)
+	if err != nil {
+		t.Fatalf("repo.SaveLinkPreview returned error: %v", err)
+	}
+
+	foundPreview, err := repo.GetLinkPreview(preview.URL)
+	if err != nil {
+		t.Fatalf("repo.GetLinkPreview returned error: %v", err)
+	}
+	if foundPreview != preview {
+		t.Errorf("Expected repo.GetLinkPreview to return %v, but it was %v", preview, foundPreview)
+	}
+
+	preview.Title = "Updated"
+	err = repo.SaveLinkPreview(preview)
+	if err != nil {
+		t.Fatalf("repo.SaveLinkPreview returned error: %v", err)
+	}
+
+	foundPreview, err = repo.GetLinkPreview(preview.URL)
+	if err != nil {
+		t.Fatalf("repo.GetLinkPreview returned error: %v", err)
+	}
+	if foundPreview != preview {
+		t.Errorf("Expected repo.GetLinkPreview to return %v, but it was %v", preview, foundPreview)
+	}
+}
+
+func testChatRepositoryChannelTopicAndPins(t *testing.T, repo ChatRepository, userID int32) {
+	channelID, err := repo.CreateChannel("General", userID)
+	if err != nil {
+		t.Fatalf("repo.CreateChannel returned error: %v", err)
+	}
+
+	err = repo.SetChannelTopic(channelID, "Release planning", "Where we plan releases")
+	if err != nil {
+		t.Fatalf("repo.SetChannelTopic returned error: %v", err)
+	}
+
+	err = repo.SetChannelTopic(channelID+1, "Missing", "")
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.SetChannelTopic with missing channel to return ErrNotFound, but it was %v", err)
+	}
+
+	message, err := repo.PostMessage(channelID, userID, "Remember this", "")
+	if err != nil {
+		t.Fatalf("repo.PostMessage returned error: %v", err)
+	}
+
+	found, err := repo.GetMessage(message.ID)
+	if err != nil {
+		t.Fatalf("repo.GetMessage returned error: %v", err)
+	}
+	if found.ID != message.ID || found.ChannelID != channelID || found.Body != "Remember this" {
+		t.Errorf("Expected repo.GetMessage to return %v, but it was %v", message, found)
+	}
+
+	_, err = repo.GetMessage(message.ID + 1)
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.GetMessage with missing message to return ErrNotFound, but it was %v", err)
+	}
+
+	err = repo.PinMessage(message.ID, userID)
+	if err != nil {
+		t.Fatalf("repo.PinMessage returned error: %v", err)
+	}
+
+	// Pinning twice is not an error
+	err = repo.PinMessage(message.ID, userID)
+	if err != nil {
+		t.Fatalf("repo.PinMessage returned error: %v", err)
+	}
+
+	err = repo.PinMessage(message.ID+1, userID)
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.PinMessage with missing message to return ErrNotFound, but it was %v", err)
+	}
+
+	channel, err := repo.GetChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.GetChannel returned error: %v", err)
+	}
+	if channel.Topic != "Release planning" {
+		t.Errorf("Expected channel.Topic to be %s, but it was %s", "Release planning", channel.Topic)
+	}
+	if channel.Description != "Where we plan releases" {
+		t.Errorf("Expected channel.Description to be %s, but it was %s", "Where we plan releases", channel.Description)
+	}
+	if len(channel.PinnedMessageIDs) != 1 || channel.PinnedMessageIDs[0] != message.ID {
+		t.Errorf("Expected channel.PinnedMessageIDs to be %v, but it was %v", []int64{message.ID}, channel.PinnedMessageIDs)
+	}
+
+	err = repo.UnpinMessage(message.ID)
+	if err != nil {
+		t.Fatalf("repo.UnpinMessage returned error: %v", err)
+	}
+
+	err = repo.UnpinMessage(message.ID)
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.UnpinMessage of unpinned message to return ErrNotFound, but it was %v", err)
+	}
+
+	channel, err = repo.GetChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.GetChannel returned error: %v", err)
+	}
+	if len(channel.PinnedMessageIDs) != 0 {
+		t.Errorf("Expected channel.PinnedMessageIDs to be empty, but it was %v", channel.PinnedMessageIDs)
+	}
+}
+
+func testChatRepositoryArchiveAndDeleteChannel(t *testing.T, repo ChatRepository, userID int32) {
+	channelID, err := repo.CreateChannel("General", userID)
+	if err != nil {
+		t.Fatalf("repo.CreateChannel returned error: %v", err)
+	}
+
+	message, err := repo.PostMessage(channelID, userID, "Hello", "")
+	if err != nil {
+		t.Fatalf("repo.PostMessage returned error: %v", err)
+	}
+
+	err = repo.PinMessage(message.ID, userID)
+	if err != nil {
+		t.Fatalf("repo.PinMessage returned error: %v", err)
+	}
+
+	err = repo.ArchiveChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.ArchiveChannel returned error: %v", err)
+	}
+
+	// Archived channels are read-only
+	err = repo.RenameChannel(channelID, "Old")
+	if err != ErrChannelArchived {
+		t.Fatalf("Expected repo.RenameChannel of archived channel to return ErrChannelArchived, but it was %v", err)
+	}
+
+	err = repo.SetChannelTopic(channelID, "Old news", "")
+	if err != ErrChannelArchived {
+		t.Fatalf("Expected repo.SetChannelTopic of archived channel to return ErrChannelArchived, but it was %v", err)
+	}
+
+	err = repo.UnpinMessage(message.ID)
+	if err != ErrChannelArchived {
+		t.Fatalf("Expected repo.UnpinMessage in archived channel to return ErrChannelArchived, but it was %v", err)
+	}
+
+	err = repo.PinMessage(message.ID, userID)
+	if err != ErrChannelArchived {
+		t.Fatalf("Expected repo.PinMessage in archived channel to return ErrChannelArchived, but it was %v", err)
+	}
+
+	channel, err := repo.GetChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.GetChannel returned error: %v", err)
+	}
+	if channel.Name != "General" || channel.Topic != "" || len(channel.PinnedMessageIDs) != 1 {
+		t.Errorf("Expected archived channel to be unchanged, but it was %v", channel)
+	}
+
+	err = repo.ArchiveChannel(channelID)
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.ArchiveChannel of archived channel to return ErrNotFound, but it was %v", err)
+	}
+
+	_, err = repo.PostMessage(channelID, userID, "Anyone here?", "")
+	if err != ErrChannelArchived {
+		t.Fatalf("Expected repo.PostMessage to archived channel to return ErrChannelArchived, but it was %v", err)
+	}
+
+	channels, err := repo.GetChannels()
+	if err != nil {
+		t.Fatalf("repo.GetChannels returned error: %v", err)
+	}
+	if len(channels) != 0 {
+		t.Errorf("Expected repo.GetChannels to return %d channels, but it was %d", 0, len(channels))
+	}
+
+	channels, err = repo.GetArchivedChannels()
+	if err != nil {
+		t.Fatalf("repo.GetArchivedChannels returned error: %v", err)
+	}
+	if len(channels) != 1 {
+		t.Fatalf("Expected repo.GetArchivedChannels to return %d channels, but it was %d", 1, len(channels))
+	}
+	if channels[0].ID != channelID || !channels[0].Archived || channels[0].OwnerID != userID {
+		t.Errorf("Expected archived channel %d owned by %d, but it was %v", channelID, userID, channels[0])
+	}
+
+	err = repo.UnarchiveChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.UnarchiveChannel returned error: %v", err)
+	}
+
+	_, err = repo.PostMessage(channelID, userID, "Welcome back", "")
+	if err != nil {
+		t.Fatalf("repo.PostMessage returned error: %v", err)
+	}
+
+	err = repo.DeleteChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.DeleteChannel returned error: %v", err)
+	}
+
+	_, err = repo.GetChannel(channelID)
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.GetChannel of deleted channel to return ErrNotFound, but it was %v", err)
+	}
+
+	messages, err := repo.GetMessages(channelID, -1, 100)
+	if err != nil {
+		t.Fatalf("repo.GetMessages returned error: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected deleted channel to have %d messages, but it had %d", 0, len(messages))
+	}
+
+	_, err = repo.PostMessage(channelID, userID, "Hello?", "")
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.PostMessage to deleted channel to return ErrNotFound, but it was %v", err)
+	}
+}
+
+func testChatRepositoryPostMessageClientNonce(t *testing.T, repo ChatRepository, userID, otherUserID int32) {
+	channelID, err := repo.CreateChannel("General", userID)
+	if err != nil {
+		t.Fatalf("repo.CreateChannel returned error: %v", err)
+	}
+
+	original, err := repo.PostMessage(channelID, userID, "Hello", "abc")
+	if err != nil {
+		t.Fatalf("repo.PostMessage returned error: %v", err)
+	}
+	if original.ID == 0 || original.Time.IsZero() {
+		t.Errorf("Expected repo.PostMessage to return the stored message, but it was %v", original)
+	}
+
+	retry, err := repo.PostMessage(channelID, userID, "Hello again", "abc")
+	if err != nil {
+		t.Fatalf("repo.PostMessage returned error: %v", err)
+	}
+	if retry.ID != original.ID || retry.Body != "Hello" || !retry.Time.Equal(original.Time) {
+		t.Errorf("Expected repo.PostMessage with used nonce to return %v, but it was %v", original, retry)
+	}
+
+	other, err := repo.PostMessage(channelID, otherUserID, "Hello", "abc")
+	if err != nil {
+		t.Fatalf("repo.PostMessage returned error: %v", err)
+	}
+	if other.ID == original.ID {
+		t.Error("Expected nonce used by another author to post a new message, but it returned the original")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = repo.PostMessage(channelID, userID, "No nonce", "")
+		if err != nil {
+			t.Fatalf("repo.PostMessage returned error: %v", err)
+		}
+	}
+
+	messages, err := repo.GetMessages(channelID, -1, 100)
+	if err != nil {
+		t.Fatalf("repo.GetMessages returned error: %v", err)
+	}
+	if len(messages) != 4 {
+		t.Errorf("Expected repo.GetMessages to return %d messages, but it was %d", 4, len(messages))
+	}
+
+	err = repo.ArchiveChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.ArchiveChannel returned error: %v", err)
+	}
+
+	retry, err = repo.PostMessage(channelID, userID, "Hello", "abc")
+	if err != nil {
+		t.Fatalf("repo.PostMessage retry to archived channel returned error: %v", err)
+	}
+	if retry.ID != original.ID {
+		t.Errorf("Expected repo.PostMessage retry to archived channel to return message %d, but it was %d", original.ID, retry.ID)
+	}
+
+	_, err = repo.PostMessage(channelID, userID, "Hello", "def")
+	if err != ErrChannelArchived {
+		t.Fatalf("Expected repo.PostMessage to archived channel to return ErrChannelArchived, but it was %v", err)
+	}
+}
+
+func testChatRepositorySetChannelOwner(t *testing.T, repo ChatRepository, userID int32) {
+	channelID, err := repo.CreateChannel("General", 0)
+	if err != nil {
+		t.Fatalf("repo.CreateChannel returned error: %v", err)
+	}
+
+	channel, err := repo.GetChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.GetChannel returned error: %v", err)
+	}
+	if channel.OwnerID != 0 {
+		t.Errorf("Expected channel created without owner to have OwnerID %d, but it was %d", 0, channel.OwnerID)
+	}
+
+	err = repo.SetChannelOwner(channelID, userID)
+	if err != nil {
+		t.Fatalf("repo.SetChannelOwner returned error: %v", err)
+	}
+
+	channel, err = repo.GetChannel(channelID)
+	if err != nil {
+		t.Fatalf("repo.GetChannel returned error: %v", err)
+	}
+	if channel.OwnerID != userID {
+		t.Errorf("Expected channel.OwnerID to be %d, but it was %d", userID, channel.OwnerID)
+	}
+
+	err = repo.SetChannelOwner(channelID+1, userID)
+	if err != ErrNotFound {
+		t.Fatalf("Expected repo.SetChannelOwner with missing channel to return ErrNotFound, but it was %v", err)
+	}
+}
+
+func testUserRepositorySetName(t *testing.T, repo UserRepository) {
+	user, err := repo.CreateUser("tester", "tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	_, err = repo.CreateUser("other", "other@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	updatedUser, err := repo.SetName(user.ID, "renamed")
+	if err != nil {
+		t.Fatalf("repo.SetName returned error: %v", err)
+	}
+	if updatedUser.Name != "renamed" {
+		t.Errorf("Expected updatedUser.Name to be %s, but it was %s", "renamed", updatedUser.Name)
+	}
+
+	_, err = repo.SetName(user.ID, "other")
+	if err != (DuplicationError{Field: "name"}) {
+		t.Errorf("Expected repo.SetName with taken name to return DuplicationError, but it was %v", err)
+	}
+}
+
+func testUserRepositoryEmailChangeLifeCycle(t *testing.T, repo UserRepository) {
+	user, err := repo.CreateUser("tester", "tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	_, err = repo.CreateUser("other", "other@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	takenToken, err := repo.CreateEmailChangeToken(user.ID, "other@example.com", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Expected repo.CreateEmailChangeToken with taken email not to reveal it is taken, but it returned %v", err)
+	}
+
+	_, err = repo.SetEmailByToken(takenToken, "127.0.0.1")
+	if err != (DuplicationError{Field: "email"}) {
+		t.Fatalf("Expected repo.SetEmailByToken with taken email to return DuplicationError, but it was %v", err)
+	}
+
+	_, err = repo.SetEmailByToken("invalidtoken", "127.0.0.1")
+	if err != ErrNotFound {
+		t.Fatalf("repo.SetEmailByToken should have returned ErrNotFound but it returned: %v", err)
+	}
+
+	token, err := repo.CreateEmailChangeToken(user.ID, "new@example.com", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("repo.CreateEmailChangeToken returned error: %v", err)
+	}
+
+	updatedUser, err := repo.SetEmailByToken(token, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("repo.SetEmailByToken returned error: %v", err)
+	}
+	if updatedUser.Email != "new@example.com" {
+		t.Errorf("Expected updatedUser.Email to be %s, but it was %s", "new@example.com", updatedUser.Email)
+	}
+
+	_, err = repo.SetEmailByToken(token, "127.0.0.1")
+	if err != ErrNotFound {
+		t.Fatalf("repo.SetEmailByToken with used token should have returned ErrNotFound but it returned: %v", err)
+	}
+
+	_, err = repo.Login("new@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.Login returned error: %v", err)
+	}
+}
+
+func testUserRepositoryEmailVerificationLifeCycle(t *testing.T, repo UserRepository) {
+	user, err := repo.CreateUser("tester", "tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+	if user.EmailVerified {
+		t.Fatal("Expected new user not to have verified email, but it did")
+	}
+
+	_, err = repo.SetEmailVerifiedByToken("invalidtoken", "127.0.0.1")
+	if err != ErrNotFound {
+		t.Fatalf("repo.SetEmailVerifiedByToken should have returned ErrNotFound but it returned: %v", err)
+	}
+
+	token, err := repo.CreateEmailVerificationToken(user.ID, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("repo.CreateEmailVerificationToken returned error: %v", err)
+	}
+
+	verifiedUser, err := repo.SetEmailVerifiedByToken(token, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("repo.SetEmailVerifiedByToken returned error: %v", err)
+	}
+	if verifiedUser.ID != user.ID || !verifiedUser.EmailVerified {
+		t.Errorf("Expected user %d to be verified, but it was %v", user.ID, verifiedUser)
+	}
+
+	_, err = repo.SetEmailVerifiedByToken(token, "127.0.0.1")
+	if err != ErrNotFound {
+		t.Fatalf("repo.SetEmailVerifiedByToken with used token should have returned ErrNotFound but it returned: %v", err)
+	}
+
+	foundUser, err := repo.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("repo.GetUser returned error: %v", err)
+	}
+	if !foundUser.EmailVerified {
+		t.Error("Expected user to have verified email, but it did not")
+	}
+}
+
+func testUserRepositoryGetUsers(t *testing.T, repo UserRepository) {
+	first, err := repo.CreateUser("first", "first@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	second, err := repo.CreateUser("second", "second@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	users, err := repo.GetUsers()
+	if err != nil {
+		t.Fatalf("repo.GetUsers returned error: %v", err)
+	}
+	if len(users) != 2 || users[0] != first || users[1] != second {
+		t.Errorf("Expected users to be %v, but it was %v", []User{first, second}, users)
+	}
+
+	user, err := repo.GetUserByEmail("second@example.com")
+	if err != nil {
+		t.Fatalf("repo.GetUserByEmail returned error: %v", err)
+	}
+	if user != second {
+		t.Errorf("Expected user to be %v, but it was %v", second, user)
+	}
+
+	_, err = repo.GetUserByEmail("missing@example.com")
+	if err != ErrNotFound {
+		t.Errorf("Expected repo.GetUserByEmail with unknown email to return %v, but it was %v", ErrNotFound, err)
+	}
+}
+
+func testUserRepositoryDisableUser(t *testing.T, repo UserRepository, sessionRepo SessionRepository) {
+	user, err := repo.CreateUser("tester", "tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	sessionID, err := sessionRepo.CreateSession(user.ID)
+	if err != nil {
+		t.Fatalf("sessionRepo.CreateSession returned error: %v", err)
+	}
+
+	err = repo.DisableUser(user.ID)
+	if err != nil {
+		t.Fatalf("repo.DisableUser returned error: %v", err)
+	}
+
+	user, err = repo.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("repo.GetUser returned error: %v", err)
+	}
+	if !user.Disabled {
+		t.Error("Expected user.Disabled to be true, but it was false")
+	}
+
+	_, err = repo.Login("tester@example.com", "secret")
+	if err != ErrNotFound {
+		t.Errorf("Expected repo.Login of disabled user to return %v, but it was %v", ErrNotFound, err)
+	}
+
+	_, err = sessionRepo.GetUserIDBySessionID(sessionID)
+	if err != ErrNotFound {
+		t.Errorf("Expected session of disabled user to be revoked, but sessionRepo.GetUserIDBySessionID returned %v", err)
+	}
+
+	err = repo.DisableUser(-1)
+	if err != ErrNotFound {
+		t.Errorf("Expected repo.DisableUser with unknown user to return %v, but it was %v", ErrNotFound, err)
+	}
+}
+
+func TestLoginFailureDelay(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		failures int32
+		delay    time.Duration
+	}{
+		{1, 0},
+		{freeLoginFailures, 0},
+		{freeLoginFailures + 1, loginFailureBaseDelay},
+		{freeLoginFailures + 2, 2 * loginFailureBaseDelay},
+		{freeLoginFailures + 3, 4 * loginFailureBaseDelay},
+		{maxLoginFailures, accountLockoutDuration},
+		{maxLoginFailures + 5, accountLockoutDuration},
+	}
+
+	for i, tt := range tests {
+		delay := loginFailureDelay(tt.failures)
+		if delay != tt.delay {
+			t.Errorf("%d. Expected loginFailureDelay(%d) to be %v, but it was %v", i, tt.failures, tt.delay, delay)
+		}
+	}
+}
+
+func testUserRepositoryConcurrentLoginFailures(t *testing.T, repo UserRepository) {
+	_, err := repo.CreateUser("tester", "tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	results := make(chan error, maxLoginFailures)
+	for i := 0; i < maxLoginFailures; i++ {
+		go func() {
+			_, err := repo.Login("tester@example.com", "wrong")
+			results <- err
+		}()
+	}
+
+	var counted int32
+	for i := 0; i < maxLoginFailures; i++ {
+		switch err := <-results; err.(type) {
+		case LoginThrottledError:
+		case AccountLockedError:
+			counted++
+		default:
+			if err != ErrNotFound {
+				t.Fatalf("Expected repo.Login with wrong password to fail, but it returned: %v", err)
+			}
+			counted++
+		}
+	}
+
+	failures, err := repo.GetLoginFailures()
+	if err != nil {
+		t.Fatalf("repo.GetLoginFailures returned error: %v", err)
+	}
+	if len(failures) != 1 || failures[0].Failures != counted {
+		t.Fatalf("Expected %d login failures to be recorded, but they were %v", counted, failures)
+	}
+}
+
+func testUserRepositoryLoginFailures(t *testing.T, repo UserRepository) {
+	user, err := repo.CreateUser("tester", "tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser returned error: %v", err)
+	}
+
+	for i := 0; i <= freeLoginFailures; i++ {
+		_, err = repo.Login("tester@example.com", "wrong")
+		if err != ErrNotFound {
+			t.Fatalf("%d. Expected repo.Login with wrong password to return ErrNotFound, but it returned: %v", i, err)
+		}
+	}
+
+	_, err = repo.Login("tester@example.com", "secret")
+	if throttled, ok := err.(LoginThrottledError); !ok || throttled.Locked || throttled.RetryAfter <= 0 {
+		t.Fatalf("Expected repo.Login to be delayed, but it returned: %v", err)
+	}
+
+	failures, err := repo.GetLoginFailures()
+	if err != nil {
+		t.Fatalf("repo.GetLoginFailures returned error: %v", err)
+	}
+	if len(failures) != 1 || failures[0].User.ID != user.ID || failures[0].Failures != freeLoginFailures+1 {
+		t.Fatalf("Expected one user with %d failures, but it was %v", freeLoginFailures+1, failures)
+	}
+
+	_, err = repo.UnlockAccountByToken("invalidtoken", "127.0.0.1")
+	if err != ErrNotFound {
+		t.Fatalf("repo.UnlockAccountByToken with invalid token should have returned ErrNotFound, but it returned: %v", err)
+	}
+
+	token, err := repo.CreateAccountUnlockToken(user.ID, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("repo.CreateAccountUnlockToken returned error: %v", err)
+	}
+
+	unlockedUser, err := repo.UnlockAccountByToken(token, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("repo.UnlockAccountByToken returned error: %v", err)
+	}
+	if unlockedUser.ID != user.ID {
+		t.Errorf("Expected repo.UnlockAccountByToken to return user %d, but it was %d", user.ID, unlockedUser.ID)
+	}
+
+	_, err = repo.UnlockAccountByToken(token, "127.0.0.1")
+	if err != ErrNotFound {
+		t.Errorf("repo.UnlockAccountByToken with used token should have returned ErrNotFound, but it returned: %v", err)
+	}
+
+	_, err = repo.Login("tester@example.com", "secret")
+	if err != nil {
+		t.Fatalf("Expected repo.Login to succeed after unlock, but it returned: %v", err)
+	}
+
+	for i := 0; i <= freeLoginFailures; i++ {
+		repo.Login("tester@example.com", "wrong")
+	}
+
+	err = repo.UnlockAccount(user.ID)
+	if err != nil {
+		t.Fatalf("repo.UnlockAccount returned error: %v", err)
+	}
+
+	failures, err = repo.GetLoginFailures()
+	if err != nil {
+		t.Fatalf("repo.GetLoginFailures returned error: %v", err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("Expected no login failures after unlock, but there were %v", failures)
+	}
+}
+
+func testEventRepository(t *testing.T, repo EventRepository, chatRepo ChatRepository, userID int32) {
+	_, startID, err := repo.GetEventRange()
+	if err != nil {
+		t.Fatalf("repo.GetEventRange returned error: %v", err)
+	}
+
+	channelID, err := chatRepo.CreateChannel("Events", userID)
+	if err != nil {
+		t.Fatalf("chatRepo.CreateChannel returned error: %v", err)
+	}
+	message, err := chatRepo.PostMessage(channelID, userID, "Hello", "")
+	if err != nil {
+		t.Fatalf("chatRepo.PostMessage returned error: %v", err)
+	}
+
+	events, err := repo.GetEventsAfter(startID, 10)
+	if err != nil {
+		t.Fatalf("repo.GetEventsAfter returned error: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected repo.GetEventsAfter to return %d events, but it was %d", 2, len(events))
+	}
+	if events[0].Method != "channel_created" {
+		t.Errorf("Expected first event to be %s, but it was %s", "channel_created", events[0].Method)
+	}
+	if events[1].Method != "message_posted" {
+		t.Errorf("Expected second event to be %s, but it was %s", "message_posted", events[1].Method)
+	}
+	if events[0].ID <= startID || events[1].ID <= events[0].ID {
+		t.Errorf("Expected event IDs to increase from %d, but they were %d and %d", startID, events[0].ID, events[1].ID)
+	}
+
+	var posted struct {
+		ID int64 `json:"id"`
+	}
+	err = json.Unmarshal(events[1].Params, &posted)
+	if err != nil {
+		t.Fatalf("Unable to parse event params %s: %v", events[1].Params, err)
+	}
+	if posted.ID != message.ID {
+		t.Errorf("Expected message_posted event to have ID %d, but it was %d", message.ID, posted.ID)
+	}
+	newestID := events[1].ID
+
+	events, err = repo.GetEventsAfter(startID, 1)
+	if err != nil {
+		t.Fatalf("repo.GetEventsAfter returned error: %v", err)
+	}
+	if len(events) != 1 {
+		t.Errorf("Expected repo.GetEventsAfter with maxCount 1 to return %d events, but it was %d", 1, len(events))
+	}
+
+	_, lastID, err := repo.GetEventRange()
+	if err != nil {
+		t.Fatalf("repo.GetEventRange returned error: %v", err)
+	}
+	if lastID != newestID {
+		t.Errorf("Expected the newest event to be %d, but it was %d", newestID, lastID)
+	}
+
+	_, err = repo.DeleteEventsBefore(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("repo.DeleteEventsBefore returned error: %v", err)
+	}
+
+	firstID, lastID, err := repo.GetEventRange()
+	if err != nil {
+		t.Fatalf("repo.GetEventRange returned error: %v", err)
+	}
+	if firstID != newestID || lastID != newestID {
+		t.Errorf("Expected only the newest event %d to be kept, but the range was %d to %d", newestID, firstID, lastID)
+	}
+}
+
+func testEventSignalOrder(t *testing.T, signaler EventSignaler, repo ChatRepository, userID int32) {
+	channelID, err := repo.CreateChannel("Test", userID)
+	if err != nil {
+		t.Fatalf("repo.CreateChannel returned error: %v", err)
+	}
+
+	c := make(chan Event)
+	signaler.EventSignal().Add(c)
+	defer signaler.EventSignal().Remove(c)
+
+	const posters = 4
+	const burst = 10
+	errChan := make(chan error, posters)
+	for p := 0; p < posters; p++ {
+		go func() {
+			for i := 0; i < burst; i++ {
+				if _, err := repo.PostMessage(channelID, userID, "Hello", ""); err != nil {
+					errChan <- err
+					return
+				}
+			}
+			errChan <- nil
+		}()
+	}
+
+	// The channel_created event may still be waiting to be dispatched
+	var lastID int64
+	for received := 0; received < posters*burst; {
+		select {
+		case event := <-c:
+			if event.ID <= lastID {
+				t.Fatalf("Expected event %d to be dispatched after event %d, but it was before", lastID, event.ID)
+			}
+			lastID = event.ID
+			if event.Method == "message_posted" {
+				received++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Received %d of %d events", received, posters*burst)
+		}
+	}
+
+	for p := 0; p < posters; p++ {
+		if err := <-errChan; err != nil {
+			t.Fatalf("repo.PostMessage returned error: %v", err)
+		}
+	}
+}
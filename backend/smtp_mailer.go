@@ -8,6 +8,10 @@ import (
 )
 
 var passwordResetMailTmpl = template.Must(template.New("passwordResetMailTemplate").Parse("To: {{.To}}\r\nSubject: The Pithy Reader Password Reset\r\n\r\nClick the following link to reset password: {{.RootURL}}/#resetPassword?token={{.Token}}"))
+var emailChangeConfirmationMailTmpl = template.Must(template.New("emailChangeConfirmationMailTemplate").Parse("To: {{.To}}\r\nSubject: JChat Email Change Confirmation\r\n\r\nClick the following link to confirm your new email address: {{.RootURL}}/#confirmEmailChange?token={{.Token}}"))
+var emailVerificationMailTmpl = template.Must(template.New("emailVerificationMailTemplate").Parse("To: {{.To}}\r\nSubject: JChat Email Verification\r\n\r\nClick the following link to verify your email address: {{.RootURL}}/#verifyEmail?token={{.Token}}"))
+var accountUnlockMailTmpl = template.Must(template.New("accountUnlockMailTemplate").Parse("To: {{.To}}\r\nSubject: JChat Account Locked\r\n\r\nYour account was locked after too many failed login attempts. Click the following link to unlock it: {{.RootURL}}/#unlockAccount?token={{.Token}}"))
+var testMailTmpl = template.Must(template.New("testMailTemplate").Parse("To: {{.To}}\r\nSubject: JChat Test Mail\r\n\r\nThis is a test mail from the JChat server at {{.RootURL}}. If you received it, mail is configured correctly."))
 
 type SMTPMailer struct {
 	ServerAddr string
@@ -18,6 +22,26 @@ type SMTPMailer struct {
 }
 
 func (m *SMTPMailer) SendPasswordResetMail(to, token string) error {
+	return m.sendTokenMail("SendPasswordResetEmail", passwordResetMailTmpl, to, token)
+}
+
+func (m *SMTPMailer) SendEmailChangeConfirmationMail(to, token string) error {
+	return m.sendTokenMail("SendEmailChangeConfirmationMail", emailChangeConfirmationMailTmpl, to, token)
+}
+
+func (m *SMTPMailer) SendEmailVerificationMail(to, token string) error {
+	return m.sendTokenMail("SendEmailVerificationMail", emailVerificationMailTmpl, to, token)
+}
+
+func (m *SMTPMailer) SendAccountUnlockMail(to, token string) error {
+	return m.sendTokenMail("SendAccountUnlockMail", accountUnlockMailTmpl, to, token)
+}
+
+func (m *SMTPMailer) SendTestMail(to string) error {
+	return m.sendTokenMail("SendTestMail", testMailTmpl, to, "")
+}
+
+func (m *SMTPMailer) sendTokenMail(name string, tmpl *template.Template, to, token string) error {
 	var data = struct {
 		RootURL string
 		To      string
@@ -29,17 +53,20 @@ func (m *SMTPMailer) SendPasswordResetMail(to, token string) error {
 	}
 
 	buf := &bytes.Buffer{}
-	err := passwordResetMailTmpl.Execute(buf, data)
+	err := tmpl.Execute(buf, data)
 	if err != nil {
 		return err
 	}
 
 	err = smtp.SendMail(m.ServerAddr, m.Auth, m.From, []string{to}, buf.Bytes())
 	if err != nil {
-		m.logger.Error("SendPasswordResetEmail failed", "to", to, "error", err)
+		metrics.Inc("jchat_mails_sent_total", "mail", name, "outcome", "failure")
+		m.logger.Error(name+" failed", "to", to, "error", err)
 		return err
 	}
 
-	m.logger.Info("SendPasswordResetEmail", "to", to)
+	metrics.Inc("jchat_mails_sent_total", "mail", name, "outcome", "success")
+
+	m.logger.Info(name, "to", to)
 	return nil
 }
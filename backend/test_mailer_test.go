@@ -5,8 +5,27 @@ type testPasswordResetMail struct {
 	token string
 }
 
+type testEmailChangeConfirmationMail struct {
+	to    string
+	token string
+}
+
+type testEmailVerificationMail struct {
+	to    string
+	token string
+}
+
+type testAccountUnlockMail struct {
+	to    string
+	token string
+}
+
 type testMailer struct {
-	sentPasswordResetMails []testPasswordResetMail
+	sentPasswordResetMails           []testPasswordResetMail
+	sentEmailChangeConfirmationMails []testEmailChangeConfirmationMail
+	sentEmailVerificationMails       []testEmailVerificationMail
+	sentAccountUnlockMails           []testAccountUnlockMail
+	sentTestMails                    []string
 }
 
 func (m *testMailer) SendPasswordResetMail(to, token string) error {
@@ -14,3 +33,26 @@ func (m *testMailer) SendPasswordResetMail(to, token string) error {
 	m.sentPasswordResetMails = append(m.sentPasswordResetMails, e)
 	return nil
 }
+
+func (m *testMailer) SendEmailChangeConfirmationMail(to, token string) error {
+	e := testEmailChangeConfirmationMail{to: to, token: token}
+	m.sentEmailChangeConfirmationMails = append(m.sentEmailChangeConfirmationMails, e)
+	return nil
+}
+
+func (m *testMailer) SendEmailVerificationMail(to, token string) error {
+	e := testEmailVerificationMail{to: to, token: token}
+	m.sentEmailVerificationMails = append(m.sentEmailVerificationMails, e)
+	return nil
+}
+
+func (m *testMailer) SendAccountUnlockMail(to, token string) error {
+	e := testAccountUnlockMail{to: to, token: token}
+	m.sentAccountUnlockMails = append(m.sentAccountUnlockMails, e)
+	return nil
+}
+
+func (m *testMailer) SendTestMail(to string) error {
+	m.sentTestMails = append(m.sentTestMails, to)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost with the given
+// common name to dir and returns the paths of the certificate and key files.
+func writeTestCert(t testing.TB, dir, commonName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func getCertCommonName(t testing.TB, r *CertReloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("r.GetCertificate returned error: %v", err)
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader returned error: %v", err)
+	}
+	if cn := getCertCommonName(t, r); cn != "first" {
+		t.Errorf("Expected certificate common name to be %s, but it was %s", "first", cn)
+	}
+
+	writeTestCert(t, dir, "second")
+	err = r.Reload()
+	if err != nil {
+		t.Fatalf("r.Reload returned error: %v", err)
+	}
+	if cn := getCertCommonName(t, r); cn != "second" {
+		t.Errorf("Expected certificate common name to be %s, but it was %s", "second", cn)
+	}
+
+	err = os.Remove(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Reload()
+	if err == nil {
+		t.Error("Expected r.Reload with missing key to return error, but it did not")
+	}
+	if cn := getCertCommonName(t, r); cn != "second" {
+		t.Errorf("Expected failed reload to keep certificate %s, but it was %s", "second", cn)
+	}
+}
+
+func TestCertReloaderServesTLS(t *testing.T) {
+	t.Parallel()
+
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "localhost")
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader returned error: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("secure"))
+		}),
+		TLSConfig: &tls.Config{GetCertificate: r.GetCertificate},
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("client.Get returned error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		t.Fatal("Expected TLS connection, but there was none")
+	}
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "localhost" {
+		t.Errorf("Expected peer certificate common name to be %s, but it was %s", "localhost", cn)
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		httpsPort string
+		url       string
+		location  string
+	}{
+		{"443", "http://example.com/", "https://example.com/"},
+		{"443", "http://example.com:80/ws?x=1", "https://example.com/ws?x=1"},
+		{"8443", "http://example.com:8080/", "https://example.com:8443/"},
+	}
+
+	for i, tt := range tests {
+		handler := newHTTPSRedirectHandler(tt.httpsPort)
+		req := httptest.NewRequest("GET", tt.url, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%d. Expected status to be %d, but it was %d", i, http.StatusMovedPermanently, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != tt.location {
+			t.Errorf("%d. Expected Location to be %s, but it was %s", i, tt.location, location)
+		}
+	}
+}
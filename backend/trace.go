@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"time"
+)
+
+// RequestTrace records where the time handling a single request was spent.
+type RequestTrace struct {
+	ID       string
+	Start    time.Time
+	DBTime   time.Duration
+	DBCalls  int
+	SendTime time.Duration
+}
+
+// NewRequestTrace starts a trace with a random ID.
+func NewRequestTrace() *RequestTrace {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+
+	return &RequestTrace{
+		ID:    hex.EncodeToString(idBytes),
+		Start: time.Now(),
+	}
+}
+
+// TracedRepository wraps a Repository so each call is logged with the trace
+// ID and its duration is added to the trace's database time.
+type TracedRepository struct {
+	Repository
+	trace  *RequestTrace
+	logger log.Logger
+}
+
+func NewTracedRepository(repo Repository, trace *RequestTrace, logger log.Logger) *TracedRepository {
+	return &TracedRepository{Repository: repo, trace: trace, logger: logger}
+}
+
+func (r *TracedRepository) observe(method string, start time.Time) {
+	duration := time.Since(start)
+	r.trace.DBTime += duration
+	r.trace.DBCalls++
+	r.logger.Debug("Repository call", "repo_method", method, "duration", duration)
+}
+
+func (r *TracedRepository) GetUser(userID int32) (user User, err error) {
+	defer r.observe("GetUser", time.Now())
+	return r.Repository.GetUser(userID)
+}
+
+func (r *TracedRepository) GetUserByEmail(email string) (user User, err error) {
+	defer r.observe("GetUserByEmail", time.Now())
+	return r.Repository.GetUserByEmail(email)
+}
+
+func (r *TracedRepository) GetUsers() (users []User, err error) {
+	defer r.observe("GetUsers", time.Now())
+	return r.Repository.GetUsers()
+}
+
+func (r *TracedRepository) CreateUser(name, email, password string) (user User, err error) {
+	defer r.observe("CreateUser", time.Now())
+	return r.Repository.CreateUser(name, email, password)
+}
+
+func (r *TracedRepository) CreateVerifiedUser(name, email, password string) (user User, err error) {
+	defer r.observe("CreateVerifiedUser", time.Now())
+	return r.Repository.CreateVerifiedUser(name, email, password)
+}
+
+func (r *TracedRepository) Login(email, password string) (user User, err error) {
+	defer r.observe("Login", time.Now())
+	return r.Repository.Login(email, password)
+}
+
+func (r *TracedRepository) CheckPassword(userID int32, password string) (err error) {
+	defer r.observe("CheckPassword", time.Now())
+	return r.Repository.CheckPassword(userID, password)
+}
+
+func (r *TracedRepository) SetPassword(userID int32, password string) (err error) {
+	defer r.observe("SetPassword", time.Now())
+	return r.Repository.SetPassword(userID, password)
+}
+
+func (r *TracedRepository) DisableUser(userID int32) (err error) {
+	defer r.observe("DisableUser", time.Now())
+	return r.Repository.DisableUser(userID)
+}
+
+func (r *TracedRepository) SetName(userID int32, name string) (user User, err error) {
+	defer r.observe("SetName", time.Now())
+	return r.Repository.SetName(userID, name)
+}
+
+func (r *TracedRepository) CreatePasswordResetToken(email string, requestIP string) (token string, err error) {
+	defer r.observe("CreatePasswordResetToken", time.Now())
+	return r.Repository.CreatePasswordResetToken(email, requestIP)
+}
+
+func (r *TracedRepository) SetPasswordByToken(token, password string, completionIP string) (err error) {
+	defer r.observe("SetPasswordByToken", time.Now())
+	return r.Repository.SetPasswordByToken(token, password, completionIP)
+}
+
+func (r *TracedRepository) CreateEmailChangeToken(userID int32, email string, requestIP string) (token string, err error) {
+	defer r.observe("CreateEmailChangeToken", time.Now())
+	return r.Repository.CreateEmailChangeToken(userID, email, requestIP)
+}
+
+func (r *TracedRepository) SetEmailByToken(token string, completionIP string) (user User, err error) {
+	defer r.observe("SetEmailByToken", time.Now())
+	return r.Repository.SetEmailByToken(token, completionIP)
+}
+
+func (r *TracedRepository) CreateEmailVerificationToken(userID int32, requestIP string) (token string, err error) {
+	defer r.observe("CreateEmailVerificationToken", time.Now())
+	return r.Repository.CreateEmailVerificationToken(userID, requestIP)
+}
+
+func (r *TracedRepository) SetEmailVerifiedByToken(token string, completionIP string) (user User, err error) {
+	defer r.observe("SetEmailVerifiedByToken", time.Now())
+	return r.Repository.SetEmailVerifiedByToken(token, completionIP)
+}
+
+func (r *TracedRepository) SetEmailVerified(userID int32) (err error) {
+	defer r.observe("SetEmailVerified", time.Now())
+	return r.Repository.SetEmailVerified(userID)
+}
+
+func (r *TracedRepository) CreateAccountUnlockToken(userID int32, requestIP string) (token string, err error) {
+	defer r.observe("CreateAccountUnlockToken", time.Now())
+	return r.Repository.CreateAccountUnlockToken(userID, requestIP)
+}
+
+func (r *TracedRepository) UnlockAccountByToken(token string, completionIP string) (user User, err error) {
+	defer r.observe("UnlockAccountByToken", time.Now())
+	return r.Repository.UnlockAccountByToken(token, completionIP)
+}
+
+func (r *TracedRepository) UnlockAccount(userID int32) (err error) {
+	defer r.observe("UnlockAccount", time.Now())
+	return r.Repository.UnlockAccount(userID)
+}
+
+func (r *TracedRepository) GetLoginFailures() (failures []UserLoginFailures, err error) {
+	defer r.observe("GetLoginFailures", time.Now())
+	return r.Repository.GetLoginFailures()
+}
+
+func (r *TracedRepository) CreateSession(userID int32) (sessionID string, err error) {
+	defer r.observe("CreateSession", time.Now())
+	return r.Repository.CreateSession(userID)
+}
+
+func (r *TracedRepository) DeleteSession(sessionID string) (err error) {
+	defer r.observe("DeleteSession", time.Now())
+	return r.Repository.DeleteSession(sessionID)
+}
+
+func (r *TracedRepository) DeleteUserSessions(userID int32) (count int64, err error) {
+	defer r.observe("DeleteUserSessions", time.Now())
+	return r.Repository.DeleteUserSessions(userID)
+}
+
+func (r *TracedRepository) GetUserIDBySessionID(sessionID string) (userID int32, err error) {
+	defer r.observe("GetUserIDBySessionID", time.Now())
+	return r.Repository.GetUserIDBySessionID(sessionID)
+}
+
+func (r *TracedRepository) CreateChannel(name string, userID int32) (channelID int32, err error) {
+	defer r.observe("CreateChannel", time.Now())
+	return r.Repository.CreateChannel(name, userID)
+}
+
+func (r *TracedRepository) RenameChannel(channelID int32, name string) (err error) {
+	defer r.observe("RenameChannel", time.Now())
+	return r.Repository.RenameChannel(channelID, name)
+}
+
+func (r *TracedRepository) SetChannelTopic(channelID int32, topic, description string) (err error) {
+	defer r.observe("SetChannelTopic", time.Now())
+	return r.Repository.SetChannelTopic(channelID, topic, description)
+}
+
+func (r *TracedRepository) SetChannelOwner(channelID, ownerID int32) (err error) {
+	defer r.observe("SetChannelOwner", time.Now())
+	return r.Repository.SetChannelOwner(channelID, ownerID)
+}
+
+func (r *TracedRepository) GetChannel(channelID int32) (channel Channel, err error) {
+	defer r.observe("GetChannel", time.Now())
+	return r.Repository.GetChannel(channelID)
+}
+
+func (r *TracedRepository) GetChannels() (channels []Channel, err error) {
+	defer r.observe("GetChannels", time.Now())
+	return r.Repository.GetChannels()
+}
+
+func (r *TracedRepository) GetArchivedChannels() (channels []Channel, err error) {
+	defer r.observe("GetArchivedChannels", time.Now())
+	return r.Repository.GetArchivedChannels()
+}
+
+func (r *TracedRepository) ArchiveChannel(channelID int32) (err error) {
+	defer r.observe("ArchiveChannel", time.Now())
+	return r.Repository.ArchiveChannel(channelID)
+}
+
+func (r *TracedRepository) UnarchiveChannel(channelID int32) (err error) {
+	defer r.observe("UnarchiveChannel", time.Now())
+	return r.Repository.UnarchiveChannel(channelID)
+}
+
+func (r *TracedRepository) DeleteChannel(channelID int32) (err error) {
+	defer r.observe("DeleteChannel", time.Now())
+	return r.Repository.DeleteChannel(channelID)
+}
+
+func (r *TracedRepository) PinMessage(messageID int64, userID int32) (err error) {
+	defer r.observe("PinMessage", time.Now())
+	return r.Repository.PinMessage(messageID, userID)
+}
+
+func (r *TracedRepository) UnpinMessage(messageID int64) (err error) {
+	defer r.observe("UnpinMessage", time.Now())
+	return r.Repository.UnpinMessage(messageID)
+}
+
+func (r *TracedRepository) PostMessage(channelID int32, authorID int32, body, clientNonce string) (message Message, err error) {
+	defer r.observe("PostMessage", time.Now())
+	return r.Repository.PostMessage(channelID, authorID, body, clientNonce)
+}
+
+func (r *TracedRepository) GetMessage(messageID int64) (message Message, err error) {
+	defer r.observe("GetMessage", time.Now())
+	return r.Repository.GetMessage(messageID)
+}
+
+func (r *TracedRepository) GetMessages(channelID int32, beforeMessageID int32, maxCount int32) (messages []Message, err error) {
+	defer r.observe("GetMessages", time.Now())
+	return r.Repository.GetMessages(channelID, beforeMessageID, maxCount)
+}
+
+func (r *TracedRepository) GetInit(userID int32) (json []byte, err error) {
+	defer r.observe("GetInit", time.Now())
+	return r.Repository.GetInit(userID)
+}
+
+func (r *TracedRepository) GetLinkPreview(url string) (preview LinkPreview, err error) {
+	defer r.observe("GetLinkPreview", time.Now())
+	return r.Repository.GetLinkPreview(url)
+}
+
+func (r *TracedRepository) SaveLinkPreview(preview LinkPreview) (err error) {
+	defer r.observe("SaveLinkPreview", time.Now())
+	return r.Repository.SaveLinkPreview(preview)
+}
+
+func (r *TracedRepository) UnfurlMessage(unfurl MessageUnfurl) (err error) {
+	defer r.observe("UnfurlMessage", time.Now())
+	return r.Repository.UnfurlMessage(unfurl)
+}
+
+func (r *TracedRepository) GetEventsAfter(eventID int64, maxCount int32) (events []Event, err error) {
+	defer r.observe("GetEventsAfter", time.Now())
+	return r.Repository.GetEventsAfter(eventID, maxCount)
+}
+
+func (r *TracedRepository) GetEventRange() (firstID, lastID int64, err error) {
+	defer r.observe("GetEventRange", time.Now())
+	return r.Repository.GetEventRange()
+}
+
+func (r *TracedRepository) DeleteEventsBefore(t time.Time) (count int64, err error) {
+	defer r.observe("DeleteEventsBefore", time.Now())
+	return r.Repository.DeleteEventsBefore(t)
+}
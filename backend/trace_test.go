@@ -0,0 +1,48 @@
+package main
+
+import (
+	log "gopkg.in/inconshreveable/log15.v2"
+	"testing"
+	"time"
+)
+
+type slowInitRepository struct {
+	Repository
+	delay time.Duration
+}
+
+func (r slowInitRepository) GetInit(userID int32) ([]byte, error) {
+	time.Sleep(r.delay)
+	return []byte(`{}`), nil
+}
+
+func TestTracedRepository(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	trace := NewRequestTrace()
+	if len(trace.ID) != 16 {
+		t.Errorf("Expected trace ID to be 16 characters, but it was %q", trace.ID)
+	}
+
+	repo := NewTracedRepository(slowInitRepository{delay: 10 * time.Millisecond}, trace, logger)
+
+	for i := 0; i < 2; i++ {
+		json, err := repo.GetInit(1)
+		if err != nil {
+			t.Fatalf("GetInit returned error: %v", err)
+		}
+		if string(json) != `{}` {
+			t.Errorf("Expected GetInit to return %q, but it was %q", `{}`, json)
+		}
+	}
+
+	if trace.DBCalls != 2 {
+		t.Errorf("Expected DBCalls to be 2, but it was %d", trace.DBCalls)
+	}
+	if trace.DBTime < 20*time.Millisecond {
+		t.Errorf("Expected DBTime to be at least 20ms, but it was %v", trace.DBTime)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const maxUnfurlsPerMessage = 3
+
+var ErrPrivateAddress = errors.New("refusing to connect to private address")
+
+// cgnatNetwork is the shared address space of carrier-grade NAT (RFC 6598).
+// net.IP.IsPrivate does not include it.
+var cgnatNetwork = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Unfurler fetches link previews for URLs in posted messages. It listens to
+// the message posted signal and does all network access in a background
+// worker so posting is never delayed.
+type Unfurler struct {
+	repo   Repository
+	logger log.Logger
+	client *http.Client
+
+	// MaxBytes is the maximum number of bytes of a page that will be read.
+	MaxBytes int64
+
+	// FailureTTL is how long a failed fetch is remembered. The URL is not
+	// fetched again until then.
+	FailureTTL time.Duration
+
+	failuresMutex sync.Mutex
+	failures      map[string]fetchFailure
+
+	messagePostedChan chan Message
+	queue             chan Message
+	done              chan struct{}
+}
+
+func NewUnfurler(repo Repository, timeout time.Duration, maxBytes int64, allowPrivateAddresses bool, logger log.Logger) *Unfurler {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivateAddresses {
+		dialer.Control = rejectPrivateAddress
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+
+	return &Unfurler{
+		repo:       repo,
+		logger:     logger,
+		client:     client,
+		MaxBytes:   maxBytes,
+		FailureTTL: 10 * time.Minute,
+		failures:   make(map[string]fetchFailure),
+	}
+}
+
+type fetchFailure struct {
+	err     error
+	expires time.Time
+}
+
+// Start begins listening for posted messages and unfurling them.
+func (u *Unfurler) Start() {
+	u.messagePostedChan = make(chan Message)
+	u.queue = make(chan Message, 64)
+	u.done = make(chan struct{})
+
+	u.repo.MessagePostedSignal().Add(u.messagePostedChan)
+
+	queue := u.queue
+	metrics.GaugeFunc("jchat_unfurl_queue_depth", func() float64 { return float64(len(queue)) })
+
+	go u.enqueue()
+	go u.work()
+}
+
+// Stop stops listening for posted messages. Queued messages are discarded.
+func (u *Unfurler) Stop() {
+	u.repo.MessagePostedSignal().Remove(u.messagePostedChan)
+	close(u.done)
+}
+
+func (u *Unfurler) enqueue() {
+	for {
+		select {
+		case message := <-u.messagePostedChan:
+			select {
+			case u.queue <- message:
+			default:
+				u.logger.Warn("Unfurl queue full -- skipping message", "messageID", message.ID)
+			}
+		case <-u.done:
+			return
+		}
+	}
+}
+
+func (u *Unfurler) work() {
+	for {
+		select {
+		case message := <-u.queue:
+			u.UnfurlMessage(message)
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// UnfurlMessage fetches or loads from cache the previews for all links in
+// message and attaches them to it.
+func (u *Unfurler) UnfurlMessage(message Message) {
+	urls := ExtractURLs(message.Body)
+	if len(urls) == 0 {
+		return
+	}
+	if len(urls) > maxUnfurlsPerMessage {
+		urls = urls[:maxUnfurlsPerMessage]
+	}
+
+	unfurl := MessageUnfurl{MessageID: message.ID, ChannelID: message.ChannelID}
+
+	for _, url := range urls {
+		preview, err := u.repo.GetLinkPreview(url)
+		if err == ErrNotFound {
+			preview, err = u.FetchLinkPreview(url)
+			if err != nil {
+				u.logger.Info("Unable to fetch link preview", "url", url, "error", err)
+				continue
+			}
+
+			err = u.repo.SaveLinkPreview(preview)
+			if err != nil {
+				u.logger.Error("Unable to save link preview", "url", url, "error", err)
+				continue
+			}
+		} else if err != nil {
+			u.logger.Error("Unable to get link preview", "url", url, "error", err)
+			continue
+		}
+
+		if preview.Title == "" && preview.Description == "" {
+			continue
+		}
+
+		unfurl.Previews = append(unfurl.Previews, preview)
+	}
+
+	if len(unfurl.Previews) == 0 {
+		return
+	}
+
+	err := u.repo.UnfurlMessage(unfurl)
+	if err != nil {
+		u.logger.Error("Unable to unfurl message", "messageID", message.ID, "error", err)
+	}
+}
+
+// FetchLinkPreview downloads url and extracts its OpenGraph metadata or
+// title. At most MaxBytes of the response body are read. If fetching url
+// failed within FailureTTL that error is returned without fetching it again.
+func (u *Unfurler) FetchLinkPreview(url string) (LinkPreview, error) {
+	if err := u.recentFailure(url); err != nil {
+		return LinkPreview{URL: url}, err
+	}
+
+	preview, err := u.fetchLinkPreview(url)
+	if err != nil {
+		u.recordFailure(url, err)
+	}
+	return preview, err
+}
+
+func (u *Unfurler) recentFailure(url string) error {
+	u.failuresMutex.Lock()
+	defer u.failuresMutex.Unlock()
+
+	failure, ok := u.failures[url]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(failure.expires) {
+		delete(u.failures, url)
+		return nil
+	}
+	return failure.err
+}
+
+func (u *Unfurler) recordFailure(url string, err error) {
+	u.failuresMutex.Lock()
+	defer u.failuresMutex.Unlock()
+
+	now := time.Now()
+	for url, failure := range u.failures {
+		if now.After(failure.expires) {
+			delete(u.failures, url)
+		}
+	}
+
+	u.failures[url] = fetchFailure{err: err, expires: now.Add(u.FailureTTL)}
+}
+
+func (u *Unfurler) fetchLinkPreview(url string) (LinkPreview, error) {
+	preview := LinkPreview{URL: url}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("User-Agent", "JChat/"+version+" (link preview)")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return preview, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return preview, fmt.Errorf("unsupported content type: %s", mediaType)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, u.MaxBytes))
+	if err != nil {
+		return preview, err
+	}
+
+	parseLinkPreview(&preview, string(body))
+
+	return preview, nil
+}
+
+var (
+	htmlTitleRegexp     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	htmlMetaRegexp      = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	htmlAttributeRegexp = regexp.MustCompile(`(?is)([a-z][a-z0-9:_-]*)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+func parseLinkPreview(preview *LinkPreview, body string) {
+	for _, tag := range htmlMetaRegexp.FindAllString(body, -1) {
+		attrs := make(map[string]string)
+		for _, m := range htmlAttributeRegexp.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3])
+		}
+
+		name := attrs["property"]
+		if name == "" {
+			name = attrs["name"]
+		}
+		content := strings.TrimSpace(attrs["content"])
+
+		switch strings.ToLower(name) {
+		case "og:title":
+			preview.Title = content
+		case "og:description":
+			preview.Description = content
+		case "description":
+			if preview.Description == "" {
+				preview.Description = content
+			}
+		case "og:image":
+			if href, ok := sanitizeURL(content); ok {
+				preview.ImageURL = href
+			}
+		case "og:site_name":
+			preview.SiteName = content
+		}
+	}
+
+	if preview.Title == "" {
+		if m := htmlTitleRegexp.FindStringSubmatch(body); m != nil {
+			preview.Title = strings.Join(strings.Fields(html.UnescapeString(m[1])), " ")
+		}
+	}
+
+	preview.Title = truncateString(preview.Title, 200)
+	preview.Description = truncateString(preview.Description, 500)
+	preview.SiteName = truncateString(preview.SiteName, 100)
+}
+
+func truncateString(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max])
+}
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// ExtractURLs returns the unique http and https URLs in body in the order
+// they first appear.
+func ExtractURLs(body string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+
+	for _, match := range urlRegexp.FindAllString(body, -1) {
+		match = strings.TrimRight(match, ".,;:!?)]")
+		url, ok := sanitizeURL(match)
+		if !ok || seen[url] {
+			continue
+		}
+		seen[url] = true
+		urls = append(urls, url)
+	}
+
+	return urls
+}
+
+func rejectPrivateAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || cgnatNetwork.Contains(ip) {
+		return ErrPrivateAddress
+	}
+
+	return nil
+}
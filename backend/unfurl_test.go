@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	log "gopkg.in/inconshreveable/log15.v2"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getTestUnfurler(repo Repository, timeout time.Duration, maxBytes int64) *Unfurler {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	return NewUnfurler(repo, timeout, maxBytes, true, logger)
+}
+
+func TestExtractURLs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		body string
+		urls []string
+	}{
+		{"no links here", nil},
+		{"see http://example.com.", []string{"http://example.com"}},
+		{"[docs](https://example.com/docs) and https://example.com/docs", []string{"https://example.com/docs"}},
+		{"a http://a.example.com b https://b.example.com/x?y=1", []string{"http://a.example.com", "https://b.example.com/x?y=1"}},
+		{"ftp://example.com javascript:alert(1)", nil},
+	}
+
+	for i, tt := range tests {
+		urls := ExtractURLs(tt.body)
+		if !reflect.DeepEqual(urls, tt.urls) {
+			t.Errorf("%d. Expected ExtractURLs(%q) to return %v, but it was %v", i, tt.body, tt.urls, urls)
+		}
+	}
+}
+
+func TestUnfurlerFetchLinkPreview(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head>
+<title>Fallback Title</title>
+<meta property="og:title" content="Jack &amp; Friends">
+<meta property='og:description' content='A chat about &lt;things&gt;'>
+<meta property="og:image" content="javascript:alert(1)">
+<meta property="og:site_name" content="Example">
+</head><body></body></html>`)
+	}))
+	defer server.Close()
+
+	unfurler := getTestUnfurler(nil, time.Second, 64*1024)
+	preview, err := unfurler.FetchLinkPreview(server.URL)
+	if err != nil {
+		t.Fatalf("unfurler.FetchLinkPreview returned error: %v", err)
+	}
+
+	expected := LinkPreview{
+		URL:         server.URL,
+		Title:       "Jack & Friends",
+		Description: "A chat about <things>",
+		SiteName:    "Example",
+	}
+	if preview != expected {
+		t.Errorf("Expected preview to be %v, but it was %v", expected, preview)
+	}
+}
+
+func TestUnfurlerFetchLinkPreviewTitleFallback(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head><title>\n  Just a\n  Title </title></head></html>")
+	}))
+	defer server.Close()
+
+	unfurler := getTestUnfurler(nil, time.Second, 64*1024)
+	preview, err := unfurler.FetchLinkPreview(server.URL)
+	if err != nil {
+		t.Fatalf("unfurler.FetchLinkPreview returned error: %v", err)
+	}
+	if preview.Title != "Just a Title" {
+		t.Errorf("Expected preview.Title to be %q, but it was %q", "Just a Title", preview.Title)
+	}
+}
+
+func TestUnfurlerFetchLinkPreviewSizeLimit(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head>")
+		fmt.Fprint(w, strings.Repeat(" ", 4096))
+		fmt.Fprint(w, "<title>Too far</title></head></html>")
+	}))
+	defer server.Close()
+
+	unfurler := getTestUnfurler(nil, time.Second, 1024)
+	preview, err := unfurler.FetchLinkPreview(server.URL)
+	if err != nil {
+		t.Fatalf("unfurler.FetchLinkPreview returned error: %v", err)
+	}
+	if preview.Title != "" {
+		t.Errorf("Expected preview.Title to be empty when beyond MaxBytes, but it was %q", preview.Title)
+	}
+}
+
+func TestUnfurlerFetchLinkPreviewTimeout(t *testing.T) {
+	t.Parallel()
+
+	finished := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(finished)
+
+	unfurler := getTestUnfurler(nil, 50*time.Millisecond, 1024)
+	_, err := unfurler.FetchLinkPreview(server.URL)
+	if err == nil {
+		t.Fatal("Expected unfurler.FetchLinkPreview to time out, but it did not")
+	}
+}
+
+func TestUnfurlerFetchLinkPreviewRejectsNonHTML(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "<title>Not really</title>")
+	}))
+	defer server.Close()
+
+	unfurler := getTestUnfurler(nil, time.Second, 1024)
+	_, err := unfurler.FetchLinkPreview(server.URL)
+	if err == nil {
+		t.Fatal("Expected unfurler.FetchLinkPreview to reject non-HTML content, but it did not")
+	}
+}
+
+func TestUnfurlerRejectsPrivateAddresses(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>Internal</title>")
+	}))
+	defer server.Close()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	unfurler := NewUnfurler(nil, time.Second, 1024, false, logger)
+
+	_, err := unfurler.FetchLinkPreview(server.URL)
+	if err == nil || !strings.Contains(err.Error(), ErrPrivateAddress.Error()) {
+		t.Fatalf("Expected unfurler.FetchLinkPreview to return %v, but it was %v", ErrPrivateAddress, err)
+	}
+}
+
+func TestRejectPrivateAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		address string
+		err     error
+	}{
+		{"93.184.216.34:80", nil},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", nil},
+		{"127.0.0.1:80", ErrPrivateAddress},
+		{"[::1]:80", ErrPrivateAddress},
+		{"10.1.2.3:80", ErrPrivateAddress},
+		{"172.16.0.1:80", ErrPrivateAddress},
+		{"192.168.1.1:80", ErrPrivateAddress},
+		{"169.254.169.254:80", ErrPrivateAddress},
+		{"0.0.0.0:80", ErrPrivateAddress},
+		{"[fd00::1]:80", ErrPrivateAddress},
+		{"100.64.0.1:80", ErrPrivateAddress},
+		{"100.127.255.254:80", ErrPrivateAddress},
+		{"100.63.255.255:80", nil},
+		{"100.128.0.1:80", nil},
+	}
+
+	for _, tt := range tests {
+		err := rejectPrivateAddress("tcp", tt.address, nil)
+		if err != tt.err {
+			t.Errorf("rejectPrivateAddress(%q): expected %v, but it was %v", tt.address, tt.err, err)
+		}
+	}
+}
+
+func TestUnfurlerFetchLinkPreviewCachesFailures(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	unfurler := getTestUnfurler(nil, time.Second, 1024)
+	unfurler.FailureTTL = 50 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		_, err := unfurler.FetchLinkPreview(server.URL)
+		if err == nil {
+			t.Fatal("Expected unfurler.FetchLinkPreview to return an error, but it did not")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected failed URL to be requested %d time, but it was %d", 1, n)
+	}
+
+	time.Sleep(2 * unfurler.FailureTTL)
+
+	unfurler.FetchLinkPreview(server.URL)
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected failed URL to be requested again after FailureTTL, but it was requested %d times", n)
+	}
+}
+
+func TestUnfurlerUnfurlsPostedMessages(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("test", "test@example.com", "secret")
+	if err != nil {
+		t.Fatalf("repo.CreateUser unexpectedly failed: %v", err)
+	}
+
+	channelID, err := repo.CreateChannel("General", user.ID)
+	if err != nil {
+		t.Fatalf("repo.CreateChannel unexpectedly failed: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<meta property="og:title" content="Linked Page">`)
+	}))
+	defer server.Close()
+
+	unfurler := getTestUnfurler(repo, time.Second, 1024)
+	unfurler.Start()
+	defer unfurler.Stop()
+
+	c := make(chan MessageUnfurl)
+	repo.MessageUnfurledSignal().Add(c)
+	defer repo.MessageUnfurledSignal().Remove(c)
+
+	message, err := repo.PostMessage(channelID, user.ID, "check out "+server.URL, "")
+	if err != nil {
+		t.Fatalf("repo.PostMessage returned error: %v", err)
+	}
+
+	var unfurl MessageUnfurl
+	select {
+	case unfurl = <-c:
+	case <-time.After(time.Second):
+		t.Fatal("Never received message unfurl")
+	}
+
+	if unfurl.MessageID != message.ID {
+		t.Errorf("Expected unfurl.MessageID to be %v, but it was %v", message.ID, unfurl.MessageID)
+	}
+	if unfurl.ChannelID != channelID {
+		t.Errorf("Expected unfurl.ChannelID to be %v, but it was %v", channelID, unfurl.ChannelID)
+	}
+	if len(unfurl.Previews) != 1 || unfurl.Previews[0].Title != "Linked Page" {
+		t.Fatalf("Expected unfurl.Previews to contain preview titled %q, but it was %v", "Linked Page", unfurl.Previews)
+	}
+
+	preview, err := repo.GetLinkPreview(server.URL)
+	if err != nil {
+		t.Fatalf("repo.GetLinkPreview returned error: %v", err)
+	}
+	if preview != unfurl.Previews[0] {
+		t.Errorf("Expected cached preview to be %v, but it was %v", unfurl.Previews[0], preview)
+	}
+}
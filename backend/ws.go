@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
 	"golang.org/x/net/websocket"
 	log "gopkg.in/inconshreveable/log15.v2"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// lastConnID is incremented atomically to give each client connection an ID
+// for log context.
+var lastConnID uint64
+
 type ClientConn struct {
 	ws     *websocket.Conn
 	user   User
@@ -15,22 +25,86 @@ type ClientConn struct {
 	logger log.Logger
 	mailer Mailer
 
-	channelCreatedChan chan Channel
-	channelRenamedChan chan Channel
-	messagePostedChan  chan Message
-	userCreatedChan    chan User
+	// rateLimiter limits how often expensive or abusable methods can be
+	// called. It is nil if rate limiting is disabled.
+	rateLimiter *RateLimiter
+
+	// methods are the methods clients can call. nil uses defaultMethods.
+	methods *MethodRegistry
+
+	// maxConcurrentRequests limits how many requests are handled at the same
+	// time. Zero uses defaultMaxConcurrentRequests.
+	maxConcurrentRequests int
+
+	// shared is created by Dispatch. conn.user is only meaningful in the
+	// copies of conn that handle requests. The current user is in shared.
+	shared *connShared
+
+	eventChan chan Event
+
+	// shuttingDown is closed when the server begins shutting down.
+	shuttingDown   <-chan struct{}
+	reconnectAfter time.Duration
+
+	// slowRequestThreshold is the duration after which a request is logged
+	// as slow. Zero disables slow request logging.
+	slowRequestThreshold time.Duration
+
+	// pingInterval is how often the client is sent a ping notification. The
+	// connection is closed if nothing is received for idleTimeout or a
+	// message cannot be sent within writeTimeout. Zero disables each.
+	pingInterval time.Duration
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// trustedProxies are the reverse proxies whose X-Forwarded-For header is
+	// used to find the client's IP address.
+	trustedProxies TrustedProxies
 }
 
+// Request is a JSON-RPC 2.0 request. ID is nil for notifications, which do
+// not get a response. JSONRPC may be omitted by older clients.
 type Request struct {
-	Method string          `json:"method"`
-	Params json.RawMessage `json:"params"`
-	ID     *json.Number    `json:"id,omitempty"`
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
 }
 
+// Response is a JSON-RPC 2.0 response. It is marshalled with a result member
+// unless Error is set and with a null id if ID is not set.
 type Response struct {
-	Result interface{} `json:"result,omitempty"`
-	Error  *Error      `json:"error,omitempty"`
-	ID     json.Number `json:"id"`
+	Result interface{}
+	Error  *Error
+	ID     json.RawMessage
+}
+
+func (r Response) MarshalJSON() ([]byte, error) {
+	id := r.ID
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+
+	if r.Error != nil {
+		return json.Marshal(struct {
+			JSONRPC string          `json:"jsonrpc"`
+			Error   *Error          `json:"error"`
+			ID      json.RawMessage `json:"id"`
+		}{"2.0", r.Error, id})
+	}
+
+	return json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		ID      json.RawMessage `json:"id"`
+	}{"2.0", r.Result, id})
+}
+
+// Notification is a JSON-RPC 2.0 notification sent from the server.
+type Notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
 }
 
 type Error struct {
@@ -39,9 +113,45 @@ type Error struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
+// LoginSuccess starts a session. LastEventID is the last event the client
+// has been sent. If Resync is set the client missed events that can no
+// longer be replayed and must reload everything.
 type LoginSuccess struct {
-	UserID    int32  `json:"userID"`
-	SessionID string `json:"sessionID"`
+	UserID        int32  `json:"userID"`
+	SessionID     string `json:"sessionID"`
+	EmailVerified bool   `json:"emailVerified"`
+	LastEventID   int64  `json:"lastEventID"`
+	Resync        bool   `json:"resync,omitempty"`
+}
+
+type Registration struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (r *Registration) validate() *Error {
+	if r.Name == "" {
+		return errorWithData(JSONRPCInvalidParams, `Request must include the attribute "name"`)
+	}
+
+	if len(r.Name) > 30 {
+		return errorWithData(JSONRPCInvalidParams, `"name" must be less than 30 characters`)
+	}
+
+	if err := ValidateEmail(r.Email); err != nil {
+		return errorWithData(JSONRPCInvalidParams, err.Error())
+	}
+
+	if err := ValidatePassword(r.Password); err != nil {
+		return errorWithData(JSONRPCInvalidPasswordError, err.Error())
+	}
+
+	return nil
+}
+
+func (r *Registration) rateLimitEmail() string {
+	return r.Email
 }
 
 type RequestCredentials struct {
@@ -49,6 +159,119 @@ type RequestCredentials struct {
 	Password string `json:"password"`
 }
 
+func (c *RequestCredentials) validate() *Error {
+	if c.Email == "" {
+		return errorWithData(JSONRPCInvalidParams, `Request must include the attribute "email"`)
+	}
+
+	if c.Password == "" {
+		return errorWithData(JSONRPCInvalidParams, `Request must include the attribute "password"`)
+	}
+
+	return nil
+}
+
+func (c *RequestCredentials) rateLimitEmail() string {
+	return c.Email
+}
+
+// ResumeSession resumes a session on a new connection. If LastEventID is set
+// the events after it are replayed.
+type ResumeSession struct {
+	SessionID   string `json:"session_id"`
+	LastEventID *int64 `json:"last_event_id"`
+}
+
+func (s *ResumeSession) validate() *Error {
+	if s.SessionID == "" {
+		return errorWithData(JSONRPCInvalidParams, `Request must include the attribute "session_id"`)
+	}
+	return nil
+}
+
+// EmailToken is the params of methods that redeem a token sent by email.
+type EmailToken struct {
+	Token string `json:"token"`
+}
+
+type RequestPasswordReset struct {
+	Email string `json:"email"`
+}
+
+func (r *RequestPasswordReset) validate() *Error {
+	if r.Email == "" {
+		return errorWithData(JSONRPCInvalidParams, `Request must include the attribute "email"`)
+	}
+	return nil
+}
+
+func (r *RequestPasswordReset) rateLimitEmail() string {
+	return r.Email
+}
+
+type ResetPassword struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func (c *ChangePassword) validate() *Error {
+	if err := ValidatePassword(c.NewPassword); err != nil {
+		return errorWithData(JSONRPCInvalidPasswordError, err.Error())
+	}
+	return nil
+}
+
+type UpdateProfile struct {
+	Name string `json:"name"`
+}
+
+func (p *UpdateProfile) validate() *Error {
+	if p.Name == "" {
+		return errorWithData(JSONRPCInvalidParams, `Request must include the attribute "name"`)
+	}
+
+	if len(p.Name) > 30 {
+		return errorWithData(JSONRPCInvalidParams, `"name" must be less than 30 characters`)
+	}
+
+	return nil
+}
+
+type ChangeEmail struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (c *ChangeEmail) validate() *Error {
+	if err := ValidateEmail(c.Email); err != nil {
+		return errorWithData(JSONRPCInvalidParams, err.Error())
+	}
+	return nil
+}
+
+// PostMessage may include a client_nonce chosen by the client so that
+// retrying a post whose response was lost returns the original message.
+type PostMessage struct {
+	ChannelID   int32  `json:"channel_id"`
+	Text        string `json:"text"`
+	ClientNonce string `json:"client_nonce"`
+}
+
+func (m *PostMessage) validate() *Error {
+	if len(m.Text) > 10000 {
+		return errorWithData(JSONRPCInvalidParams, `"text" must be at most 10000 characters`)
+	}
+	if len(m.ClientNonce) > 64 {
+		return errorWithData(JSONRPCInvalidParams, `"client_nonce" must be at most 64 characters`)
+	}
+	return nil
+}
+
 type CreateChannel struct {
 	Name string `json:"name"`
 }
@@ -58,6 +281,30 @@ type RenameChannel struct {
 	Name string `json:"name"`
 }
 
+type SetChannelTopic struct {
+	ID          int32  `json:"id"`
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+}
+
+func (t *SetChannelTopic) validate() *Error {
+	if len(t.Topic) > 250 {
+		return errorWithData(JSONRPCInvalidParams, `"topic" must be at most 250 characters`)
+	}
+	if len(t.Description) > 2000 {
+		return errorWithData(JSONRPCInvalidParams, `"description" must be at most 2000 characters`)
+	}
+	return nil
+}
+
+type ChannelID struct {
+	ID int32 `json:"id"`
+}
+
+type PinMessage struct {
+	MessageID int64 `json:"message_id"`
+}
+
 // Standardized JSON-RPC errors
 var JSONRPCParseError = Error{Code: -32700, Message: "Parse error"}
 var JSONRPCInvalidRequest = Error{Code: -32600, Message: "Invalid Request"}
@@ -70,6 +317,12 @@ var JSONRPCAunthenticationError = Error{Code: 4001, Message: "Authentication err
 var JSONRPCDuplicationError = Error{Code: 4002, Message: "Duplicate"}
 var JSONRPCInvalidPasswordError = Error{Code: 4003, Message: "Invalid password"}
 var JSONRPCUnauthenticatedError = Error{Code: 4004, Message: "Unauthenticated error"}
+var JSONRPCNotFoundError = Error{Code: 4005, Message: "Not found"}
+var JSONRPCChannelArchivedError = Error{Code: 4006, Message: "Channel archived"}
+var JSONRPCForbiddenError = Error{Code: 4007, Message: "Forbidden"}
+var JSONRPCEmailNotVerifiedError = Error{Code: 4008, Message: "Email not verified"}
+var JSONRPCRateLimitedError = Error{Code: 4009, Message: "Rate limited"}
+var JSONRPCAccountLockedError = Error{Code: 4010, Message: "Account locked"}
 
 // Custom JSON-RPC errors 5000-5999
 // Server errors -- roughly correspond to HTTP 500-599 type errors
@@ -81,413 +334,1351 @@ func errorWithData(errTemplate Error, data interface{}) *Error {
 	return &errTemplate
 }
 
+// defaultMethods are the methods available to every client connection.
+var defaultMethods = newDefaultMethods()
+
+func newDefaultMethods() *MethodRegistry {
+	r := NewMethodRegistry()
+	r.Use(TraceRequests, CountRequests, RecoverPanics, RequireAuth, DecodeParams, LimitRate)
+
+	r.Register("register", Method{
+		Params:    func() interface{} { return &Registration{} },
+		Exclusive: true,
+		SendsMail: true,
+		Func:      (*ClientConn).Register,
+	})
+	r.Register("login", Method{
+		Params:    func() interface{} { return &RequestCredentials{} },
+		Exclusive: true,
+		SendsMail: true,
+		Func:      (*ClientConn).Login,
+	})
+	r.Register("resume_session", Method{
+		Params:    func() interface{} { return &ResumeSession{} },
+		Exclusive: true,
+		Func:      (*ClientConn).ResumeSession,
+	})
+	r.Register("ping", Method{
+		Func: (*ClientConn).Ping,
+	})
+	r.Register("logout", Method{
+		Exclusive: true,
+		Func:      (*ClientConn).Logout,
+	})
+	r.Register("request_password_reset", Method{
+		Params:    func() interface{} { return &RequestPasswordReset{} },
+		SendsMail: true,
+		Func:      (*ClientConn).RequestPasswordReset,
+	})
+	r.Register("reset_password", Method{
+		Params: func() interface{} { return &ResetPassword{} },
+		Func:   (*ClientConn).ResetPassword,
+	})
+	r.Register("verify_email", Method{
+		Params:    func() interface{} { return &EmailToken{} },
+		Exclusive: true,
+		Func:      (*ClientConn).VerifyEmail,
+	})
+	r.Register("resend_verification_email", Method{
+		RequireAuth: true,
+		SendsMail:   true,
+		Func:        (*ClientConn).ResendVerificationEmail,
+	})
+	r.Register("unlock_account", Method{
+		Params: func() interface{} { return &EmailToken{} },
+		Func:   (*ClientConn).UnlockAccount,
+	})
+	r.Register("confirm_email_change", Method{
+		Params:    func() interface{} { return &EmailToken{} },
+		Exclusive: true,
+		Func:      (*ClientConn).ConfirmEmailChange,
+	})
+	r.Register("change_password", Method{
+		Params:      func() interface{} { return &ChangePassword{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).ChangePassword,
+	})
+	r.Register("update_profile", Method{
+		Params:      func() interface{} { return &UpdateProfile{} },
+		RequireAuth: true,
+		Exclusive:   true,
+		Func:        (*ClientConn).UpdateProfile,
+	})
+	r.Register("change_email", Method{
+		Params:      func() interface{} { return &ChangeEmail{} },
+		RequireAuth: true,
+		SendsMail:   true,
+		Func:        (*ClientConn).ChangeEmail,
+	})
+
+	r.Register("init_chat", Method{
+		RequireAuth: true,
+		Func:        (*ClientConn).InitChat,
+	})
+	r.Register("post_message", Method{
+		Params:               func() interface{} { return &PostMessage{} },
+		RequireAuth:          true,
+		RequireVerifiedEmail: true,
+		Func:                 (*ClientConn).PostMessage,
+	})
+	r.Register("create_channel", Method{
+		Params:               func() interface{} { return &CreateChannel{} },
+		RequireAuth:          true,
+		RequireVerifiedEmail: true,
+		Func:                 (*ClientConn).CreateChannel,
+	})
+	r.Register("rename_channel", Method{
+		Params:      func() interface{} { return &RenameChannel{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).RenameChannel,
+	})
+	r.Register("set_channel_topic", Method{
+		Params:      func() interface{} { return &SetChannelTopic{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).SetChannelTopic,
+	})
+	r.Register("archive_channel", Method{
+		Params:      func() interface{} { return &ChannelID{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).ArchiveChannel,
+	})
+	r.Register("unarchive_channel", Method{
+		Params:      func() interface{} { return &ChannelID{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).UnarchiveChannel,
+	})
+	r.Register("delete_channel", Method{
+		Params:      func() interface{} { return &ChannelID{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).DeleteChannel,
+	})
+	r.Register("pin_message", Method{
+		Params:      func() interface{} { return &PinMessage{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).PinMessage,
+	})
+	r.Register("unpin_message", Method{
+		Params:      func() interface{} { return &PinMessage{} },
+		RequireAuth: true,
+		Func:        (*ClientConn).UnpinMessage,
+	})
+
+	return r
+}
+
 func (conn *ClientConn) Dispatch() {
-	defer conn.removeRepositoryListeners()
+	conn.shared = newConnShared(conn.maxConcurrentRequests)
+	conn.makeNotificationChans()
+
+	conn.logger = conn.logger.New(
+		"conn_id", atomic.AddUint64(&lastConnID, 1),
+		"remote_addr", conn.ws.Request().RemoteAddr,
+		"user_id", log.Lazy{Fn: func() int32 { return conn.shared.getUser().ID }},
+	)
+	conn.logger.Debug("Client connected")
+
+	metrics.Inc("jchat_websocket_connections")
+	defer metrics.Dec("jchat_websocket_connections")
+
+	queuedEvents := make(chan Event, maxQueuedEvents)
+	eventsOverflowed := make(chan struct{}, 1)
+	stopQueueingEvents := make(chan struct{})
+	go conn.queueEvents(queuedEvents, eventsOverflowed, stopQueueingEvents)
+
+	writeErrChan := make(chan error, 1)
+	writerDone := make(chan struct{})
+	go conn.write(writeErrChan, writerDone)
+	defer func() {
+		conn.stopRequests()
+		close(stopQueueingEvents)
+		close(conn.shared.outgoing)
+		<-writerDone
+	}()
 
-	reqChan := make(chan Request)
-	errChan := make(chan error)
+	readErrChan := make(chan error, 1)
+	go conn.read(readErrChan)
 
-	go func() {
-		var req Request
+	var pingChan <-chan time.Time
+	if conn.pingInterval > 0 {
+		pingTicker := time.NewTicker(conn.pingInterval)
+		defer pingTicker.Stop()
+		pingChan = pingTicker.C
+	}
+
+	for {
+		select {
+		case <-conn.shuttingDown:
+			// Finish any request that has already been received so it is not
+			// lost, then tell the client to reconnect elsewhere.
+			conn.stopRequests()
+
+			var msg struct {
+				ReconnectAfter int64 `json:"reconnect_after_ms"`
+			}
 
-		for {
-			err := websocket.JSON.Receive(conn.ws, &req)
-			if err != nil {
-				errChan <- err
+			msg.ReconnectAfter = int64(conn.reconnectAfter / time.Millisecond)
+
+			conn.sendNotification("server_shutting_down", msg)
+			return
+		case event := <-queuedEvents:
+			if conn.disabledBy(event) {
+				conn.logger.Info("Closing connection of disabled user")
 				return
 			}
+			conn.sendEvent(event)
+		case <-eventsOverflowed:
+			// The client reconnects and is sent what it missed
+			metrics.Inc("jchat_websocket_event_overflows_total")
+			conn.logger.Info("Closing connection that fell behind on notifications", "max_queued_events", maxQueuedEvents)
+			return
+		case <-pingChan:
+			// The client answers by calling ping, which keeps the connection
+			// from timing out
+			conn.sendNotification("ping", struct{}{})
+		case err := <-writeErrChan:
+			if isTimeout(err) {
+				metrics.Inc("jchat_websocket_timeouts_total", "direction", "write")
+				conn.logger.Info("Closing connection that stopped accepting messages", "write_timeout", conn.writeTimeout)
+			} else {
+				conn.logger.Info("Unable to send message", "error", err)
+			}
+			return
+		case err := <-readErrChan:
+			switch {
+			case err == io.EOF:
+				conn.logger.Debug("Client disconnected")
+			case isTimeout(err):
+				metrics.Inc("jchat_websocket_timeouts_total", "direction", "read")
+				conn.logger.Info("Closing idle connection", "idle_timeout", conn.idleTimeout)
+			default:
+				conn.logger.Info("Unable to receive request", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// defaultMaxConcurrentRequests is used when a ClientConn does not set
+// maxConcurrentRequests.
+const defaultMaxConcurrentRequests = 4
+
+// connShared is the state of a connection that is shared by the copies of
+// ClientConn that handle its requests concurrently.
+type connShared struct {
+	mutex     sync.Mutex
+	user      User
+	listening bool
+	closing   bool
+
+	// eventMutex orders replayed events before live ones. Live events up to
+	// skipEventsThrough are not sent because the client already has them.
+	eventMutex        sync.Mutex
+	skipEventsThrough int64
+
+	// sessionLock is held for writing by exclusive methods so they run alone
+	// and in the order they were received and for reading by other requests.
+	sessionLock sync.RWMutex
+	slots       chan struct{}
+	inFlight    sync.WaitGroup
+
+	// outgoing is sent to the websocket by the writer goroutine.
+	outgoing chan outgoingMessage
+}
+
+func newConnShared(maxConcurrentRequests int) *connShared {
+	if maxConcurrentRequests < 1 {
+		maxConcurrentRequests = defaultMaxConcurrentRequests
+	}
+
+	return &connShared{
+		slots:    make(chan struct{}, maxConcurrentRequests),
+		outgoing: make(chan outgoingMessage),
+	}
+}
+
+func (s *connShared) getUser() User {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.user
+}
+
+func (s *connShared) setUser(user User) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.user = user
+}
+
+// outgoingMessage is a message for the writer goroutine to send. handled are
+// the requests answered by the message, which are logged once it is sent.
+type outgoingMessage struct {
+	v       interface{}
+	handled []handledRequest
+}
+
+// write sends outgoing messages until conn.shared.outgoing is closed. It is
+// the only goroutine that writes to the websocket. After a send fails it
+// reports the error and discards the remaining messages.
+func (conn *ClientConn) write(errChan chan<- error, done chan<- struct{}) {
+	defer close(done)
+
+	var failed bool
+	for msg := range conn.shared.outgoing {
+		if failed {
+			continue
+		}
+
+		sendStart := time.Now()
+		if conn.writeTimeout > 0 {
+			conn.ws.SetWriteDeadline(sendStart.Add(conn.writeTimeout))
+		}
+		err := websocket.JSON.Send(conn.ws, msg.v)
+		sendTime := time.Since(sendStart)
+
+		for _, h := range msg.handled {
+			if h.trace != nil {
+				h.trace.SendTime = sendTime
+			}
+			conn.logRequest(h)
+		}
+
+		if err != nil {
+			failed = true
+			errChan <- err
+		}
+	}
+}
+
+// read receives messages and starts handling each one until receiving fails
+// or the connection stops accepting requests. It blocks while the connection
+// is handling as many requests as it is allowed to. Receiving fails if no
+// message arrives within idleTimeout.
+func (conn *ClientConn) read(errChan chan<- error) {
+	for {
+		if conn.idleTimeout > 0 {
+			conn.ws.SetReadDeadline(time.Now().Add(conn.idleTimeout))
+		}
+
+		var data []byte
+		err := websocket.Message.Receive(conn.ws, &data)
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		if !conn.startMessage(data) {
+			return
+		}
+	}
+}
 
-			reqChan <- req
+// startMessage handles data in a new goroutine. Messages that call an
+// exclusive method wait for every earlier message to finish and delay every
+// later one until they are done. It returns false if the connection is no
+// longer accepting requests.
+func (conn *ClientConn) startMessage(data []byte) bool {
+	s := conn.shared
+	exclusive := conn.isExclusive(data)
+
+	s.slots <- struct{}{}
+	if exclusive {
+		s.sessionLock.Lock()
+	} else {
+		s.sessionLock.RLock()
+	}
+
+	release := func() {
+		if exclusive {
+			s.sessionLock.Unlock()
+		} else {
+			s.sessionLock.RUnlock()
 		}
+		<-s.slots
+	}
+
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		release()
+		return false
+	}
+	s.inFlight.Add(1)
+	s.mutex.Unlock()
+
+	go func() {
+		defer s.inFlight.Done()
+		defer release()
+		conn.handleMessage(data)
 	}()
 
+	return true
+}
+
+// isExclusive returns true if data calls any exclusive method.
+func (conn *ClientConn) isExclusive(data []byte) bool {
+	type methodName struct {
+		Method string `json:"method"`
+	}
+
+	// Malformed messages are not exclusive. Handling them reports the error.
+	var requests []methodName
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		json.Unmarshal(data, &requests)
+	} else {
+		requests = make([]methodName, 1)
+		json.Unmarshal(data, &requests[0])
+	}
+
+	methods := conn.methodRegistry()
+	for _, r := range requests {
+		if m := methods.Lookup(r.Method); m != nil && m.Exclusive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// stopRequests stops accepting requests, stops listening for notifications
+// and waits for the requests in flight to finish.
+func (conn *ClientConn) stopRequests() {
+	s := conn.shared
+
+	s.mutex.Lock()
+	s.closing = true
+	s.mutex.Unlock()
+
+	conn.removeRepositoryListeners()
+	s.inFlight.Wait()
+}
+
+func (conn *ClientConn) methodRegistry() *MethodRegistry {
+	if conn.methods == nil {
+		return defaultMethods
+	}
+	return conn.methods
+}
+
+func (conn *ClientConn) sendNotification(method string, params interface{}) {
+	conn.shared.outgoing <- outgoingMessage{v: Notification{JSONRPC: "2.0", Method: method, Params: params}}
+}
+
+// handledRequest is the outcome of handling a single request. response is
+// nil for notifications.
+type handledRequest struct {
+	response *Response
+	trace    *RequestTrace
+	logger   log.Logger
+	code     int32
+}
+
+// handleMessage handles a websocket message containing a single request or a
+// batch of requests and queues the responses. Malformed messages are answered
+// with an error rather than closing the connection.
+func (conn *ClientConn) handleMessage(data []byte) {
+	data = bytes.TrimSpace(data)
+
+	if len(data) == 0 || data[0] != '[' {
+		h := conn.handleRawRequest(data)
+		if h.response == nil {
+			conn.logRequest(h)
+			return
+		}
+		conn.shared.outgoing <- outgoingMessage{v: h.response, handled: []handledRequest{h}}
+		return
+	}
+
+	var rawRequests []json.RawMessage
+	err := json.Unmarshal(data, &rawRequests)
+	if err != nil {
+		conn.shared.outgoing <- outgoingMessage{v: Response{Error: errorWithData(JSONRPCParseError, err.Error())}}
+		return
+	}
+	if len(rawRequests) == 0 {
+		conn.shared.outgoing <- outgoingMessage{v: Response{Error: errorWithData(JSONRPCInvalidRequest, "Batch must not be empty")}}
+		return
+	}
+
+	handled := make([]handledRequest, len(rawRequests))
+	var responses []*Response
+	for i, raw := range rawRequests {
+		handled[i] = conn.handleRawRequest(raw)
+		if handled[i].response != nil {
+			responses = append(responses, handled[i].response)
+		}
+	}
+
+	// A batch of only notifications gets no response at all
+	if len(responses) == 0 {
+		for _, h := range handled {
+			conn.logRequest(h)
+		}
+		return
+	}
+
+	conn.shared.outgoing <- outgoingMessage{v: responses, handled: handled}
+}
+
+// handleRawRequest parses and handles a single request. Requests that are not
+// valid JSON-RPC 2.0 are answered with an error.
+func (conn *ClientConn) handleRawRequest(raw json.RawMessage) handledRequest {
+	req, rpcErr := parseRequest(raw)
+	if rpcErr != nil {
+		response := &Response{Error: rpcErr, ID: req.ID}
+		return handledRequest{response: response, code: rpcErr.Code}
+	}
+
+	return conn.handleRequest(req)
+}
+
+// parseRequest parses and validates a single request. If the request is
+// invalid the returned Request has an ID only if a valid one was found.
+func parseRequest(raw json.RawMessage) (Request, *Error) {
+	var req Request
+	err := json.Unmarshal(raw, &req)
+	if _, ok := err.(*json.SyntaxError); ok || len(raw) == 0 {
+		return Request{}, errorWithData(JSONRPCParseError, "Message is not valid JSON")
+	}
+	if err != nil {
+		return Request{}, errorWithData(JSONRPCInvalidRequest, "Request must be an object")
+	}
+
+	if !validRequestID(req.ID) {
+		return Request{}, errorWithData(JSONRPCInvalidRequest, `"id" must be a string, number or null`)
+	}
+
+	if req.JSONRPC != "" && req.JSONRPC != "2.0" {
+		return Request{ID: req.ID}, errorWithData(JSONRPCInvalidRequest, `"jsonrpc" must be "2.0"`)
+	}
+
+	if req.Method == "" {
+		return Request{ID: req.ID}, errorWithData(JSONRPCInvalidRequest, `Request must include the attribute "method"`)
+	}
+
+	switch {
+	case len(req.Params) == 0 || string(req.Params) == "null":
+		req.Params = json.RawMessage("{}")
+	case req.Params[0] != '{' && req.Params[0] != '[':
+		return Request{ID: req.ID}, errorWithData(JSONRPCInvalidRequest, `"params" must be an object or array`)
+	}
+
+	return req, nil
+}
+
+// validRequestID returns true if id is absent or a string, number or null.
+func validRequestID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+
+	switch c := id[0]; {
+	case c == 'n', c == '"', c == '-', '0' <= c && c <= '9':
+		return true
+	default:
+		return false
+	}
+}
+
+// handleRequest calls the method named by req. The response is discarded if
+// req is a notification.
+func (conn *ClientConn) handleRequest(req Request) handledRequest {
+	methods := conn.methodRegistry()
+
+	// The request is handled by a copy of conn so changes to its logger and
+	// repository do not affect concurrent requests. A change of user is
+	// copied back afterwards.
+	user := conn.shared.getUser()
+	rc := *conn
+	rc.user = user
+
+	call := &Call{
+		Name:    req.Method,
+		Method:  methods.Lookup(req.Method),
+		Request: req,
+		Trace:   NewRequestTrace(),
+		Logger:  conn.logger,
+	}
+	response := methods.Call(&rc, call)
+
+	if rc.user != user {
+		conn.shared.setUser(rc.user)
+	}
+
+	h := handledRequest{trace: call.Trace, logger: call.Logger, code: responseCode(response)}
+	if req.ID != nil {
+		response.ID = req.ID
+		h.response = &response
+	}
+
+	return h
+}
+
+// logRequest logs the timing breakdown of a finished request. Requests slower
+// than slowRequestThreshold are logged as warnings. Invalid requests are only
+// logged at debug level.
+func (conn *ClientConn) logRequest(h handledRequest) {
+	if h.trace == nil {
+		conn.logger.Debug("Invalid request", "code", h.code)
+		return
+	}
+
+	duration := time.Since(h.trace.Start)
+	ctx := []interface{}{
+		"code", h.code,
+		"duration", duration,
+		"db_time", h.trace.DBTime,
+		"db_calls", h.trace.DBCalls,
+		"send_time", h.trace.SendTime,
+	}
+
+	if conn.slowRequestThreshold > 0 && duration >= conn.slowRequestThreshold {
+		h.logger.Warn("Slow request", ctx...)
+	} else {
+		h.logger.Debug("Handled request", ctx...)
+	}
+}
+
+// makeNotificationChans makes the channel that receives repository events
+// once the user has logged in.
+func (conn *ClientConn) makeNotificationChans() {
+	conn.eventChan = make(chan Event)
+}
+
+// addRepositoryListeners starts delivering repository events to the client.
+// It does nothing if they are already delivered or the connection is closing.
+func (conn *ClientConn) addRepositoryListeners() {
+	s := conn.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listening || s.closing {
+		return
+	}
+	s.listening = true
+
+	conn.repo.EventSignal().Add(conn.eventChan)
+}
+
+// removeRepositoryListeners stops delivering repository events. queueEvents
+// must still be receiving so an event dispatching to this connection cannot
+// block the removal.
+func (conn *ClientConn) removeRepositoryListeners() {
+	s := conn.shared
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.listening {
+		return
+	}
+	s.listening = false
+
+	conn.repo.EventSignal().Remove(conn.eventChan)
+}
+
+// maxQueuedEvents is how far a client can fall behind on events before its
+// connection is closed.
+const maxQueuedEvents = 256
+
+// queueEvents receives the events dispatched to the connection and queues
+// them to be sent until stop is closed. Events are dispatched to every
+// connection in turn so it never blocks, which would delay every other
+// client. If queue is full overflow is signalled and every later event is
+// dropped so the client never sees a gap. It is sent what it missed when it
+// reconnects.
+func (conn *ClientConn) queueEvents(queue chan<- Event, overflow chan<- struct{}, stop <-chan struct{}) {
+	var overflowed bool
 	for {
 		select {
-		case req := <-reqChan:
-			var response Response
-
-			switch req.Method {
-			case "register":
-				response = conn.Register(req.Params)
-			case "login":
-				response = conn.Login(req.Params)
-			case "resume_session":
-				response = conn.ResumeSession(req.Params)
-			case "request_password_reset":
-				response = conn.RequestPasswordReset(req.Params)
-			case "reset_password":
-				response = conn.ResetPassword(req.Params)
-
-			case "init_chat":
-				response = conn.InitChat(req.Params)
-			case "post_message":
-				response = conn.PostMessage(req.Params)
-			case "create_channel":
-				response = conn.CreateChannel(req.Params)
-			case "rename_channel":
-				response = conn.RenameChannel(req.Params)
-			case "logout":
-				conn.user = User{}
+		case event := <-conn.eventChan:
+			if overflowed {
+				continue
+			}
+
+			select {
+			case queue <- event:
 			default:
-				// unknown req method
-				response.Error = errorWithData(JSONRPCMethodNotFound, req.Method)
+				overflowed = true
+				overflow <- struct{}{}
 			}
+		case <-stop:
+			return
+		}
+	}
+}
 
-			if req.ID != nil {
-				response.ID = *req.ID
+// disabledBy reports whether event disabled the connection's user. The
+// connection must then be closed because its session no longer exists.
+func (conn *ClientConn) disabledBy(event Event) bool {
+	if event.Method != "user_disabled" {
+		return false
+	}
 
-				err := websocket.JSON.Send(conn.ws, response)
-				if err != nil {
-					fmt.Println(err)
-					// Failed to send
-					return
-				}
-			}
-		case channel := <-conn.channelCreatedChan:
-			var msg struct {
-				ID   int32  `json:"id"`
-				Name string `json:"name"`
-			}
+	var params userIDNotification
+	if err := json.Unmarshal(event.Params, &params); err != nil {
+		conn.logger.Error("Unable to decode user_disabled event", "error", err)
+		return false
+	}
 
-			msg.ID = channel.ID
-			msg.Name = channel.Name
+	return params.ID != 0 && params.ID == conn.shared.getUser().ID
+}
 
-			var notification struct {
-				Method string      `json:"method"`
-				Params interface{} `json:"params"`
-			}
+// maxReplayEvents is the most events replayed to a resumed session. Clients
+// that missed more must reload everything.
+const maxReplayEvents = 1000
+
+// listenForEvents starts sending events to the client. If lastEventID is nil
+// only events after the newest in the log are sent. Otherwise the events
+// after lastEventID are replayed first unless some are no longer in the log
+// or there are more than maxReplayEvents. Then resync is true and the client
+// must reload everything. It returns the ID of the last event the client has
+// been sent or will see when it reloads.
+func (conn *ClientConn) listenForEvents(lastEventID *int64) (cursor int64, resync bool, err error) {
+	s := conn.shared
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	// Listening starts first so no event committed after the range is read
+	// can be missed.
+	conn.addRepositoryListeners()
 
-			notification.Method = "channel_created"
-			notification.Params = msg
-			err := websocket.JSON.Send(conn.ws, notification)
-			if err != nil {
-				fmt.Println(err)
-				// Failed to send
-				return
-			}
-		case channel := <-conn.channelRenamedChan:
-			var msg struct {
-				ID   int32  `json:"id"`
-				Name string `json:"name"`
-			}
+	firstID, lastID, err := conn.repo.GetEventRange()
+	if err != nil {
+		return 0, false, err
+	}
 
-			msg.ID = channel.ID
-			msg.Name = channel.Name
+	cursor = lastID
+	if lastEventID != nil {
+		cursor, resync, err = conn.replayEvents(*lastEventID, firstID, lastID)
+		if err != nil {
+			return 0, false, err
+		}
+	}
 
-			var notification struct {
-				Method string      `json:"method"`
-				Params interface{} `json:"params"`
-			}
+	if cursor > s.skipEventsThrough {
+		s.skipEventsThrough = cursor
+	}
 
-			notification.Method = "channel_renamed"
-			notification.Params = msg
-			err := websocket.JSON.Send(conn.ws, notification)
-			if err != nil {
-				fmt.Println(err)
-				// Failed to send
-				return
-			}
-		case message := <-conn.messagePostedChan:
-			var msg struct {
-				ID           int64  `json:"id"`
-				ChannelID    int32  `json:"channel_id"`
-				AuthorID     int32  `json:"author_id"`
-				Body         string `json:"body"`
-				CreationTime int64  `json:"creation_time"`
-			}
+	return cursor, resync, nil
+}
 
-			msg.ID = message.ID
-			msg.ChannelID = message.ChannelID
-			msg.AuthorID = message.AuthorID
-			msg.Body = message.Body
-			msg.CreationTime = message.Time.Unix()
+// replayEvents sends the events after afterID. firstID and lastID are the
+// range of events in the log. It must be called with eventMutex held.
+func (conn *ClientConn) replayEvents(afterID, firstID, lastID int64) (cursor int64, resync bool, err error) {
+	if afterID > lastID || afterID < firstID-1 {
+		return lastID, true, nil
+	}
 
-			var notification struct {
-				Method string      `json:"method"`
-				Params interface{} `json:"params"`
-			}
+	events, err := conn.repo.GetEventsAfter(afterID, maxReplayEvents+1)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(events) > maxReplayEvents {
+		return lastID, true, nil
+	}
 
-			notification.Method = "message_posted"
-			notification.Params = msg
-			err := websocket.JSON.Send(conn.ws, notification)
-			if err != nil {
-				fmt.Println(err)
-				// Failed to send
-				return
-			}
-		case user := <-conn.userCreatedChan:
-			var msg struct {
-				ID   int32  `json:"id"`
-				Name string `json:"name"`
-			}
+	cursor = afterID
+	for _, event := range events {
+		conn.sendNotification(event.Method, eventNotificationParams(event))
+		cursor = event.ID
+	}
 
-			msg.ID = user.ID
-			msg.Name = user.Name
+	conn.logger.Debug("Replayed events", "count", len(events), "after_event_id", afterID)
 
-			var notification struct {
-				Method string      `json:"method"`
-				Params interface{} `json:"params"`
-			}
+	return cursor, false, nil
+}
 
-			notification.Method = "user_created"
-			notification.Params = msg
-			err := websocket.JSON.Send(conn.ws, notification)
-			if err != nil {
-				fmt.Println(err)
-				// Failed to send
-				return
-			}
-		case err := <-errChan:
-			if _, ok := err.(*json.SyntaxError); ok {
-				var response Response
-				response.ID = json.Number("null")
-				response.Error = errorWithData(JSONRPCParseError, err.Error())
-
-				err = websocket.JSON.Send(conn.ws, response)
-				if err != nil {
-					fmt.Println(err)
-					// Failed to send
-					return
-				}
-			}
+// sendEvent sends a live event to the client unless it was already replayed
+// or is included in what the client loaded.
+func (conn *ClientConn) sendEvent(event Event) {
+	s := conn.shared
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
 
-			fmt.Println("errChan: ", err)
-			fmt.Printf("%T", err)
-			return
+	if event.ID <= s.skipEventsThrough {
+		return
+	}
+
+	conn.sendNotification(event.Method, eventNotificationParams(event))
+}
+
+// retryAfterData is the error data telling a client how long to wait before
+// trying again.
+func retryAfterData(retryAfter time.Duration) interface{} {
+	var data struct {
+		RetryAfter int64 `json:"retry_after_ms"`
+	}
+	data.RetryAfter = int64(retryAfter / time.Millisecond)
+	return data
+}
+
+// takeRateLimitToken takes a token from the buckets for method and the
+// connection's IP address, email and current user. email may be empty for
+// methods that do not take one. It returns a rate limited error with how long
+// to wait if any bucket is empty.
+func (conn *ClientConn) takeRateLimitToken(method, email string) *Error {
+	if conn.rateLimiter == nil {
+		return nil
+	}
+
+	var keys []string
+	if email != "" {
+		keys = append(keys, "email:"+strings.ToLower(email))
+	}
+	if remoteIP, err := conn.remoteIP(); err == nil {
+		keys = append(keys, "ip:"+remoteIP)
+	}
+	if conn.user.ID != 0 {
+		keys = append(keys, "user:"+strconv.FormatInt(int64(conn.user.ID), 10))
+	}
+
+	retryAfter, err := conn.rateLimiter.Take(method, keys...)
+	if err != nil {
+		conn.logger.Error("Unable to check rate limit", "error", err)
+		return errorWithData(JSONRPCInternalError, "Unable to check rate limit")
+	}
+	if retryAfter > 0 {
+		conn.logger.Info("Rate limited", "retry_after", retryAfter)
+		return errorWithData(JSONRPCRateLimitedError, retryAfterData(retryAfter))
+	}
+
+	return nil
+}
+
+func (conn *ClientConn) Register(params interface{}) (response Response) {
+	registration := params.(*Registration)
+
+	var err error
+	conn.user, err = conn.repo.CreateUser(registration.Name, registration.Email, registration.Password)
+	if err != nil {
+		if err, ok := err.(DuplicationError); ok {
+			response.Error = errorWithData(JSONRPCDuplicationError, err.Field)
+			return response
+		} else {
+			conn.logger.Error("Unable to create user", "error", err)
+			response.Error = errorWithData(JSONRPCInternalError, "Unable to create user")
+			return response
 		}
 	}
+
+	if conn.mailer == nil {
+		// Without mail there is no way to verify so trust the address
+		err = conn.repo.SetEmailVerified(conn.user.ID)
+		if err != nil {
+			conn.logger.Error("Unable to verify email", "error", err)
+			response.Error = errorWithData(JSONRPCInternalError, "Unable to verify email")
+			return response
+		}
+		conn.user.EmailVerified = true
+	} else {
+		err = conn.sendVerificationEmail()
+		if err != nil {
+			// The user can request another verification email so registration still succeeds
+			conn.logger.Error("Unable to send verification email", "userID", conn.user.ID, "error", err)
+		}
+	}
+
+	sessionID, err := conn.repo.CreateSession(conn.user.ID)
+	if err != nil {
+		conn.logger.Error("Unable to create session", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to create session")
+		return response
+	}
+
+	lastEventID, _, err := conn.listenForEvents(nil)
+	if err != nil {
+		conn.logger.Error("Unable to listen for events", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to listen for events")
+		return response
+	}
+
+	response.Result = LoginSuccess{UserID: conn.user.ID, SessionID: sessionID, EmailVerified: conn.user.EmailVerified, LastEventID: lastEventID}
+
+	return response
 }
 
-func (conn *ClientConn) addRepositoryListeners() {
-	conn.removeRepositoryListeners()
+// remoteIP returns the IP address of the client, looking past trusted
+// proxies.
+func (conn *ClientConn) remoteIP() (string, error) {
+	return conn.trustedProxies.ClientIP(conn.ws.Request())
+}
+
+func (conn *ClientConn) sendVerificationEmail() error {
+	remoteIP, err := conn.remoteIP()
+	if err != nil {
+		return err
+	}
+
+	token, err := conn.repo.CreateEmailVerificationToken(conn.user.ID, remoteIP)
+	if err != nil {
+		return err
+	}
 
-	conn.channelCreatedChan = make(chan Channel)
-	conn.repo.ChannelCreatedSignal().Add(conn.channelCreatedChan)
+	return conn.mailer.SendEmailVerificationMail(conn.user.Email, token)
+}
 
-	conn.channelRenamedChan = make(chan Channel)
-	conn.repo.ChannelRenamedSignal().Add(conn.channelRenamedChan)
+// sendAccountUnlockEmail mails a link that unlocks the account of userID
+// before its lockout expires.
+func (conn *ClientConn) sendAccountUnlockEmail(userID int32, email string) error {
+	remoteIP, err := conn.remoteIP()
+	if err != nil {
+		return err
+	}
 
-	conn.messagePostedChan = make(chan Message)
-	conn.repo.MessagePostedSignal().Add(conn.messagePostedChan)
+	token, err := conn.repo.CreateAccountUnlockToken(userID, remoteIP)
+	if err != nil {
+		return err
+	}
 
-	conn.userCreatedChan = make(chan User)
-	conn.repo.UserCreatedSignal().Add(conn.userCreatedChan)
+	return conn.mailer.SendAccountUnlockMail(email, token)
 }
 
-func (conn *ClientConn) removeRepositoryListeners() {
-	if conn.channelCreatedChan != nil {
-		conn.repo.ChannelCreatedSignal().Remove(conn.channelCreatedChan)
+// requireVerifiedEmail returns an error unless the current user has verified
+// their email address. The user is reloaded first in case the address was
+// verified through another connection.
+func (conn *ClientConn) requireVerifiedEmail() *Error {
+	if conn.user.EmailVerified {
+		return nil
+	}
+
+	user, err := conn.repo.GetUser(conn.user.ID)
+	if err != nil {
+		conn.logger.Error("Unable to get user", "error", err)
+		return errorWithData(JSONRPCInternalError, "Unable to get user")
+	}
+	conn.user = user
+
+	if !conn.user.EmailVerified {
+		return errorWithData(JSONRPCEmailNotVerifiedError, "Email address must be verified first")
+	}
+
+	return nil
+}
+
+func (conn *ClientConn) VerifyEmail(params interface{}) (response Response) {
+	verification := params.(*EmailToken)
+
+	remoteIP, err := conn.remoteIP()
+	if err != nil {
+		conn.logger.Error("Unable to get remoteIP", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to get remoteIP")
+		return response
 	}
 
-	if conn.channelRenamedChan != nil {
-		conn.repo.ChannelRenamedSignal().Remove(conn.channelRenamedChan)
+	user, err := conn.repo.SetEmailVerifiedByToken(verification.Token, remoteIP)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Invalid or expired token")
+		return response
 	}
-
-	if conn.messagePostedChan != nil {
-		conn.repo.MessagePostedSignal().Remove(conn.messagePostedChan)
+	if err != nil {
+		conn.logger.Error("Failed to verify email", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Failed to verify email")
+		return response
 	}
 
-	if conn.userCreatedChan != nil {
-		conn.repo.UserCreatedSignal().Remove(conn.userCreatedChan)
+	if conn.user.ID == user.ID {
+		conn.user = user
 	}
+
+	response.Result = true
+	return response
 }
 
-func (conn *ClientConn) Register(params json.RawMessage) (response Response) {
-	var registration struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+func (conn *ClientConn) UnlockAccount(params interface{}) (response Response) {
+	unlock := params.(*EmailToken)
+
+	remoteIP, err := conn.remoteIP()
+	if err != nil {
+		conn.logger.Error("Unable to get remoteIP", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to get remoteIP")
+		return response
 	}
 
-	if err := json.Unmarshal(params, &registration); err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+	_, err = conn.repo.UnlockAccountByToken(unlock.Token, remoteIP)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Invalid or expired token")
+		return response
+	}
+	if err != nil {
+		conn.logger.Error("Failed to unlock account", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Failed to unlock account")
 		return response
 	}
 
-	if registration.Name == "" {
-		response.Error = errorWithData(JSONRPCInvalidParams, `Request must include the attribute "name"`)
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) ResendVerificationEmail(params interface{}) (response Response) {
+	if conn.user.EmailVerified {
+		response.Error = errorWithData(JSONRPCInvalidParams, "Email address is already verified")
 		return response
 	}
 
-	if len(registration.Name) > 30 {
-		response.Error = errorWithData(JSONRPCInvalidParams, `"name" must be less than 30 characters`)
+	if conn.mailer == nil {
+		response.Error = errorWithData(JSONRPCSendEmailError, "Mail is not configured")
 		return response
 	}
 
-	err := ValidatePassword(registration.Password)
+	err := conn.sendVerificationEmail()
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInvalidPasswordError, err.Error())
+		response.Error = errorWithData(JSONRPCSendEmailError, "Send email failed")
 		return response
 	}
 
-	conn.user, err = conn.repo.CreateUser(registration.Name, registration.Email, registration.Password)
-	if err != nil {
-		if err, ok := err.(DuplicationError); ok {
-			response.Error = errorWithData(JSONRPCDuplicationError, err.Field)
-			return response
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) Login(params interface{}) (response Response) {
+	credentials := params.(*RequestCredentials)
+
+	user, err := conn.repo.Login(credentials.Email, credentials.Password)
+	switch err := err.(type) {
+	case nil:
+	case LoginThrottledError:
+		if err.Locked {
+			response.Error = errorWithData(JSONRPCAccountLockedError, retryAfterData(err.RetryAfter))
 		} else {
-			response.Error = errorWithData(JSONRPCInternalError, "Unable to create user")
-			return response
+			response.Error = errorWithData(JSONRPCRateLimitedError, retryAfterData(err.RetryAfter))
+		}
+		return response
+	case AccountLockedError:
+		conn.logger.Warn("Account locked after failed logins", "locked_user_id", err.UserID)
+		if conn.mailer != nil {
+			if mailErr := conn.sendAccountUnlockEmail(err.UserID, credentials.Email); mailErr != nil {
+				conn.logger.Error("Unable to send account unlock email", "error", mailErr)
+			}
 		}
+		response.Error = errorWithData(JSONRPCAccountLockedError, retryAfterData(err.RetryAfter))
+		return response
+	default:
+		response.Error = errorWithData(JSONRPCAunthenticationError, "Bad email or password")
+		return response
 	}
+	conn.user = user
 
 	sessionID, err := conn.repo.CreateSession(conn.user.ID)
 	if err != nil {
+		conn.logger.Error("Unable to create session", "error", err)
 		response.Error = errorWithData(JSONRPCInternalError, "Unable to create session")
 		return response
 	}
 
-	conn.addRepositoryListeners()
+	lastEventID, _, err := conn.listenForEvents(nil)
+	if err != nil {
+		conn.logger.Error("Unable to listen for events", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to listen for events")
+		return response
+	}
 
-	response.Result = LoginSuccess{UserID: conn.user.ID, SessionID: sessionID}
+	response.Result = LoginSuccess{UserID: conn.user.ID, SessionID: sessionID, EmailVerified: conn.user.EmailVerified, LastEventID: lastEventID}
 
 	return response
 }
 
-func (conn *ClientConn) Login(body json.RawMessage) (response Response) {
-	var credentials RequestCredentials
+func (conn *ClientConn) ResumeSession(params interface{}) (response Response) {
+	credentials := params.(*ResumeSession)
 
-	err := json.Unmarshal(body, &credentials)
+	userID, err := conn.repo.GetUserIDBySessionID(credentials.SessionID)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCAunthenticationError, "Invalid sessionID")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+		conn.logger.Error("Cannot resume session", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Cannot resume session")
 		return response
 	}
 
-	if credentials.Email == "" {
-		response.Error = errorWithData(JSONRPCInvalidParams, `Request must include the attribute "email"`)
+	user, err := conn.repo.GetUser(userID)
+	if err != nil {
+		conn.logger.Error("Unable to get user", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to get user")
 		return response
 	}
+	conn.user = user
 
-	if credentials.Password == "" {
-		response.Error = errorWithData(JSONRPCInvalidParams, `Request must include the attribute "password"`)
+	lastEventID, resync, err := conn.listenForEvents(credentials.LastEventID)
+	if err != nil {
+		conn.logger.Error("Unable to listen for events", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to listen for events")
 		return response
 	}
 
-	conn.user, err = conn.repo.Login(credentials.Email, credentials.Password)
+	response.Result = LoginSuccess{
+		UserID:        conn.user.ID,
+		SessionID:     credentials.SessionID,
+		EmailVerified: conn.user.EmailVerified,
+		LastEventID:   lastEventID,
+		Resync:        resync,
+	}
+
+	return response
+}
+
+// Ping lets the client measure latency. Calling it also answers the ping
+// notifications the server sends to check the connection is alive.
+func (conn *ClientConn) Ping(params interface{}) (response Response) {
+	response.Result = true
+	return response
+}
+
+// Logout forgets the connection's user. Notifications continue until the
+// client disconnects.
+func (conn *ClientConn) Logout(params interface{}) (response Response) {
+	conn.user = User{}
+	return response
+}
+
+func (conn *ClientConn) RequestPasswordReset(params interface{}) (response Response) {
+	reset := params.(*RequestPasswordReset)
+
+	remoteIP, err := conn.remoteIP()
 	if err != nil {
-		response.Error = errorWithData(JSONRPCAunthenticationError, "Bad email or password")
+		conn.logger.Error("Unable to get remoteIP", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to get remoteIP")
 		return response
 	}
 
-	sessionID, err := conn.repo.CreateSession(conn.user.ID)
+	token, err := conn.repo.CreatePasswordResetToken(reset.Email, remoteIP)
+	if err == ErrNotFound {
+		response.Result = true // don't reveal whether email address is taken or not
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Unable to create session")
+		conn.logger.Error("Unable to create password reset token", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to create password reset token")
 		return response
 	}
 
-	conn.addRepositoryListeners()
+	if conn.mailer == nil {
+		response.Error = errorWithData(JSONRPCSendEmailError, "Mail is not configured")
+		return response
+	}
 
-	response.Result = LoginSuccess{UserID: conn.user.ID, SessionID: sessionID}
+	err = conn.mailer.SendPasswordResetMail(reset.Email, token)
+	if err != nil {
+		response.Error = errorWithData(JSONRPCSendEmailError, "Send email failed")
+		return response
+	}
 
+	response.Result = true // don't reveal whether email address is taken or not
 	return response
 }
 
-func (conn *ClientConn) ResumeSession(body json.RawMessage) (response Response) {
-	var credentials struct {
-		SessionID string `json:"session_id"`
-	}
+func (conn *ClientConn) ResetPassword(params interface{}) (response Response) {
+	resetPassword := params.(*ResetPassword)
 
-	err := json.Unmarshal(body, &credentials)
+	remoteIP, err := conn.remoteIP()
 	if err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+		conn.logger.Error("Unable to get remoteIP", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to get remoteIP")
 		return response
 	}
 
-	if credentials.SessionID == "" {
-		response.Error = errorWithData(JSONRPCInvalidParams, `Request must include the attribute "session_id"`)
+	err = conn.repo.SetPasswordByToken(resetPassword.Token, resetPassword.Password, remoteIP)
+	if err != nil {
+		conn.logger.Error("Failed to update password", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Failed to update password")
 		return response
 	}
 
-	userID, err := conn.repo.GetUserIDBySessionID(credentials.SessionID)
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) ChangePassword(params interface{}) (response Response) {
+	changePassword := params.(*ChangePassword)
+
+	err := conn.repo.CheckPassword(conn.user.ID, changePassword.CurrentPassword)
 	if err == ErrNotFound {
-		response.Error = errorWithData(JSONRPCAunthenticationError, "Invalid sessionID")
+		response.Error = errorWithData(JSONRPCAunthenticationError, "Bad password")
 		return response
 	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Cannot resume session")
+		conn.logger.Error("Unable to check password", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to check password")
+		return response
+	}
+
+	err = conn.repo.SetPassword(conn.user.ID, changePassword.NewPassword)
+	if err != nil {
+		conn.logger.Error("Failed to update password", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Failed to update password")
 		return response
 	}
 
-	conn.user, err = conn.repo.GetUser(userID)
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) UpdateProfile(params interface{}) (response Response) {
+	profile := params.(*UpdateProfile)
 
-	conn.addRepositoryListeners()
+	user, err := conn.repo.SetName(conn.user.ID, profile.Name)
+	if err != nil {
+		if err, ok := err.(DuplicationError); ok {
+			response.Error = errorWithData(JSONRPCDuplicationError, err.Field)
+			return response
+		}
+		conn.logger.Error("Unable to update profile", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to update profile")
+		return response
+	}
 
-	response.Result = LoginSuccess{UserID: conn.user.ID, SessionID: credentials.SessionID}
+	conn.user = user
 
+	response.Result = true
 	return response
 }
 
-func (conn *ClientConn) RequestPasswordReset(body json.RawMessage) (response Response) {
-	var reset struct {
-		Email string `json:"email"`
-	}
+func (conn *ClientConn) ChangeEmail(params interface{}) (response Response) {
+	changeEmail := params.(*ChangeEmail)
 
-	err := json.Unmarshal(body, &reset)
+	err := conn.repo.CheckPassword(conn.user.ID, changeEmail.Password)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCAunthenticationError, "Bad password")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+		conn.logger.Error("Unable to check password", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to check password")
 		return response
 	}
 
-	if reset.Email == "" {
-		response.Error = errorWithData(JSONRPCInvalidParams, `Request must include the attribute "email"`)
+	if conn.mailer == nil {
+		response.Error = errorWithData(JSONRPCSendEmailError, "Mail is not configured")
 		return response
 	}
 
 	var remoteIP string
-	remoteIP, _, err = net.SplitHostPort(conn.ws.Request().RemoteAddr)
+	remoteIP, err = conn.remoteIP()
 	if err != nil {
+		conn.logger.Error("Unable to get remoteIP", "error", err)
 		response.Error = errorWithData(JSONRPCInternalError, "Unable to get remoteIP")
 		return response
 	}
 
-	token, err := conn.repo.CreatePasswordResetToken(reset.Email, remoteIP)
-	if err == ErrNotFound {
-		response.Result = true // don't reveal whether email address is taken or not
+	token, err := conn.repo.CreateEmailChangeToken(conn.user.ID, changeEmail.Email, remoteIP)
+	if err != nil {
+		conn.logger.Error("Unable to create email change token", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to create email change token")
 		return response
 	}
+
+	err = conn.mailer.SendEmailChangeConfirmationMail(changeEmail.Email, token)
 	if err != nil {
-		fmt.Println(err)
-		response.Error = errorWithData(JSONRPCInternalError, "Unable to create password reset token")
+		response.Error = errorWithData(JSONRPCSendEmailError, "Send email failed")
 		return response
 	}
 
-	if conn.mailer == nil {
-		response.Error = errorWithData(JSONRPCSendEmailError, "Mail is not configured")
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) ConfirmEmailChange(params interface{}) (response Response) {
+	confirmation := params.(*EmailToken)
+
+	remoteIP, err := conn.remoteIP()
+	if err != nil {
+		conn.logger.Error("Unable to get remoteIP", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to get remoteIP")
 		return response
 	}
 
-	err = conn.mailer.SendPasswordResetMail(reset.Email, token)
+	user, err := conn.repo.SetEmailByToken(confirmation.Token, remoteIP)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Invalid or expired token")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCSendEmailError, "Send email failed")
+		if err, ok := err.(DuplicationError); ok {
+			response.Error = errorWithData(JSONRPCDuplicationError, err.Field)
+			return response
+		}
+		conn.logger.Error("Failed to update email", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Failed to update email")
 		return response
 	}
 
-	response.Result = true // don't reveal whether email address is taken or not
+	if conn.user.ID == user.ID {
+		conn.user = user
+	}
+
+	response.Result = true
 	return response
 }
 
-func (conn *ClientConn) ResetPassword(body json.RawMessage) (response Response) {
-	var resetPassword struct {
-		Token    string `json:"token"`
-		Password string `json:"password"`
+func (conn *ClientConn) InitChat(params interface{}) (response Response) {
+	initJSON, err := conn.repo.GetInit(conn.user.ID)
+	if err != nil {
+		conn.logger.Error("Unable to initialize chat", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to initialize chat")
+		return response
 	}
 
-	err := json.Unmarshal(body, &resetPassword)
+	rawInit := json.RawMessage(initJSON)
+	response.Result = &rawInit
+	return response
+}
+
+func (conn *ClientConn) PostMessage(params interface{}) (response Response) {
+	message := params.(*PostMessage)
+
+	posted, err := conn.repo.PostMessage(message.ChannelID, conn.user.ID, message.Text, message.ClientNonce)
+	if err == ErrChannelArchived {
+		response.Error = errorWithData(JSONRPCChannelArchivedError, "Cannot post to an archived channel")
+		return response
+	}
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Channel not found")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+		conn.logger.Error("Unable to post message", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to post message")
 		return response
 	}
 
-	var remoteIP string
-	remoteIP, _, err = net.SplitHostPort(conn.ws.Request().RemoteAddr)
+	response.Result = newMessagePostedNotification(posted)
+	return response
+}
+
+func (conn *ClientConn) CreateChannel(params interface{}) (response Response) {
+	message := params.(*CreateChannel)
+
+	_, err := conn.repo.CreateChannel(message.Name, conn.user.ID)
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Unable to get remoteIP")
+		conn.logger.Error("Unable to create channel", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to create channel")
 		return response
 	}
 
-	err = conn.repo.SetPasswordByToken(resetPassword.Token, resetPassword.Password, remoteIP)
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) RenameChannel(params interface{}) (response Response) {
+	message := params.(*RenameChannel)
+
+	err := conn.repo.RenameChannel(message.ID, message.Name)
+	if err == ErrChannelArchived {
+		response.Error = errorWithData(JSONRPCChannelArchivedError, "Cannot rename an archived channel")
+		return response
+	}
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Channel not found")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Failed to update password")
+		conn.logger.Error("Unable to rename channel", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to rename channel")
 		return response
 	}
 
@@ -495,43 +1686,77 @@ func (conn *ClientConn) ResetPassword(body json.RawMessage) (response Response)
 	return response
 }
 
-func (conn *ClientConn) InitChat(body json.RawMessage) (response Response) {
-	if conn.user.ID == 0 {
-		response.Error = &JSONRPCUnauthenticatedError
+func (conn *ClientConn) SetChannelTopic(params interface{}) (response Response) {
+	message := params.(*SetChannelTopic)
+
+	if response.Error = conn.authorizeChannelOwner(message.ID); response.Error != nil {
 		return response
 	}
 
-	initJSON, err := conn.repo.GetInit(conn.user.ID)
+	err := conn.repo.SetChannelTopic(message.ID, message.Topic, message.Description)
+	if err == ErrChannelArchived {
+		response.Error = errorWithData(JSONRPCChannelArchivedError, "Cannot set the topic of an archived channel")
+		return response
+	}
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Channel not found")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Unable to initialize chat")
+		conn.logger.Error("Unable to set channel topic", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to set channel topic")
 		return response
 	}
 
-	rawInit := json.RawMessage(initJSON)
-	response.Result = &rawInit
+	response.Result = true
 	return response
 }
 
-func (conn *ClientConn) PostMessage(body json.RawMessage) (response Response) {
-	if conn.user.ID == 0 {
-		response.Error = &JSONRPCUnauthenticatedError
+func (conn *ClientConn) PinMessage(params interface{}) (response Response) {
+	message := params.(*PinMessage)
+
+	if response.Error = conn.authorizeMessageChannelOwner(message.MessageID); response.Error != nil {
 		return response
 	}
 
-	var message struct {
-		ChannelID int32  `json:"channel_id"`
-		Text      string `json:"text"`
+	err := conn.repo.PinMessage(message.MessageID, conn.user.ID)
+	if err == ErrChannelArchived {
+		response.Error = errorWithData(JSONRPCChannelArchivedError, "Cannot pin messages in an archived channel")
+		return response
+	}
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Message not found")
+		return response
 	}
-
-	err := json.Unmarshal(body, &message)
 	if err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+		conn.logger.Error("Unable to pin message", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to pin message")
+		return response
+	}
+
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) UnpinMessage(params interface{}) (response Response) {
+	message := params.(*PinMessage)
+
+	if response.Error = conn.authorizeMessageChannelOwner(message.MessageID); response.Error != nil {
 		return response
 	}
 
-	_, err = conn.repo.PostMessage(message.ChannelID, conn.user.ID, message.Text)
+	err := conn.repo.UnpinMessage(message.MessageID)
+	if err == ErrChannelArchived {
+		response.Error = errorWithData(JSONRPCChannelArchivedError, "Cannot unpin messages in an archived channel")
+		return response
+	}
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Message is not pinned")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Unable to post message")
+		conn.logger.Error("Unable to unpin message", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to unpin message")
 		return response
 	}
 
@@ -539,23 +1764,60 @@ func (conn *ClientConn) PostMessage(body json.RawMessage) (response Response) {
 	return response
 }
 
-func (conn *ClientConn) CreateChannel(body json.RawMessage) (response Response) {
-	if conn.user.ID == 0 {
-		response.Error = &JSONRPCUnauthenticatedError
-		return response
+// authorizeChannelOwner returns an error unless the current user owns the
+// channel. Channels without an owner, such as those created with jchat
+// channel create and no --owner, are managed only by administrators until one
+// is assigned with jchat channel set-owner.
+func (conn *ClientConn) authorizeChannelOwner(channelID int32) *Error {
+	channel, err := conn.repo.GetChannel(channelID)
+	if err == ErrNotFound {
+		return errorWithData(JSONRPCNotFoundError, "Channel not found")
+	}
+	if err != nil {
+		conn.logger.Error("Unable to get channel", "error", err)
+		return errorWithData(JSONRPCInternalError, "Unable to get channel")
 	}
 
-	var message CreateChannel
+	if channel.OwnerID == 0 {
+		return errorWithData(JSONRPCForbiddenError, "Channel has no owner -- ask an administrator")
+	}
+	if channel.OwnerID != conn.user.ID {
+		return errorWithData(JSONRPCForbiddenError, "Only the channel owner can do that")
+	}
+
+	return nil
+}
 
-	err := json.Unmarshal(body, &message)
+// authorizeMessageChannelOwner returns an error unless the current user owns
+// the channel the message was posted to.
+func (conn *ClientConn) authorizeMessageChannelOwner(messageID int64) *Error {
+	message, err := conn.repo.GetMessage(messageID)
+	if err == ErrNotFound {
+		return errorWithData(JSONRPCNotFoundError, "Message not found")
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+		conn.logger.Error("Unable to get message", "error", err)
+		return errorWithData(JSONRPCInternalError, "Unable to get message")
+	}
+
+	return conn.authorizeChannelOwner(message.ChannelID)
+}
+
+func (conn *ClientConn) ArchiveChannel(params interface{}) (response Response) {
+	message := params.(*ChannelID)
+
+	if response.Error = conn.authorizeChannelOwner(message.ID); response.Error != nil {
 		return response
 	}
 
-	_, err = conn.repo.CreateChannel(message.Name, conn.user.ID)
+	err := conn.repo.ArchiveChannel(message.ID)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCChannelArchivedError, "Channel is already archived")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Unable to create channel")
+		conn.logger.Error("Unable to archive channel", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to archive channel")
 		return response
 	}
 
@@ -563,23 +1825,43 @@ func (conn *ClientConn) CreateChannel(body json.RawMessage) (response Response)
 	return response
 }
 
-func (conn *ClientConn) RenameChannel(body json.RawMessage) (response Response) {
-	if conn.user.ID == 0 {
-		response.Error = &JSONRPCUnauthenticatedError
+func (conn *ClientConn) UnarchiveChannel(params interface{}) (response Response) {
+	message := params.(*ChannelID)
+
+	if response.Error = conn.authorizeChannelOwner(message.ID); response.Error != nil {
 		return response
 	}
 
-	var message RenameChannel
-
-	err := json.Unmarshal(body, &message)
+	err := conn.repo.UnarchiveChannel(message.ID)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCInvalidParams, "Channel is not archived")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCParseError, err.Error())
+		conn.logger.Error("Unable to unarchive channel", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to unarchive channel")
+		return response
+	}
+
+	response.Result = true
+	return response
+}
+
+func (conn *ClientConn) DeleteChannel(params interface{}) (response Response) {
+	message := params.(*ChannelID)
+
+	if response.Error = conn.authorizeChannelOwner(message.ID); response.Error != nil {
 		return response
 	}
 
-	err = conn.repo.RenameChannel(message.ID, message.Name)
+	err := conn.repo.DeleteChannel(message.ID)
+	if err == ErrNotFound {
+		response.Error = errorWithData(JSONRPCNotFoundError, "Channel not found")
+		return response
+	}
 	if err != nil {
-		response.Error = errorWithData(JSONRPCInternalError, "Unable to rename channel")
+		conn.logger.Error("Unable to delete channel", "error", err)
+		response.Error = errorWithData(JSONRPCInternalError, "Unable to delete channel")
 		return response
 	}
 
@@ -2,15 +2,32 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"golang.org/x/net/websocket"
 	log "gopkg.in/inconshreveable/log15.v2"
+	"net"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func getTestWsServer(t testing.TB, repo Repository) *httptest.Server {
+	return getTestWsServerWithMailer(t, repo, nil)
+}
+
+func getTestWsServerWithMailer(t testing.TB, repo Repository, mailer Mailer) *httptest.Server {
+	return getTestWsServerWithConfig(t, func(conn *ClientConn) {
+		conn.repo = repo
+		conn.mailer = mailer
+	})
+}
+
+// getTestWsServerWithConfig returns a server that dispatches each websocket
+// connection after configure has set up its ClientConn.
+func getTestWsServerWithConfig(t testing.TB, configure func(conn *ClientConn)) *httptest.Server {
 	logger := log.New()
 	logger.SetHandler(log.DiscardHandler())
 
@@ -19,10 +36,9 @@ func getTestWsServer(t testing.TB, repo Repository) *httptest.Server {
 
 		conn := &ClientConn{
 			ws:     ws,
-			repo:   repo,
 			logger: logger,
-			mailer: nil,
 		}
+		configure(conn)
 
 		conn.Dispatch()
 	}))
@@ -38,7 +54,34 @@ func connectWebSocketClient(t testing.TB, server *httptest.Server) *websocket.Co
 	return ws
 }
 
-func login(t testing.TB, ws *websocket.Conn, email, password string) {
+// receiveResponse receives the next response into v. Notifications that
+// arrive first are skipped.
+func receiveResponse(t testing.TB, ws *websocket.Conn, v interface{}) {
+	for {
+		var data []byte
+		err := websocket.Message.Receive(ws, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Unable to parse message %s: %v", data, err)
+		}
+		if msg.ID == nil {
+			continue
+		}
+
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("Unable to parse response %s: %v", data, err)
+		}
+		return
+	}
+}
+
+func login(t testing.TB, ws *websocket.Conn, email, password string) LoginSuccess {
 	request := struct {
 		Method string             `json:"method"`
 		Params RequestCredentials `json:"params"`
@@ -69,6 +112,78 @@ func login(t testing.TB, ws *websocket.Conn, email, password string) {
 	if response.Error != nil {
 		t.Fatalf("Unexpected error: %v", response.Error)
 	}
+
+	return response.Result
+}
+
+// requestError sends a request for method on ws and returns the error of
+// its response or nil if it succeeded.
+func requestError(t testing.TB, ws *websocket.Conn, method string, params interface{}) *Error {
+	request := struct {
+		Method string      `json:"method"`
+		Params interface{} `json:"params"`
+		ID     int32       `json:"id"`
+	}{
+		Method: method,
+		Params: params,
+		ID:     1,
+	}
+
+	err := websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Error *Error `json:"error,omitempty"`
+		ID    int32  `json:"id"`
+	}
+	receiveResponse(t, ws, &response)
+
+	return response.Error
+}
+
+// resumeSession resumes sessionID on ws and returns the response and the
+// notifications received before it.
+func resumeSession(t testing.TB, ws *websocket.Conn, sessionID string, lastEventID *int64) (LoginSuccess, []Notification) {
+	request := struct {
+		Method string        `json:"method"`
+		Params ResumeSession `json:"params"`
+		ID     int32         `json:"id"`
+	}{
+		Method: "resume_session",
+		Params: ResumeSession{SessionID: sessionID, LastEventID: lastEventID},
+		ID:     1,
+	}
+
+	err := websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notifications []Notification
+	for {
+		var msg struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result LoginSuccess    `json:"result"`
+			Error  *Error          `json:"error"`
+			ID     json.RawMessage `json:"id"`
+		}
+		err = websocket.JSON.Receive(ws, &msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.ID == nil {
+			notifications = append(notifications, Notification{Method: msg.Method, Params: msg.Params})
+			continue
+		}
+		if msg.Error != nil {
+			t.Fatalf("Unexpected error: %v", msg.Error)
+		}
+		return msg.Result, notifications
+	}
 }
 
 func TestClientConnInvalidJSON(t *testing.T) {
@@ -143,6 +258,67 @@ func TestClientConnLoginFailure(t *testing.T) {
 	}
 }
 
+func TestClientConnLoginFailuresDelayLogin(t *testing.T) {
+	repo := getPgxRepository(t)
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	tests := []struct {
+		method    string
+		params    interface{}
+		errorCode int32
+	}{
+		{"login", RequestCredentials{"joe@example.com", "wrong"}, JSONRPCAunthenticationError.Code},
+		{"init_chat", struct{}{}, JSONRPCUnauthenticatedError.Code},
+		{"login", RequestCredentials{"joe@example.com", "wrong"}, JSONRPCAunthenticationError.Code},
+		{"login", RequestCredentials{"joe@example.com", "wrong"}, JSONRPCAunthenticationError.Code},
+		{"login", RequestCredentials{"joe@example.com", "wrong"}, JSONRPCAunthenticationError.Code},
+		{"login", RequestCredentials{"joe@example.com", "password"}, JSONRPCRateLimitedError.Code},
+	}
+
+	for i, tt := range tests {
+		request := struct {
+			Method string      `json:"method"`
+			Params interface{} `json:"params"`
+			ID     int32       `json:"id"`
+		}{
+			Method: tt.method,
+			Params: tt.params,
+			ID:     int32(i),
+		}
+
+		err := websocket.JSON.Send(ws, &request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var response struct {
+			Result interface{} `json:"result,omitempty"`
+			Error  *Error      `json:"error,omitempty"`
+			ID     int32       `json:"id"`
+		}
+		err = websocket.JSON.Receive(ws, &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.Error == nil {
+			t.Errorf("%d. Expected an error, but didn't get one. %#v", i, response)
+			continue
+		}
+		if response.Error.Code != tt.errorCode {
+			t.Errorf("%d. Expected Error.Code to be %d, but it was %d", i, tt.errorCode, response.Error.Code)
+		}
+	}
+}
+
 func TestClientConnLoginSuccess(t *testing.T) {
 	repo := getPgxRepository(t)
 
@@ -191,6 +367,177 @@ func TestClientConnLoginSuccess(t *testing.T) {
 	}
 }
 
+func TestClientConnResumeSessionReplaysMissedEvents(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	session := login(t, ws, "joe@example.com", "password")
+	ws.Close()
+
+	channelID, err := repo.CreateChannel("General", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posted, err := repo.PostMessage(channelID, user.ID, "Hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws = connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	resumed, notifications := resumeSession(t, ws, session.SessionID, &session.LastEventID)
+	if resumed.Resync {
+		t.Fatal("Expected resume_session not to require a resync, but it did")
+	}
+	if len(notifications) != 2 {
+		t.Fatalf("Expected %d replayed notifications, but there were %d", 2, len(notifications))
+	}
+
+	var channel struct {
+		EventID int64 `json:"event_id"`
+		ID      int32 `json:"id"`
+	}
+	var message struct {
+		EventID int64 `json:"event_id"`
+		ID      int64 `json:"id"`
+	}
+	if notifications[0].Method != "channel_created" {
+		t.Fatalf("Expected first notification to be %s, but it was %s", "channel_created", notifications[0].Method)
+	}
+	if err := json.Unmarshal(notifications[0].Params.(json.RawMessage), &channel); err != nil {
+		t.Fatal(err)
+	}
+	if notifications[1].Method != "message_posted" {
+		t.Fatalf("Expected second notification to be %s, but it was %s", "message_posted", notifications[1].Method)
+	}
+	if err := json.Unmarshal(notifications[1].Params.(json.RawMessage), &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if channel.ID != channelID {
+		t.Errorf("Expected replayed channel ID to be %d, but it was %d", channelID, channel.ID)
+	}
+	if message.ID != posted.ID {
+		t.Errorf("Expected replayed message ID to be %d, but it was %d", posted.ID, message.ID)
+	}
+	if channel.EventID <= session.LastEventID || message.EventID <= channel.EventID {
+		t.Errorf("Expected event IDs to increase from %d, but they were %d and %d", session.LastEventID, channel.EventID, message.EventID)
+	}
+	if resumed.LastEventID != message.EventID {
+		t.Errorf("Expected LastEventID to be %d, but it was %d", message.EventID, resumed.LastEventID)
+	}
+}
+
+func TestClientConnResumeSessionWithUnknownEventResyncs(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+	session := login(t, ws, "joe@example.com", "password")
+
+	ws2 := connectWebSocketClient(t, server)
+	defer ws2.Close()
+
+	futureEventID := session.LastEventID + 1000
+	resumed, notifications := resumeSession(t, ws2, session.SessionID, &futureEventID)
+	if !resumed.Resync {
+		t.Error("Expected resume_session from an unknown event to require a resync, but it did not")
+	}
+	if len(notifications) != 0 {
+		t.Errorf("Expected no replayed notifications, but there were %d", len(notifications))
+	}
+	if resumed.LastEventID != session.LastEventID {
+		t.Errorf("Expected LastEventID to be %d, but it was %d", session.LastEventID, resumed.LastEventID)
+	}
+}
+
+func TestClientConnDisablingUserClosesConnection(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	err = repo.DisableUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var data []byte
+		err := websocket.Message.Receive(ws, &data)
+		if err == nil {
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Fatal("Expected connection of disabled user to be closed, but it was not")
+		}
+		break
+	}
+}
+
+type failingGetUserRepository struct {
+	Repository
+}
+
+func (r failingGetUserRepository) GetUser(userID int32) (User, error) {
+	return User{}, errors.New("database is down")
+}
+
+func TestClientConnResumeSessionFailsWhenUserCannotBeLoaded(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	session := login(t, ws, "joe@example.com", "password")
+	ws.Close()
+
+	failingServer := getTestWsServer(t, failingGetUserRepository{Repository: repo})
+	defer failingServer.Close()
+	ws = connectWebSocketClient(t, failingServer)
+	defer ws.Close()
+
+	rpcErr := requestError(t, ws, "resume_session", map[string]string{"session_id": session.SessionID})
+	if rpcErr == nil || rpcErr.Code != JSONRPCInternalError.Code {
+		t.Fatalf("Expected resume_session to return error code %d, but it was %v", JSONRPCInternalError.Code, rpcErr)
+	}
+
+	rpcErr = requestError(t, ws, "init_chat", nil)
+	if rpcErr == nil || rpcErr.Code != JSONRPCUnauthenticatedError.Code {
+		t.Errorf("Expected init_chat after failed resume to return error code %d, but it was %v", JSONRPCUnauthenticatedError.Code, rpcErr)
+	}
+}
+
 func TestClientConnUnauthenticatedUserDoesNotReceiveNotifications(t *testing.T) {
 	repo := getPgxRepository(t)
 
@@ -210,7 +557,7 @@ func TestClientConnUnauthenticatedUserDoesNotReceiveNotifications(t *testing.T)
 		t.Fatal(err)
 	}
 
-	_, err = repo.PostMessage(channelID, user.ID, "Hello")
+	_, err = repo.PostMessage(channelID, user.ID, "Hello", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -274,7 +621,12 @@ func TestClientConnUnauthenticatedUserCannotInitChat(t *testing.T) {
 func TestClientConnCreateChannel(t *testing.T) {
 	repo := getPgxRepository(t)
 
-	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.SetEmailVerified(user.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -306,10 +658,7 @@ func TestClientConnCreateChannel(t *testing.T) {
 		Error  *Error      `json:"error,omitempty"`
 		ID     int32       `json:"id"`
 	}
-	err = websocket.JSON.Receive(ws, &response)
-	if err != nil {
-		t.Fatal(err)
-	}
+	receiveResponse(t, ws, &response)
 
 	if response.ID != request.ID {
 		t.Fatalf("Expected response ID (%d) to equal request ID (%d), but it did not", response.ID, request.ID)
@@ -412,10 +761,7 @@ func TestClientConnRenameChannel(t *testing.T) {
 		Error  *Error      `json:"error,omitempty"`
 		ID     int32       `json:"id"`
 	}
-	err = websocket.JSON.Receive(ws, &response)
-	if err != nil {
-		t.Fatal(err)
-	}
+	receiveResponse(t, ws, &response)
 
 	if response.ID != request.ID {
 		t.Fatalf("Expected response ID (%d) to equal request ID (%d), but it did not", response.ID, request.ID)
@@ -442,7 +788,7 @@ func TestClientConnRenameChannel(t *testing.T) {
 	}
 }
 
-func TestClientConnIsNotifiedChannelRenamed(t *testing.T) {
+func TestClientConnIsNotifiedChannelUpdatedOnRename(t *testing.T) {
 	repo := getPgxRepository(t)
 
 	user, err := repo.CreateUser("joe", "joe@example.com", "password")
@@ -467,7 +813,7 @@ func TestClientConnIsNotifiedChannelRenamed(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	type channelRenamed struct {
+	type channelUpdated struct {
 		ID   int32  `json:"id"`
 		Name string `json:"name"`
 	}
@@ -479,15 +825,15 @@ func TestClientConnIsNotifiedChannelRenamed(t *testing.T) {
 
 	var notice struct {
 		Method string         `json:"method"`
-		Params channelRenamed `json:"params"`
+		Params channelUpdated `json:"params"`
 	}
 	err = websocket.JSON.Receive(ws, &notice)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if notice.Method != "channel_renamed" {
-		t.Fatalf("Expected notice.Method to be %s, but it was %s", "channel_renamed", notice.Method)
+	if notice.Method != "channel_updated" {
+		t.Fatalf("Expected notice.Method to be %s, but it was %s", "channel_updated", notice.Method)
 	}
 	if notice.Params.ID != channelID {
 		t.Fatalf("Expected notice.Params.ID to be %d, but it was %d", channelID, notice.Params.ID)
@@ -496,3 +842,1396 @@ func TestClientConnIsNotifiedChannelRenamed(t *testing.T) {
 		t.Fatalf("Expected notice.Params.Name to be %s, but it was %s", "Bar", notice.Params.Name)
 	}
 }
+
+func TestClientConnSetChannelTopic(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelID, err := repo.CreateChannel("Foo", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	request := struct {
+		Method string          `json:"method"`
+		Params SetChannelTopic `json:"params"`
+		ID     int32           `json:"id"`
+	}{
+		Method: "set_channel_topic",
+		Params: SetChannelTopic{ID: channelID, Topic: "Release planning", Description: "Where we plan releases"},
+		ID:     1,
+	}
+
+	err = websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type channelUpdated struct {
+		ID          int32  `json:"id"`
+		Name        string `json:"name"`
+		Topic       string `json:"topic"`
+		Description string `json:"description"`
+	}
+
+	// The response and the channel_updated notification can arrive in either order
+	var gotResponse, gotNotice bool
+	for i := 0; i < 2; i++ {
+		var msg struct {
+			Method string         `json:"method"`
+			Params channelUpdated `json:"params"`
+			Result interface{}    `json:"result,omitempty"`
+			Error  *Error         `json:"error,omitempty"`
+			ID     *int32         `json:"id"`
+		}
+		err = websocket.JSON.Receive(ws, &msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.ID != nil {
+			gotResponse = true
+			if msg.Error != nil {
+				t.Fatalf("Unexpected error: %v", msg.Error)
+			}
+			if msg.Result != true {
+				t.Fatalf("Expected Result to be %v, but it was %v", true, msg.Result)
+			}
+			continue
+		}
+
+		gotNotice = true
+		if msg.Method != "channel_updated" {
+			t.Fatalf("Expected notice.Method to be %s, but it was %s", "channel_updated", msg.Method)
+		}
+		if msg.Params.Topic != "Release planning" {
+			t.Fatalf("Expected notice.Params.Topic to be %s, but it was %s", "Release planning", msg.Params.Topic)
+		}
+		if msg.Params.Description != "Where we plan releases" {
+			t.Fatalf("Expected notice.Params.Description to be %s, but it was %s", "Where we plan releases", msg.Params.Description)
+		}
+	}
+
+	if !gotResponse || !gotNotice {
+		t.Fatalf("Expected both response and notification, got response: %v, notification: %v", gotResponse, gotNotice)
+	}
+}
+
+func TestPostMessageValidate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		text        string
+		clientNonce string
+		valid       bool
+	}{
+		{"hello", "", true},
+		{strings.Repeat("x", 10000), strings.Repeat("x", 64), true},
+		{strings.Repeat("x", 10001), "", false},
+		{"hello", strings.Repeat("x", 65), false},
+	}
+
+	for _, tt := range tests {
+		err := (&PostMessage{Text: tt.text, ClientNonce: tt.clientNonce}).validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("Expected validate of text length %d and client_nonce length %d to be valid: %v, but it returned %v", len(tt.text), len(tt.clientNonce), tt.valid, err)
+		}
+	}
+}
+
+func TestSetChannelTopicValidate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		topic       string
+		description string
+		valid       bool
+	}{
+		{"", "", true},
+		{strings.Repeat("x", 250), strings.Repeat("x", 2000), true},
+		{strings.Repeat("x", 251), "", false},
+		{"", strings.Repeat("x", 2001), false},
+	}
+
+	for _, tt := range tests {
+		err := (&SetChannelTopic{Topic: tt.topic, Description: tt.description}).validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("Expected validate of topic length %d and description length %d to be valid: %v, but it returned %v", len(tt.topic), len(tt.description), tt.valid, err)
+		}
+	}
+}
+
+func TestClientConnTopicAndPinsRequireOwner(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	owner, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.CreateUser("bob", "bob@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelID, err := repo.CreateChannel("Foo", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := repo.PostMessage(channelID, owner.ID, "Hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.PinMessage(message.ID, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "bob@example.com", "password")
+
+	requests := []struct {
+		method string
+		params interface{}
+	}{
+		{"set_channel_topic", SetChannelTopic{ID: channelID, Topic: "Mine now"}},
+		{"pin_message", PinMessage{MessageID: message.ID}},
+		{"unpin_message", PinMessage{MessageID: message.ID}},
+	}
+	for _, r := range requests {
+		rpcErr := requestError(t, ws, r.method, r.params)
+		if rpcErr == nil || rpcErr.Code != JSONRPCForbiddenError.Code {
+			t.Errorf("Expected %s by non-owner to return error code %d, but it was %v", r.method, JSONRPCForbiddenError.Code, rpcErr)
+		}
+	}
+
+	rpcErr := requestError(t, ws, "pin_message", PinMessage{MessageID: message.ID + 1})
+	if rpcErr == nil || rpcErr.Code != JSONRPCNotFoundError.Code {
+		t.Errorf("Expected pin_message of missing message to return error code %d, but it was %v", JSONRPCNotFoundError.Code, rpcErr)
+	}
+
+	channel, err := repo.GetChannel(channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Topic != "" || len(channel.PinnedMessageIDs) != 1 {
+		t.Errorf("Expected channel to be unchanged, but it was %v", channel)
+	}
+}
+
+func TestClientConnArchiveChannelRequiresOwner(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	owner, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.CreateUser("bob", "bob@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelID, err := repo.CreateChannel("Foo", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "bob@example.com", "password")
+
+	request := struct {
+		Method string    `json:"method"`
+		Params ChannelID `json:"params"`
+		ID     int32     `json:"id"`
+	}{
+		Method: "archive_channel",
+		Params: ChannelID{ID: channelID},
+		ID:     1,
+	}
+
+	err = websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Result interface{} `json:"result,omitempty"`
+		Error  *Error      `json:"error,omitempty"`
+		ID     int32       `json:"id"`
+	}
+	err = websocket.JSON.Receive(ws, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.ID != request.ID {
+		t.Fatalf("Expected response ID (%d) to equal request ID (%d), but it did not", response.ID, request.ID)
+	}
+	if response.Error == nil {
+		t.Fatalf("Expected an error, but didn't get one. %#v", response)
+	}
+	if response.Error.Code != JSONRPCForbiddenError.Code {
+		t.Fatalf("Expected Error.Code to be %d, but it was %d", JSONRPCForbiddenError.Code, response.Error.Code)
+	}
+
+	channel, err := repo.GetChannel(channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Archived {
+		t.Fatal("Expected channel not to be archived, but it was")
+	}
+}
+
+func TestClientConnArchivedChannelIsReadOnly(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelID, err := repo.CreateChannel("Foo", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := repo.PostMessage(channelID, user.ID, "Hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.PinMessage(message.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.ArchiveChannel(channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	requests := []struct {
+		method string
+		params interface{}
+	}{
+		{"rename_channel", RenameChannel{ID: channelID, Name: "Bar"}},
+		{"set_channel_topic", SetChannelTopic{ID: channelID, Topic: "Old news"}},
+		{"unpin_message", PinMessage{MessageID: message.ID}},
+		{"pin_message", PinMessage{MessageID: message.ID}},
+	}
+	for _, r := range requests {
+		rpcErr := requestError(t, ws, r.method, r.params)
+		if rpcErr == nil || rpcErr.Code != JSONRPCChannelArchivedError.Code {
+			t.Errorf("Expected %s in archived channel to return error code %d, but it was %v", r.method, JSONRPCChannelArchivedError.Code, rpcErr)
+		}
+	}
+}
+
+func TestClientConnOwnerlessChannelRequiresAssignedOwner(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelID, err := repo.CreateChannel("Foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	rpcErr := requestError(t, ws, "archive_channel", ChannelID{ID: channelID})
+	if rpcErr == nil || rpcErr.Code != JSONRPCForbiddenError.Code {
+		t.Fatalf("Expected archive_channel of ownerless channel to return error code %d, but it was %v", JSONRPCForbiddenError.Code, rpcErr)
+	}
+
+	err = repo.SetChannelOwner(channelID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpcErr = requestError(t, ws, "archive_channel", ChannelID{ID: channelID})
+	if rpcErr != nil {
+		t.Fatalf("Expected archive_channel by assigned owner to succeed, but it returned %v", rpcErr)
+	}
+}
+
+func TestClientConnPostMessageToArchivedChannel(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.SetEmailVerified(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelID, err := repo.CreateChannel("Foo", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.ArchiveChannel(channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	request := struct {
+		Method string      `json:"method"`
+		Params interface{} `json:"params"`
+		ID     int32       `json:"id"`
+	}{
+		Method: "post_message",
+		Params: map[string]interface{}{"channel_id": channelID, "text": "Hello"},
+		ID:     1,
+	}
+
+	err = websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Result interface{} `json:"result,omitempty"`
+		Error  *Error      `json:"error,omitempty"`
+		ID     int32       `json:"id"`
+	}
+	err = websocket.JSON.Receive(ws, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Error == nil {
+		t.Fatalf("Expected an error, but didn't get one. %#v", response)
+	}
+	if response.Error.Code != JSONRPCChannelArchivedError.Code {
+		t.Fatalf("Expected Error.Code to be %d, but it was %d", JSONRPCChannelArchivedError.Code, response.Error.Code)
+	}
+}
+
+func TestClientConnPostMessageWithClientNonce(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.SetEmailVerified(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channelID, err := repo.CreateChannel("Foo", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	var results [2]messagePostedNotification
+	for i := range results {
+		request := struct {
+			Method string      `json:"method"`
+			Params interface{} `json:"params"`
+			ID     int32       `json:"id"`
+		}{
+			Method: "post_message",
+			Params: map[string]interface{}{"channel_id": channelID, "text": "Hello", "client_nonce": "abc"},
+			ID:     int32(i + 1),
+		}
+
+		err = websocket.JSON.Send(ws, &request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first post is also sent as a notification
+		for {
+			var response struct {
+				Method string                     `json:"method"`
+				Result *messagePostedNotification `json:"result"`
+				Error  *Error                     `json:"error"`
+				ID     int32                      `json:"id"`
+			}
+			err = websocket.JSON.Receive(ws, &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Method != "" {
+				continue
+			}
+
+			if response.Error != nil {
+				t.Fatalf("post_message returned error: %v", response.Error)
+			}
+			if response.Result == nil {
+				t.Fatalf("Expected post_message to return the message, but it did not")
+			}
+			results[i] = *response.Result
+			break
+		}
+	}
+
+	if results[0].ID == 0 || results[0].ChannelID != channelID || results[0].AuthorID != user.ID || results[0].Body != "Hello" || results[0].CreationTime == 0 {
+		t.Errorf("Expected post_message to return the stored message, but it was %+v", results[0])
+	}
+	if results[1] != results[0] {
+		t.Errorf("Expected retried post_message to return %+v, but it was %+v", results[0], results[1])
+	}
+
+	messages, err := repo.GetMessages(channelID, -1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("Expected %d message to be posted, but it was %d", 1, len(messages))
+	}
+}
+
+func TestClientConnChangePassword(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	type changePassword struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	tests := []struct {
+		params    changePassword
+		errorCode int32
+	}{
+		{changePassword{"wrongpassword", "newpassword"}, JSONRPCAunthenticationError.Code},
+		{changePassword{"password", "short"}, JSONRPCInvalidPasswordError.Code},
+		{changePassword{"password", "newpassword"}, 0},
+	}
+
+	for i, tt := range tests {
+		request := struct {
+			Method string         `json:"method"`
+			Params changePassword `json:"params"`
+			ID     int32          `json:"id"`
+		}{
+			Method: "change_password",
+			Params: tt.params,
+			ID:     int32(i),
+		}
+
+		err = websocket.JSON.Send(ws, &request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var response struct {
+			Result interface{} `json:"result,omitempty"`
+			Error  *Error      `json:"error,omitempty"`
+			ID     int32       `json:"id"`
+		}
+		err = websocket.JSON.Receive(ws, &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.errorCode == 0 {
+			if response.Error != nil {
+				t.Errorf("%d. Unexpected error: %v", i, response.Error)
+			}
+			continue
+		}
+
+		if response.Error == nil {
+			t.Errorf("%d. Expected an error, but didn't get one. %#v", i, response)
+			continue
+		}
+		if response.Error.Code != tt.errorCode {
+			t.Errorf("%d. Expected Error.Code to be %d, but it was %d", i, tt.errorCode, response.Error.Code)
+		}
+	}
+
+	_, err = repo.Login("joe@example.com", "newpassword")
+	if err != nil {
+		t.Fatalf("Expected to login with new password, but got error: %v", err)
+	}
+}
+
+func TestClientConnWrongCurrentPasswordDoesNotLockAccount(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &testMailer{}
+	server := getTestWsServerWithMailer(t, repo, mailer)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	for i := 0; i < maxLoginFailures; i++ {
+		rpcErr := requestError(t, ws, "change_password", map[string]string{"current_password": "wrong", "new_password": "newpassword"})
+		if rpcErr == nil || rpcErr.Code != JSONRPCAunthenticationError.Code {
+			t.Fatalf("%d. Expected change_password with wrong password to return error code %d, but it was %v", i, JSONRPCAunthenticationError.Code, rpcErr)
+		}
+
+		rpcErr = requestError(t, ws, "change_email", map[string]string{"email": "joseph@example.com", "password": "wrong"})
+		if rpcErr == nil || rpcErr.Code != JSONRPCAunthenticationError.Code {
+			t.Fatalf("%d. Expected change_email with wrong password to return error code %d, but it was %v", i, JSONRPCAunthenticationError.Code, rpcErr)
+		}
+	}
+
+	if len(mailer.sentAccountUnlockMails) != 0 {
+		t.Errorf("Expected no account unlock mails to be sent, but %d were", len(mailer.sentAccountUnlockMails))
+	}
+
+	rpcErr := requestError(t, ws, "change_password", map[string]string{"current_password": "password", "new_password": "newpassword"})
+	if rpcErr != nil {
+		t.Fatalf("Expected change_password with correct password to succeed, but it returned %v", rpcErr)
+	}
+
+	_, err = repo.Login("joe@example.com", "newpassword")
+	if err != nil {
+		t.Fatalf("Expected to login with new password, but got error: %v", err)
+	}
+}
+
+func TestClientConnChangeEmail(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &testMailer{}
+	server := getTestWsServerWithMailer(t, repo, mailer)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	request := struct {
+		Method string      `json:"method"`
+		Params interface{} `json:"params"`
+		ID     int32       `json:"id"`
+	}{
+		Method: "change_email",
+		Params: map[string]string{"email": "joseph@example.com", "password": "password"},
+		ID:     1,
+	}
+
+	err = websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Result interface{} `json:"result,omitempty"`
+		Error  *Error      `json:"error,omitempty"`
+		ID     int32       `json:"id"`
+	}
+	err = websocket.JSON.Receive(ws, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Error != nil {
+		t.Fatalf("Unexpected error: %v", response.Error)
+	}
+
+	if len(mailer.sentEmailChangeConfirmationMails) != 1 {
+		t.Fatalf("Expected %d email change confirmation mails to be sent, but %d were", 1, len(mailer.sentEmailChangeConfirmationMails))
+	}
+	sentMail := mailer.sentEmailChangeConfirmationMails[0]
+	if sentMail.to != "joseph@example.com" {
+		t.Fatalf("Expected confirmation to be sent to %s, but it was sent to %s", "joseph@example.com", sentMail.to)
+	}
+
+	// Email is not changed until it is confirmed
+	_, err = repo.Login("joe@example.com", "password")
+	if err != nil {
+		t.Fatalf("Expected to login with old email, but got error: %v", err)
+	}
+
+	request.Method = "confirm_email_change"
+	request.Params = map[string]string{"token": sentMail.token}
+	request.ID = 2
+
+	err = websocket.JSON.Send(ws, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the user_updated notification if it arrives first
+	for {
+		response.ID = 0
+		err = websocket.JSON.Receive(ws, &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.ID == request.ID {
+			break
+		}
+	}
+	if response.Error != nil {
+		t.Fatalf("Unexpected error: %v", response.Error)
+	}
+
+	_, err = repo.Login("joseph@example.com", "password")
+	if err != nil {
+		t.Fatalf("Expected to login with new email, but got error: %v", err)
+	}
+}
+
+func TestClientConnChangeEmailDoesNotRevealTakenAddresses(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.CreateUser("bob", "bob@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &testMailer{}
+	server := getTestWsServerWithMailer(t, repo, mailer)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	for _, email := range []string{"bob@example.com", "joseph@example.com"} {
+		rpcErr := requestError(t, ws, "change_email", map[string]string{"email": email, "password": "password"})
+		if rpcErr != nil {
+			t.Errorf("Expected change_email to %s to succeed, but it returned %v", email, rpcErr)
+		}
+	}
+
+	if len(mailer.sentEmailChangeConfirmationMails) != 2 {
+		t.Fatalf("Expected %d email change confirmation mails to be sent, but %d were", 2, len(mailer.sentEmailChangeConfirmationMails))
+	}
+
+	_, err = repo.SetEmailByToken(mailer.sentEmailChangeConfirmationMails[0].token, "127.0.0.1")
+	if err != (DuplicationError{Field: "email"}) {
+		t.Errorf("Expected confirming change to taken email to return DuplicationError, but it was %v", err)
+	}
+}
+
+func TestClientConnChangeEmailRequiresValidEmail(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	_, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &testMailer{}
+	server := getTestWsServerWithMailer(t, repo, mailer)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	for _, email := range []string{"", "joe", "joe@", "@example.com", "joe @example.com"} {
+		rpcErr := requestError(t, ws, "change_email", map[string]string{"email": email, "password": "password"})
+		if rpcErr == nil || rpcErr.Code != JSONRPCInvalidParams.Code {
+			t.Errorf("Expected change_email to %q to return error code %d, but it was %v", email, JSONRPCInvalidParams.Code, rpcErr)
+		}
+	}
+
+	if len(mailer.sentEmailChangeConfirmationMails) != 0 {
+		t.Errorf("Expected no email change confirmation mails to be sent, but %d were", len(mailer.sentEmailChangeConfirmationMails))
+	}
+}
+
+func TestClientConnRegisterRequiresEmail(t *testing.T) {
+	repo := getPgxRepository(t)
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	for i, email := range []string{"", "joe", "joe@", "@example.com"} {
+		request := struct {
+			Method string            `json:"method"`
+			Params map[string]string `json:"params"`
+			ID     int32             `json:"id"`
+		}{
+			Method: "register",
+			Params: map[string]string{"name": "joe", "email": email, "password": "password"},
+			ID:     int32(i),
+		}
+
+		err := websocket.JSON.Send(ws, &request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var response struct {
+			Result interface{} `json:"result,omitempty"`
+			Error  *Error      `json:"error,omitempty"`
+			ID     int32       `json:"id"`
+		}
+		err = websocket.JSON.Receive(ws, &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.Error == nil {
+			t.Errorf("%d. Expected an error for email %q, but didn't get one", i, email)
+			continue
+		}
+		if response.Error.Code != JSONRPCInvalidParams.Code {
+			t.Errorf("%d. Expected Error.Code to be %d, but it was %d", i, JSONRPCInvalidParams.Code, response.Error.Code)
+		}
+	}
+}
+
+func TestClientConnEmailVerification(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	mailer := &testMailer{}
+	server := getTestWsServerWithMailer(t, repo, mailer)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	type request struct {
+		Method string            `json:"method"`
+		Params map[string]string `json:"params"`
+		ID     int32             `json:"id"`
+	}
+
+	type response struct {
+		Result json.RawMessage `json:"result,omitempty"`
+		Error  *Error          `json:"error,omitempty"`
+		ID     int32           `json:"id"`
+	}
+
+	call := func(req request) response {
+		err := websocket.JSON.Send(ws, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			var resp response
+			err = websocket.JSON.Receive(ws, &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Skip notifications
+			if resp.ID == req.ID && (resp.Result != nil || resp.Error != nil) {
+				return resp
+			}
+		}
+	}
+
+	resp := call(request{Method: "register", Params: map[string]string{"name": "joe", "email": "joe@example.com", "password": "password"}, ID: 1})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+
+	var loginSuccess LoginSuccess
+	err := json.Unmarshal(resp.Result, &loginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loginSuccess.EmailVerified {
+		t.Fatal("Expected newly registered user not to be verified, but it was")
+	}
+
+	if len(mailer.sentEmailVerificationMails) != 1 {
+		t.Fatalf("Expected %d verification mails to be sent, but %d were", 1, len(mailer.sentEmailVerificationMails))
+	}
+	sentMail := mailer.sentEmailVerificationMails[0]
+	if sentMail.to != "joe@example.com" {
+		t.Fatalf("Expected verification to be sent to %s, but it was sent to %s", "joe@example.com", sentMail.to)
+	}
+
+	resp = call(request{Method: "create_channel", Params: map[string]string{"name": "General"}, ID: 2})
+	if resp.Error == nil || resp.Error.Code != JSONRPCEmailNotVerifiedError.Code {
+		t.Fatalf("Expected create_channel to fail with %v, but it was %v", JSONRPCEmailNotVerifiedError, resp.Error)
+	}
+
+	resp = call(request{Method: "resend_verification_email", Params: map[string]string{}, ID: 3})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	if len(mailer.sentEmailVerificationMails) != 2 {
+		t.Fatalf("Expected %d verification mails to be sent, but %d were", 2, len(mailer.sentEmailVerificationMails))
+	}
+
+	resp = call(request{Method: "verify_email", Params: map[string]string{"token": "invalid"}, ID: 4})
+	if resp.Error == nil || resp.Error.Code != JSONRPCNotFoundError.Code {
+		t.Fatalf("Expected verify_email with bad token to fail with %v, but it was %v", JSONRPCNotFoundError, resp.Error)
+	}
+
+	resp = call(request{Method: "verify_email", Params: map[string]string{"token": sentMail.token}, ID: 5})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+
+	resp = call(request{Method: "create_channel", Params: map[string]string{"name": "General"}, ID: 6})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+}
+
+// testRPCResponse is the part of a JSON-RPC response checked by the
+// conformance tests. Code is 0 for successful responses.
+type testRPCResponse struct {
+	ID   string
+	Code int32
+}
+
+// parseTestRPCResponses parses a single response or a batch of responses
+// and checks that each is a well formed JSON-RPC 2.0 response.
+func parseTestRPCResponses(t *testing.T, data []byte) []testRPCResponse {
+	var raws []json.RawMessage
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &raws); err != nil {
+			t.Fatalf("Unable to parse batch response %s: %v", data, err)
+		}
+	} else {
+		raws = []json.RawMessage{data}
+	}
+
+	responses := make([]testRPCResponse, len(raws))
+	for i, raw := range raws {
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &members); err != nil {
+			t.Fatalf("Unable to parse response %s: %v", raw, err)
+		}
+		if string(members["jsonrpc"]) != `"2.0"` {
+			t.Errorf("Expected jsonrpc to be \"2.0\" in %s", raw)
+		}
+		id, ok := members["id"]
+		if !ok {
+			t.Errorf("Expected id to be present in %s", raw)
+		}
+		responses[i].ID = string(id)
+
+		_, hasResult := members["result"]
+		errorJSON, hasError := members["error"]
+		if hasResult == hasError {
+			t.Errorf("Expected exactly one of result or error in %s", raw)
+		}
+		if hasError {
+			var rpcErr Error
+			if err := json.Unmarshal(errorJSON, &rpcErr); err != nil {
+				t.Fatalf("Unable to parse error %s: %v", errorJSON, err)
+			}
+			responses[i].Code = rpcErr.Code
+		}
+	}
+
+	return responses
+}
+
+func TestClientConnJSONRPCConformance(t *testing.T) {
+	// Requests are handled one at a time so responses arrive in order
+	server := getTestWsServerWithConfig(t, func(conn *ClientConn) {
+		conn.maxConcurrentRequests = 1
+	})
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	tests := []struct {
+		message  string
+		expected []testRPCResponse
+	}{
+		// Method not found with numeric, string and null IDs
+		{`{"jsonrpc": "2.0", "method": "foobar", "id": 1}`, []testRPCResponse{{"1", JSONRPCMethodNotFound.Code}}},
+		{`{"jsonrpc": "2.0", "method": "foobar", "id": "abc"}`, []testRPCResponse{{`"abc"`, JSONRPCMethodNotFound.Code}}},
+		{`{"jsonrpc": "2.0", "method": "foobar", "id": null}`, []testRPCResponse{{"null", JSONRPCMethodNotFound.Code}}},
+		// Notifications never get a response
+		{`{"jsonrpc": "2.0", "method": "foobar"}`, nil},
+		{`{"jsonrpc": "2.0", "method": "logout"}`, nil},
+		// A successful response with no result still has a result member
+		{`{"jsonrpc": "2.0", "method": "logout", "id": 2}`, []testRPCResponse{{"2", 0}}},
+		// Bad params are invalid params, not parse errors
+		{`{"jsonrpc": "2.0", "method": "login", "params": {"email": 1}, "id": 3}`, []testRPCResponse{{"3", JSONRPCInvalidParams.Code}}},
+		{`{"jsonrpc": "2.0", "method": "login", "id": 4}`, []testRPCResponse{{"4", JSONRPCInvalidParams.Code}}},
+		// Malformed JSON is a parse error with a null ID
+		{`{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`, []testRPCResponse{{"null", JSONRPCParseError.Code}}},
+		// Invalid request objects
+		{`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`, []testRPCResponse{{"null", JSONRPCInvalidRequest.Code}}},
+		{`{"jsonrpc": "1.0", "method": "foobar", "id": 5}`, []testRPCResponse{{"5", JSONRPCInvalidRequest.Code}}},
+		{`{"jsonrpc": "2.0", "method": "logout", "params": "bar", "id": 6}`, []testRPCResponse{{"6", JSONRPCInvalidRequest.Code}}},
+		{`{"jsonrpc": "2.0", "method": "foobar", "id": {}}`, []testRPCResponse{{"null", JSONRPCInvalidRequest.Code}}},
+		{`{"jsonrpc": "2.0", "id": 7}`, []testRPCResponse{{"7", JSONRPCInvalidRequest.Code}}},
+		{`"foobar"`, []testRPCResponse{{"null", JSONRPCInvalidRequest.Code}}},
+		// Batches
+		{`[
+			{"jsonrpc": "2.0", "method": "foobar", "id": "1"},
+			{"jsonrpc": "2.0", "method": "logout"},
+			{"foo": "boo"},
+			{"jsonrpc": "2.0", "method": "login", "params": {}, "id": "2"}
+		]`, []testRPCResponse{{`"1"`, JSONRPCMethodNotFound.Code}, {"null", JSONRPCInvalidRequest.Code}, {`"2"`, JSONRPCInvalidParams.Code}}},
+		{`[1, 2]`, []testRPCResponse{{"null", JSONRPCInvalidRequest.Code}, {"null", JSONRPCInvalidRequest.Code}}},
+		{`[]`, []testRPCResponse{{"null", JSONRPCInvalidRequest.Code}}},
+		{`[{"jsonrpc": "2.0", "method": "foobar", "id": "1"}, {"jsonrpc": "2.0", "method"]`, []testRPCResponse{{"null", JSONRPCParseError.Code}}},
+		{`[{"jsonrpc": "2.0", "method": "foobar"}, {"jsonrpc": "2.0", "method": "logout"}]`, nil},
+	}
+
+	for i, tt := range tests {
+		err := websocket.Message.Send(ws, tt.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The connection must survive every message. A probe request after
+		// each message also shows which responses belong to the message.
+		err = websocket.Message.Send(ws, `{"jsonrpc": "2.0", "method": "probe", "id": "probe"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var responses []testRPCResponse
+		for {
+			var data []byte
+			err = websocket.Message.Receive(ws, &data)
+			if err != nil {
+				t.Fatalf("%d. Unable to receive response: %v", i, err)
+			}
+
+			parsed := parseTestRPCResponses(t, data)
+			if len(parsed) == 1 && parsed[0].ID == `"probe"` {
+				break
+			}
+			if responses != nil {
+				t.Errorf("%d. Expected one message in response, but got another: %s", i, data)
+			}
+			responses = parsed
+		}
+
+		if len(responses) != len(tt.expected) {
+			t.Errorf("%d. Expected %v, but got %v", i, tt.expected, responses)
+			continue
+		}
+		for j := range tt.expected {
+			if responses[j] != tt.expected[j] {
+				t.Errorf("%d. Expected %v, but got %v", i, tt.expected, responses)
+				break
+			}
+		}
+	}
+}
+
+// newBlockingTestMethods returns methods for testing concurrency. "block"
+// waits until release is closed. "exclusive" returns whether every "block"
+// call had finished when it ran. "echo" returns immediately.
+func newBlockingTestMethods(release <-chan struct{}) *MethodRegistry {
+	var blocking int32
+
+	r := NewMethodRegistry()
+	r.Register("block", Method{
+		Func: func(conn *ClientConn, params interface{}) (response Response) {
+			atomic.AddInt32(&blocking, 1)
+			defer atomic.AddInt32(&blocking, -1)
+			<-release
+			response.Result = true
+			return response
+		},
+	})
+	r.Register("exclusive", Method{
+		Exclusive: true,
+		Func: func(conn *ClientConn, params interface{}) (response Response) {
+			response.Result = atomic.LoadInt32(&blocking) == 0
+			return response
+		},
+	})
+	r.Register("echo", Method{
+		Func: func(conn *ClientConn, params interface{}) (response Response) {
+			response.Result = true
+			return response
+		},
+	})
+
+	return r
+}
+
+// sendTestRequests sends a request for each method with IDs counting from 1.
+func sendTestRequests(t *testing.T, ws *websocket.Conn, methods ...string) {
+	for i, method := range methods {
+		request := Request{JSONRPC: "2.0", Method: method, ID: json.RawMessage(strconv.Itoa(i + 1))}
+		err := websocket.JSON.Send(ws, &request)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// receiveTestResponseIDs receives n responses and returns their IDs in the
+// order they arrived. Every response must have the result true.
+func receiveTestResponseIDs(t *testing.T, ws *websocket.Conn, n int) []int32 {
+	ids := make([]int32, n)
+	for i := range ids {
+		var response struct {
+			Result interface{} `json:"result"`
+			Error  *Error      `json:"error"`
+			ID     int32       `json:"id"`
+		}
+		receiveResponse(t, ws, &response)
+		if response.Error != nil || response.Result != true {
+			t.Fatalf("Expected result true for request %d, but it was %v (error %v)", response.ID, response.Result, response.Error)
+		}
+		ids[i] = response.ID
+	}
+	return ids
+}
+
+func TestClientConnHandlesRequestsConcurrently(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	methods := newBlockingTestMethods(release)
+	server := getTestWsServerWithConfig(t, func(conn *ClientConn) {
+		conn.methods = methods
+	})
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	sendTestRequests(t, ws, "block", "echo")
+
+	ids := receiveTestResponseIDs(t, ws, 1)
+	if ids[0] != 2 {
+		t.Fatalf("Expected echo (2) to finish while block (1) was running, but got response %d", ids[0])
+	}
+
+	close(release)
+	ids = receiveTestResponseIDs(t, ws, 1)
+	if ids[0] != 1 {
+		t.Fatalf("Expected response 1, but got %d", ids[0])
+	}
+}
+
+func TestClientConnLimitsConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	methods := newBlockingTestMethods(release)
+	server := getTestWsServerWithConfig(t, func(conn *ClientConn) {
+		conn.methods = methods
+		conn.maxConcurrentRequests = 2
+	})
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	sendTestRequests(t, ws, "block", "block", "echo")
+
+	// The echo must wait for a free slot so nothing can arrive yet
+	err := ws.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err == nil {
+		t.Fatalf("Expected no response while both slots were busy, but got %s", data)
+	}
+	ws.Close()
+
+	close(release)
+}
+
+func TestClientConnExclusiveMethodsRunAlone(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	methods := newBlockingTestMethods(release)
+	server := getTestWsServerWithConfig(t, func(conn *ClientConn) {
+		conn.methods = methods
+	})
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	sendTestRequests(t, ws, "block", "exclusive", "echo")
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	// exclusive returning true shows it waited for block. echo must wait for
+	// exclusive even though it could otherwise run at once.
+	ids := receiveTestResponseIDs(t, ws, 3)
+	for i, id := range ids {
+		if id != int32(i+1) {
+			t.Fatalf("Expected responses in order 1, 2, 3, but they were %v", ids)
+		}
+	}
+}
+
+func TestClientConnClosesIdleConnection(t *testing.T) {
+	t.Parallel()
+
+	server := getTestWsServerWithConfig(t, func(conn *ClientConn) {
+		conn.idleTimeout = 50 * time.Millisecond
+	})
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	err := ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data []byte
+	err = websocket.Message.Receive(ws, &data)
+	if err == nil {
+		t.Fatalf("Expected idle connection to be closed, but received %s", data)
+	}
+	if isTimeout(err) {
+		t.Fatal("Expected idle connection to be closed, but it was still open")
+	}
+}
+
+func TestClientConnAnsweringPingsKeepsConnectionOpen(t *testing.T) {
+	t.Parallel()
+
+	server := getTestWsServerWithConfig(t, func(conn *ClientConn) {
+		conn.pingInterval = 20 * time.Millisecond
+		conn.idleTimeout = 60 * time.Millisecond
+	})
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	err := ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Answer pings for several idle timeouts
+	deadline := time.Now().Add(200 * time.Millisecond)
+	var pings, pongs int
+	for time.Now().Before(deadline) || pongs == 0 {
+		var msg struct {
+			Method string          `json:"method"`
+			Result interface{}     `json:"result"`
+			ID     json.RawMessage `json:"id"`
+		}
+		err := websocket.JSON.Receive(ws, &msg)
+		if err != nil {
+			t.Fatalf("Connection closed after %d pings: %v", pings, err)
+		}
+
+		switch {
+		case msg.ID == nil && msg.Method == "ping":
+			pings++
+			err = websocket.JSON.Send(ws, Request{JSONRPC: "2.0", Method: "ping", ID: json.RawMessage(strconv.Itoa(pings))})
+			if err != nil {
+				t.Fatal(err)
+			}
+		case msg.ID != nil:
+			if msg.Result != true {
+				t.Fatalf("Expected ping result to be true, but it was %v", msg.Result)
+			}
+			pongs++
+		default:
+			t.Fatalf("Unexpected message: %v", msg)
+		}
+	}
+
+	if pings < 3 {
+		t.Errorf("Expected at least 3 pings, but there were %d", pings)
+	}
+}
+
+func TestClientConnQueueEventsDropsEverythingAfterOverflow(t *testing.T) {
+	t.Parallel()
+
+	conn := &ClientConn{eventChan: make(chan Event)}
+	queue := make(chan Event, 2)
+	overflow := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go conn.queueEvents(queue, overflow, stop)
+
+	for id := int64(1); id <= 3; id++ {
+		conn.eventChan <- Event{ID: id}
+	}
+
+	select {
+	case <-overflow:
+	case <-time.After(time.Second):
+		t.Fatal("Expected overflow to be signalled, but it was not")
+	}
+
+	for _, expected := range []int64{1, 2} {
+		if event := <-queue; event.ID != expected {
+			t.Errorf("Expected queued event %d, but it was %d", expected, event.ID)
+		}
+	}
+
+	// Queueing later events would leave the client with a gap
+	conn.eventChan <- Event{ID: 4}
+	conn.eventChan <- Event{ID: 5}
+	select {
+	case event := <-queue:
+		t.Errorf("Expected events after the overflow to be dropped, but %d was queued", event.ID)
+	default:
+	}
+}
+
+func TestClientConnNotificationsArriveInOrder(t *testing.T) {
+	repo := getPgxRepository(t)
+
+	user, err := repo.CreateUser("joe", "joe@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := getTestWsServer(t, repo)
+	defer server.Close()
+	ws := connectWebSocketClient(t, server)
+	defer ws.Close()
+
+	login(t, ws, "joe@example.com", "password")
+
+	// Each writer creates a channel and immediately posts a burst to it while
+	// the others do the same
+	const writers = 4
+	const burst = 10
+	errChan := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			channelID, err := repo.CreateChannel("Burst "+strconv.Itoa(w), user.ID)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			for i := 0; i < burst; i++ {
+				_, err = repo.PostMessage(channelID, user.ID, strconv.Itoa(i), "")
+				if err != nil {
+					errChan <- err
+					return
+				}
+			}
+			errChan <- nil
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastEventID int64
+	nextMessage := make(map[int32]int)
+	var messages int
+	for messages < writers*burst {
+		var notice struct {
+			Method string `json:"method"`
+			Params struct {
+				EventID   int64  `json:"event_id"`
+				ID        int32  `json:"id"`
+				ChannelID int32  `json:"channel_id"`
+				Body      string `json:"body"`
+			} `json:"params"`
+		}
+		err = websocket.JSON.Receive(ws, &notice)
+		if err != nil {
+			t.Fatalf("Received %d of %d messages: %v", messages, writers*burst, err)
+		}
+
+		if notice.Params.EventID <= lastEventID {
+			t.Fatalf("Expected event %d to follow event %d, but it did not", notice.Params.EventID, lastEventID)
+		}
+		lastEventID = notice.Params.EventID
+
+		switch notice.Method {
+		case "channel_created":
+			nextMessage[notice.Params.ID] = 0
+		case "message_posted":
+			next, ok := nextMessage[notice.Params.ChannelID]
+			if !ok {
+				t.Fatalf("Expected channel_created for channel %d before its messages, but it was not received", notice.Params.ChannelID)
+			}
+			if notice.Params.Body != strconv.Itoa(next) {
+				t.Fatalf("Expected message %d in channel %d, but it was %s", next, notice.Params.ChannelID, notice.Params.Body)
+			}
+			nextMessage[notice.Params.ChannelID] = next + 1
+			messages++
+		}
+	}
+}
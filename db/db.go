@@ -0,0 +1,13 @@
+// Package db embeds the jchat database migrations and prepared statements so
+// they are available to the jchat binary without access to the source tree.
+package db
+
+import (
+	"embed"
+)
+
+//go:embed migrations/*.sql
+var Migrations embed.FS
+
+//go:embed sql/*.sql
+var SQL embed.FS
@@ -0,0 +1,10 @@
+alter table messages add column body_html text;
+
+update messages
+set body_html='<p>' || replace(replace(replace(replace(replace(body, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;') || '</p>';
+
+alter table messages alter column body_html set not null;
+
+---- create above / drop below ----
+
+alter table messages drop column body_html;
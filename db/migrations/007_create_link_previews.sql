@@ -0,0 +1,26 @@
+create table link_previews(
+  url varchar primary key,
+  title varchar not null,
+  description varchar not null,
+  image_url varchar not null,
+  site_name varchar not null,
+  fetch_time timestamptz not null default now()
+);
+
+grant select, insert, update, delete on link_previews to {{.app_user}};
+
+create table message_link_previews(
+  message_id bigint not null references messages on delete cascade,
+  url varchar not null references link_previews on delete cascade,
+  position smallint not null,
+  primary key (message_id, url)
+);
+
+create index on message_link_previews (url);
+
+grant select, insert, update, delete on message_link_previews to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table message_link_previews;
+drop table link_previews;
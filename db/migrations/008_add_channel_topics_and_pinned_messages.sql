@@ -0,0 +1,20 @@
+alter table channels add column topic varchar(250) not null default '';
+alter table channels add column description text not null default '';
+
+create table pinned_messages(
+  message_id bigint primary key references messages on delete cascade,
+  channel_id integer not null references channels on delete cascade,
+  user_id integer not null references users,
+  pin_time timestamptz not null default now()
+);
+
+create index on pinned_messages (channel_id);
+
+grant select, insert, update, delete on pinned_messages to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table pinned_messages;
+
+alter table channels drop column description;
+alter table channels drop column topic;
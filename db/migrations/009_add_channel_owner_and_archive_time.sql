@@ -0,0 +1,7 @@
+alter table channels add column user_id integer references users on delete set null;
+alter table channels add column archive_time timestamptz;
+
+---- create above / drop below ----
+
+alter table channels drop column archive_time;
+alter table channels drop column user_id;
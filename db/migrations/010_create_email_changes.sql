@@ -0,0 +1,16 @@
+create table email_changes(
+  token varchar primary key,
+  user_id integer not null references users on delete cascade,
+  email varchar not null,
+  request_ip inet not null,
+  request_time timestamptz not null,
+  completion_ip inet,
+  completion_time timestamptz,
+  check(completion_ip is null = completion_time is null)
+);
+
+grant select, insert, update, delete on email_changes to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table email_changes;
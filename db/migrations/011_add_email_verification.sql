@@ -0,0 +1,23 @@
+alter table users add column email_verified_time timestamptz;
+
+-- Existing users registered before verification was required
+update users
+set email_verified_time=creation_time;
+
+create table email_verifications(
+  token varchar primary key,
+  user_id integer not null references users on delete cascade,
+  request_ip inet not null,
+  request_time timestamptz not null,
+  completion_ip inet,
+  completion_time timestamptz,
+  check(completion_ip is null = completion_time is null)
+);
+
+grant select, insert, update, delete on email_verifications to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table email_verifications;
+
+alter table users drop column email_verified_time;
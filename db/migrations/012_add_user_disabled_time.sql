@@ -0,0 +1,5 @@
+alter table users add column disabled_time timestamptz;
+
+---- create above / drop below ----
+
+alter table users drop column disabled_time;
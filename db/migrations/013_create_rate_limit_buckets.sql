@@ -0,0 +1,11 @@
+create table rate_limit_buckets(
+  key varchar primary key,
+  tokens float8 not null,
+  update_time timestamptz not null default now()
+);
+
+grant select, insert, update, delete on rate_limit_buckets to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table rate_limit_buckets;
@@ -0,0 +1,21 @@
+alter table users add column login_failures integer not null default 0;
+alter table users add column login_blocked_until timestamptz;
+
+create table account_unlocks(
+  token varchar primary key,
+  user_id integer not null references users on delete cascade,
+  request_ip inet not null,
+  request_time timestamptz not null,
+  completion_ip inet,
+  completion_time timestamptz,
+  check(completion_ip is null = completion_time is null)
+);
+
+grant select, insert, update, delete on account_unlocks to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table account_unlocks;
+
+alter table users drop column login_blocked_until;
+alter table users drop column login_failures;
@@ -0,0 +1,15 @@
+create table events(
+  id bigserial primary key,
+  method varchar not null,
+  params json not null,
+  insert_time timestamptz not null default now()
+);
+
+create index on events (insert_time);
+
+grant select, insert, update, delete on events to {{.app_user}};
+grant usage on sequence events_id_seq to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table events;
@@ -0,0 +1,6 @@
+alter table messages add column client_nonce varchar;
+alter table messages add unique (user_id, client_nonce);
+
+---- create above / drop below ----
+
+alter table messages drop column client_nonce;
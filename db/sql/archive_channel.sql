@@ -0,0 +1,4 @@
+update channels
+set archive_time=now()
+where id=$1
+  and archive_time is null
@@ -0,0 +1,2 @@
+insert into account_unlocks(token, user_id, request_ip, request_time)
+values($1, $2, $3, current_timestamp)
@@ -1,3 +1,3 @@
-insert into channels(name)
-values($1)
+insert into channels(name, user_id)
+values($1, nullif($2, 0))
 returning id
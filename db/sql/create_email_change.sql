@@ -0,0 +1,2 @@
+insert into email_changes(token, user_id, email, request_ip, request_time)
+values($1, $2, $3, $4, current_timestamp)
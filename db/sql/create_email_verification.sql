@@ -0,0 +1,2 @@
+insert into email_verifications(token, user_id, request_ip, request_time)
+values($1, $2, $3, current_timestamp)
@@ -0,0 +1,3 @@
+insert into message_link_previews(message_id, url, position)
+values($1, $2, $3)
+on conflict do nothing
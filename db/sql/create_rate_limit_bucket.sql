@@ -0,0 +1,3 @@
+insert into rate_limit_buckets(key, tokens)
+values($1, $2)
+on conflict (key) do nothing
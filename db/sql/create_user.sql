@@ -1,3 +1,3 @@
-insert into users(name, email, password_digest, password_salt)
-values($1, $2, $3, $4)
-returning id, name, email
+insert into users(name, email, password_digest, password_salt, email_verified_time)
+values($1, $2, $3, $4, case when $5::boolean then now() end)
+returning id, name, email, email_verified_time is not null, disabled_time is not null
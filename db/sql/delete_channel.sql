@@ -0,0 +1,2 @@
+delete from channels
+where id=$1
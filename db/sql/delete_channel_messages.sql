@@ -0,0 +1,2 @@
+delete from messages
+where channel_id=$1
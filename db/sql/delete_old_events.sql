@@ -0,0 +1,3 @@
+delete from events
+where insert_time < $1
+  and id < (select max(id) from events)
@@ -0,0 +1,2 @@
+delete from rate_limit_buckets
+where update_time < $1
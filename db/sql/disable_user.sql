@@ -0,0 +1,3 @@
+update users
+set disabled_time=coalesce(disabled_time, current_timestamp)
+where id=$1
@@ -0,0 +1,14 @@
+select id,
+  name,
+  topic,
+  description,
+  coalesce(user_id, 0),
+  archive_time is not null,
+  array(
+    select message_id
+    from pinned_messages
+    where pinned_messages.channel_id=channels.id
+    order by pin_time
+  )
+from channels
+where id=$1
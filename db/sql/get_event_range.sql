@@ -0,0 +1,2 @@
+select coalesce(min(id), 0), coalesce(max(id), 0)
+from events
@@ -0,0 +1,5 @@
+select id, method, params, insert_time
+from events
+where id > $1
+order by id
+limit $2
@@ -7,6 +7,15 @@ from (
         select
           id,
           name,
+          topic,
+          description,
+          user_id as owner_id,
+          array(
+            select message_id
+            from pinned_messages
+            where pinned_messages.channel_id=channels.id
+            order by pin_time
+          ) as pinned_message_ids,
           (
             select coalesce(json_agg(row_to_json(t)), '[]'::json)
             from (
@@ -14,15 +23,41 @@ from (
                 id,
                 user_id as author_id,
                 body,
-                extract(epoch from creation_time::timestamptz(0)) as creation_time
+                body_html,
+                extract(epoch from creation_time::timestamptz(0)) as creation_time,
+                (
+                  select coalesce(json_agg(row_to_json(t)), '[]'::json)
+                  from (
+                    select
+                      link_previews.url,
+                      link_previews.title,
+                      link_previews.description,
+                      link_previews.image_url,
+                      link_previews.site_name
+                    from message_link_previews
+                      join link_previews using(url)
+                    where message_link_previews.message_id=messages.id
+                    order by message_link_previews.position
+                  ) t
+                ) as link_previews
               from messages
               where messages.channel_id=channels.id
               order by creation_time asc
             ) t
           ) messages
         from channels
+        where archive_time is null
       ) t
     ) as channels,
+    (
+      select coalesce(json_agg(row_to_json(t)), '[]'::json)
+      from (
+        select id, name, user_id as owner_id
+        from channels
+        where archive_time is not null
+        order by name
+      ) t
+    ) as archived_channels,
     (
       select coalesce(json_agg(row_to_json(t)), '[]'::json)
       from (
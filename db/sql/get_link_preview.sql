@@ -0,0 +1,3 @@
+select url, title, description, image_url, site_name
+from link_previews
+where url=$1
@@ -0,0 +1,4 @@
+select id, name, email, login_failures, login_blocked_until
+from users
+where login_failures > 0
+order by id
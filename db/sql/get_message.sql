@@ -0,0 +1,3 @@
+select id, channel_id, user_id, body, body_html, creation_time
+from messages
+where id=$1
@@ -0,0 +1,4 @@
+select id, channel_id, user_id, body, body_html, creation_time
+from messages
+where user_id=$1
+  and client_nonce=$2
@@ -1,4 +1,4 @@
-select id, user_id, body, creation_time
+select id, user_id, body, body_html, creation_time
 from messages
 where channel_id=$1
 order by id desc
@@ -0,0 +1,4 @@
+select password_digest, password_salt
+from users
+where id=$1
+  and disabled_time is null
@@ -0,0 +1,4 @@
+select tokens, extract(epoch from now() - update_time)::float8
+from rate_limit_buckets
+where key=$1
+for update
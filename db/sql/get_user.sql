@@ -1,2 +1,2 @@
-select id, name, email
+select id, name, email, email_verified_time is not null, disabled_time is not null
 from users where id=$1
@@ -1,3 +1,3 @@
-select id
+select id, name, email, email_verified_time is not null, disabled_time is not null
 from users
 where email=$1
@@ -0,0 +1,3 @@
+select id, name, email, email_verified_time is not null, disabled_time is not null
+from users
+order by id
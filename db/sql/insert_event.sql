@@ -0,0 +1,7 @@
+with l as (
+  select pg_advisory_xact_lock(hashtext('events'))
+)
+insert into events(method, params)
+select $1, $2
+from l
+returning id, insert_time
@@ -1,3 +1,5 @@
-select id, name, email, password_digest, password_salt
+select id, name, email, email_verified_time is not null, disabled_time is not null, password_digest, password_salt,
+  login_failures, greatest(extract(epoch from login_blocked_until - now()), 0)::float8
 from users
 where email=$1
+  and disabled_time is null
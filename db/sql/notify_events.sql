@@ -0,0 +1 @@
+select pg_notify('events', '')
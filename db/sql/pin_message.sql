@@ -0,0 +1,14 @@
+with m as (
+  select messages.id, messages.channel_id
+  from messages
+    join channels on channels.id=messages.channel_id
+  where messages.id=$1
+    and channels.archive_time is null
+), p as (
+  insert into pinned_messages(message_id, channel_id, user_id)
+  select id, channel_id, $2
+  from m
+  on conflict do nothing
+)
+select channel_id
+from m
@@ -1,3 +1,7 @@
-insert into messages(channel_id, user_id, body)
-values($1, $2, $3)
+insert into messages(channel_id, user_id, body, body_html, client_nonce)
+select id, $2, $3, $4, nullif($5, '')
+from channels
+where id=$1
+  and archive_time is null
+on conflict (user_id, client_nonce) do nothing
 returning id, creation_time
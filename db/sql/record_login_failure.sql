@@ -0,0 +1,4 @@
+update users
+set login_failures=login_failures+1
+where id=$1
+returning login_failures
@@ -1,3 +1,4 @@
 update channels
 set name=$2
 where id=$1
+  and archive_time is null
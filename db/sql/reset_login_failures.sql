@@ -0,0 +1,4 @@
+update users
+set login_failures=0,
+  login_blocked_until=null
+where id=$1
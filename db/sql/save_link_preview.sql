@@ -0,0 +1,8 @@
+insert into link_previews(url, title, description, image_url, site_name)
+values($1, $2, $3, $4, $5)
+on conflict (url) do update
+set title=excluded.title,
+  description=excluded.description,
+  image_url=excluded.image_url,
+  site_name=excluded.site_name,
+  fetch_time=now()
@@ -0,0 +1,3 @@
+update channels
+set user_id=$2
+where id=$1
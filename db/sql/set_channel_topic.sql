@@ -0,0 +1,5 @@
+update channels
+set topic=$2,
+  description=$3
+where id=$1
+  and archive_time is null
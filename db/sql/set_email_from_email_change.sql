@@ -0,0 +1,15 @@
+with t as (
+  update email_changes
+  set completion_ip=$1,
+    completion_time=current_timestamp
+  where token=$2
+    and completion_time is null
+    and request_time > current_timestamp - interval '1 day'
+  returning user_id, email
+)
+update users
+set email=t.email,
+  email_verified_time=current_timestamp
+from t
+where users.id=t.user_id
+returning users.id, users.name, users.email, users.email_verified_time is not null, users.disabled_time is not null
@@ -0,0 +1,3 @@
+update users
+set email_verified_time=coalesce(email_verified_time, current_timestamp)
+where id=$1
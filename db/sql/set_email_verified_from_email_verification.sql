@@ -0,0 +1,14 @@
+with t as (
+  update email_verifications
+  set completion_ip=$1,
+    completion_time=current_timestamp
+  where token=$2
+    and completion_time is null
+    and request_time > current_timestamp - interval '7 days'
+  returning user_id
+)
+update users
+set email_verified_time=coalesce(email_verified_time, current_timestamp)
+from t
+where users.id=t.user_id
+returning users.id, users.name, users.email, users.email_verified_time is not null, users.disabled_time is not null
@@ -0,0 +1,3 @@
+update users
+set login_blocked_until=now() + $2::float8 * interval '1 second'
+where id=$1
@@ -0,0 +1,4 @@
+update rate_limit_buckets
+set tokens=$2,
+  update_time=now()
+where key=$1
@@ -0,0 +1,4 @@
+update users
+set name=$2
+where id=$1
+returning id, name, email, email_verified_time is not null, disabled_time is not null
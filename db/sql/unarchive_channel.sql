@@ -0,0 +1,4 @@
+update channels
+set archive_time=null
+where id=$1
+  and archive_time is not null
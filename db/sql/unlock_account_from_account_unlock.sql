@@ -0,0 +1,15 @@
+with t as (
+  update account_unlocks
+  set completion_ip=$1,
+    completion_time=current_timestamp
+  where token=$2
+    and completion_time is null
+    and request_time > current_timestamp - interval '1 day'
+  returning user_id
+)
+update users
+set login_failures=0,
+  login_blocked_until=null
+from t
+where users.id=t.user_id
+returning users.id, users.name, users.email, users.email_verified_time is not null, users.disabled_time is not null
@@ -0,0 +1,6 @@
+delete from pinned_messages
+using channels
+where pinned_messages.message_id=$1
+  and channels.id=pinned_messages.channel_id
+  and channels.archive_time is null
+returning pinned_messages.channel_id
@@ -0,0 +1,11 @@
+// Package frontend holds the built frontend when the jchat binary is built
+// with the assets tag. Build the frontend with middleman first so it is in
+// frontend/build.
+package frontend
+
+import (
+	"io/fs"
+)
+
+// Assets is nil unless the binary was built with the assets tag.
+var Assets fs.FS
@@ -0,0 +1,19 @@
+//go:build assets
+
+package frontend
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:build
+var build embed.FS
+
+func init() {
+	var err error
+	Assets, err = fs.Sub(build, "build")
+	if err != nil {
+		panic(err)
+	}
+}
@@ -52,7 +52,7 @@ ignore /js\/(?!application).*\.js/
 
 set :images_dir, 'img'
 
-set :build_dir, '../build/assets'
+set :build_dir, 'build'
 
 # Build-specific configuration
 configure :build do
@@ -11,6 +11,9 @@
 //= require views/login.js
 //= require views/lost_password.js
 //= require views/reset_password.js
+//= require views/verify_email.js
+//= require views/unlock_account.js
+//= require views/confirm_email_change.js
 //= require views/register.js
 //= require views/header.js
 //= require views/working_notice.js
@@ -8,8 +8,15 @@
     this.firstRequestStarted = new signals.Signal()
     this.lastRequestFinished = new signals.Signal()
     this.channelCreated = new signals.Signal()
+    this.channelUpdated = new signals.Signal()
+    this.channelArchived = new signals.Signal()
+    this.channelUnarchived = new signals.Signal()
+    this.channelDeleted = new signals.Signal()
     this.messagePosted = new signals.Signal()
+    this.messageUnfurled = new signals.Signal()
     this.userCreated = new signals.Signal()
+    this.userUpdated = new signals.Signal()
+    this.latencyMeasured = new signals.Signal()
 
     this.wsOnMessage = this.wsOnMessage.bind(this)
     this.wsOnClose = this.wsOnClose.bind(this)
@@ -21,6 +28,7 @@
 
   Connection.prototype = {
     connectAttemptCount: 0,
+    reconnectDelay: null,
     nextRequestID: 0,
 
     hostRelativeWsURI: function(path) {
@@ -48,6 +56,7 @@
       this.ws.onopen = this.wsOnOpen
 
       this.pendingRequests = {}
+      this.pendingPings = {}
     },
 
     wsOnMessage: function(evt) {
@@ -64,7 +73,13 @@
       console.log("close")
       this.lost.dispatch()
 
-      setTimeout(this.connect.bind(this), this.connectAttemptCount * 1000)
+      var delay = this.connectAttemptCount * 1000
+      if(this.reconnectDelay) {
+        delay = this.reconnectDelay
+        this.reconnectDelay = null
+      }
+
+      setTimeout(this.connect.bind(this), delay)
       this.connectAttemptCount++
     },
 
@@ -80,6 +95,18 @@
 
     onResponse: function(response) {
       var id = response.id
+
+      var ping = this.pendingPings[id]
+      if(ping) {
+        delete this.pendingPings[id]
+        this.latency = Date.now() - ping.sentAt
+        this.latencyMeasured.dispatch(this.latency)
+        if(ping.callbacks.succeeded) {
+          ping.callbacks.succeeded(this.latency)
+        }
+        return
+      }
+
       var callbacks = this.pendingRequests[id]
       if(callbacks) {
         if(response.result && callbacks.succeeded) {
@@ -98,23 +125,62 @@
     },
 
     onNotification: function(notification) {
+      // Resuming the session after a reconnect replays the events after the
+      // last one received
+      if(notification.params && typeof notification.params.event_id !== 'undefined') {
+        this.advanceLastEventID(notification.params.event_id)
+      }
+
       switch(notification.method) {
         case "channel_created":
           this.channelCreated.dispatch(notification.params)
           break
+        case "channel_updated":
+          this.channelUpdated.dispatch(notification.params)
+          break
+        case "channel_archived":
+          this.channelArchived.dispatch(notification.params)
+          break
+        case "channel_unarchived":
+          this.channelUnarchived.dispatch(notification.params)
+          break
+        case "channel_deleted":
+          this.channelDeleted.dispatch(notification.params)
+          break
         case "message_posted":
           this.messagePosted.dispatch(notification.params)
           break
+        case "message_unfurled":
+          this.messageUnfurled.dispatch(notification.params)
+          break
         case "user_created":
           this.userCreated.dispatch(notification.params)
           break
+        case "user_updated":
+          this.userUpdated.dispatch(notification.params)
+          break
+        case "user_disabled":
+          // The server closes the disabled user's own connections so other
+          // clients have nothing to do
+          break
+        case "ping":
+          // The server closes connections it does not hear from so answer
+          // to show this one is alive
+          this.ping()
+          break
+        case "server_shutting_down":
+          // Spread reconnects out so every client does not hit the new
+          // server at the same moment
+          var delay = notification.params.reconnect_after_ms
+          this.reconnectDelay = delay + Math.random() * delay
+          break
         default:
           console.log("Unknown notification:", notification)
       }
     },
 
     sendNotification: function(method, params) {
-      var msg = {method: method, params: params}
+      var msg = {jsonrpc: "2.0", method: method, params: params}
       this.ws.send(JSON.stringify(msg))
     },
 
@@ -124,19 +190,45 @@
       }
 
       var requestID = this.nextRequestID++
-      var msg = {method: method, params: params, id: requestID}
+      var msg = {jsonrpc: "2.0", method: method, params: params, id: requestID}
       this.pendingRequests[requestID] = callbacks
 
       this.ws.send(JSON.stringify(msg))
     },
 
+    // ping measures the round trip time to the server. It is not a pending
+    // request so it does not show the working notice.
+    ping: function(callbacks) {
+      var requestID = this.nextRequestID++
+      var msg = {jsonrpc: "2.0", method: "ping", id: requestID}
+      this.pendingPings[requestID] = {sentAt: Date.now(), callbacks: callbacks || {}}
+
+      this.ws.send(JSON.stringify(msg))
+    },
+
     onSessionStart: function(data) {
       this.userID = data.userID
       this.sessionID = data.sessionID
+      this.emailVerified = data.emailVerified
+      this.advanceLastEventID(data.lastEventID)
       localStorage.setItem("sessionID", this.sessionID)
     },
 
-    login: function(credentials, callbacks) {
+    // advanceLastEventID never moves the replay cursor backwards. Live events
+    // can arrive before the login or resume response that reports an older
+    // event ID.
+    advanceLastEventID: function(eventID) {
+      if(typeof eventID === 'undefined' || eventID === null) {
+        return
+      }
+      if(typeof this.lastEventID === 'undefined' || eventID > this.lastEventID) {
+        this.lastEventID = eventID
+      }
+    },
+
+    // withSessionStart returns callbacks that record the session before
+    // calling the succeeded callback.
+    withSessionStart: function(callbacks) {
       if(typeof callbacks === 'undefined') {
         callbacks = {}
       }
@@ -149,7 +241,11 @@
       } else {
         callbacks.succeeded = this.onSessionStart.bind(this)
       }
-      this.sendRequest("login", credentials, callbacks)
+      return callbacks
+    },
+
+    login: function(credentials, callbacks) {
+      this.sendRequest("login", credentials, this.withSessionStart(callbacks))
     },
 
     logout: function() {
@@ -160,11 +256,18 @@
     },
 
     register: function(registration, callbacks) {
-      this.sendRequest("register", registration, callbacks)
+      this.sendRequest("register", registration, this.withSessionStart(callbacks))
     },
 
+    // resumeSession asks for the events missed since the last one received
+    // if there was one. The result has resync set if they could not all be
+    // replayed.
     resumeSession: function(sessionID, callbacks) {
-      this.sendRequest("resume_session", {session_id: sessionID}, callbacks)
+      var params = {session_id: sessionID}
+      if(typeof this.lastEventID !== 'undefined') {
+        params.last_event_id = this.lastEventID
+      }
+      this.sendRequest("resume_session", params, this.withSessionStart(callbacks))
     },
 
     requestPasswordReset: function(email, callbacks) {
@@ -175,6 +278,34 @@
       this.sendRequest("reset_password", reset, callbacks)
     },
 
+    verifyEmail: function(token, callbacks) {
+      this.sendRequest("verify_email", {token: token}, callbacks)
+    },
+
+    unlockAccount: function(token, callbacks) {
+      this.sendRequest("unlock_account", {token: token}, callbacks)
+    },
+
+    resendVerificationEmail: function(callbacks) {
+      this.sendRequest("resend_verification_email", {}, callbacks)
+    },
+
+    confirmEmailChange: function(token, callbacks) {
+      this.sendRequest("confirm_email_change", {token: token}, callbacks)
+    },
+
+    changePassword: function(passwords, callbacks) {
+      this.sendRequest("change_password", passwords, callbacks)
+    },
+
+    updateProfile: function(profile, callbacks) {
+      this.sendRequest("update_profile", profile, callbacks)
+    },
+
+    changeEmail: function(change, callbacks) {
+      this.sendRequest("change_email", change, callbacks)
+    },
+
     initChat: function(callbacks) {
       this.sendRequest("init_chat", {}, callbacks)
     },
@@ -185,6 +316,30 @@
 
     createChannel: function(channel, callbacks) {
       this.sendRequest("create_channel", channel, callbacks)
+    },
+
+    setChannelTopic: function(topic, callbacks) {
+      this.sendRequest("set_channel_topic", topic, callbacks)
+    },
+
+    archiveChannel: function(channelID, callbacks) {
+      this.sendRequest("archive_channel", {id: channelID}, callbacks)
+    },
+
+    unarchiveChannel: function(channelID, callbacks) {
+      this.sendRequest("unarchive_channel", {id: channelID}, callbacks)
+    },
+
+    deleteChannel: function(channelID, callbacks) {
+      this.sendRequest("delete_channel", {id: channelID}, callbacks)
+    },
+
+    pinMessage: function(messageID, callbacks) {
+      this.sendRequest("pin_message", {message_id: messageID}, callbacks)
+    },
+
+    unpinMessage: function(messageID, callbacks) {
+      this.sendRequest("unpin_message", {message_id: messageID}, callbacks)
     }
   }
 })()
@@ -7,22 +7,37 @@
     router.start()
   }
 
+  var startChat = function() {
+    conn.initChat({
+      succeeded: function(data) {
+        window.chat = new App.Models.Chat(conn, data)
+
+        window.router = new App.Router
+        router.navigate('home')
+        router.start()
+      }
+    })
+  }
+
   document.addEventListener("DOMContentLoaded", function() {
     window.conn = new Connection
     conn.opened.add(function() {
       var sessionID = localStorage.getItem("sessionID")
       if(sessionID) {
         conn.resumeSession(sessionID, {
-          succeeded: function() {
-            conn.initChat({
-              succeeded: function(data) {
-                window.chat = new App.Models.Chat(conn, data)
-
-                window.router = new App.Router
-                router.navigate('home')
-                router.start()
+          succeeded: function(data) {
+            // After a reconnect the events missed while disconnected have
+            // already been replayed unless there were too many to replay
+            if(window.chat) {
+              if(data.resync) {
+                window.location.reload()
+                return
               }
-            })
+              chat.resendUnsentMessages()
+              return
+            }
+
+            startChat()
           },
           failed: gotoLogin
         })
@@ -6,9 +6,14 @@
 
     this.id = attrs.id
     this.name = attrs.name
+    this.topic = attrs.topic
+    this.description = attrs.description
+    this.ownerID = attrs.owner_id
+    this.pinnedMessageIDs = attrs.pinned_message_ids
     this.messages = attrs.messages
 
     this.messageReceived = new signals.Signal()
+    this.updated = new signals.Signal()
 
     this.sendMessage = this.sendMessage.bind(this)
     this.onMessagePosted = this.onMessagePosted.bind(this)
@@ -20,19 +25,54 @@
     },
 
     sendMessage: function(text) {
-      this.chat.postMessage({channel_id: this.id, text: text})
+      this.chat.postMessage({channel_id: this.id, text: text, client_nonce: newClientNonce()})
     },
 
     onMessagePosted: function(message) {
+      // A message can be delivered both live and when events are replayed
+      // after a reconnect
+      for(var i = this.messages.length - 1; i >= 0; i--) {
+        if(this.messages[i].id == message.id) {
+          return
+        }
+      }
+
       this.messages.push(message)
       this.messageReceived.dispatch()
+    },
+
+    onUpdated: function(attrs) {
+      this.name = attrs.name
+      this.topic = attrs.topic
+      this.description = attrs.description
+      this.pinnedMessageIDs = attrs.pinned_message_ids
+      this.updated.dispatch()
+    },
+
+    onMessageUnfurled: function(unfurl) {
+      for(var i = 0; i < this.messages.length; i++) {
+        var m = this.messages[i]
+        if(unfurl.message_id == m.id) {
+          m.link_previews = unfurl.link_previews
+          this.messageReceived.dispatch()
+          return
+        }
+      }
     }
   }
 
+  // newClientNonce returns a value that identifies one post so the server
+  // can recognize a retry of it
+  var newClientNonce = function() {
+    return Date.now().toString(36) + Math.random().toString(36).slice(2)
+  }
+
   App.Models.Chat = function(conn, attrs) {
     this.conn = conn
+    this.unsentMessages = {}
 
     this.users = attrs.users
+    this.archivedChannels = attrs.archived_channels
 
     this.channels = attrs.channels.map(function(c) {
       return new App.Models.Channel(this, c)
@@ -51,11 +91,29 @@
     this.onChannelCreated = this.onChannelCreated.bind(this)
     this.conn.channelCreated.add(this.onChannelCreated)
 
+    this.onChannelUpdated = this.onChannelUpdated.bind(this)
+    this.conn.channelUpdated.add(this.onChannelUpdated)
+
+    this.onChannelArchived = this.onChannelArchived.bind(this)
+    this.conn.channelArchived.add(this.onChannelArchived)
+
+    this.onChannelUnarchived = this.onChannelUnarchived.bind(this)
+    this.conn.channelUnarchived.add(this.onChannelUnarchived)
+
+    this.onChannelDeleted = this.onChannelDeleted.bind(this)
+    this.conn.channelDeleted.add(this.onChannelDeleted)
+
     this.onUserCreated = this.onUserCreated.bind(this)
     this.conn.userCreated.add(this.onUserCreated)
 
+    this.onUserUpdated = this.onUserUpdated.bind(this)
+    this.conn.userUpdated.add(this.onUserUpdated)
+
     this.onMessagePosted = this.onMessagePosted.bind(this)
     this.conn.messagePosted.add(this.onMessagePosted)
+
+    this.onMessageUnfurled = this.onMessageUnfurled.bind(this)
+    this.conn.messageUnfurled.add(this.onMessageUnfurled)
   }
 
   App.Models.Chat.prototype = {
@@ -72,8 +130,26 @@
       this.channelChanged.dispatch(channel)
     },
 
+    // postMessage keeps the message until the server acknowledges it so it
+    // can be sent again if the connection drops first
     postMessage: function(message) {
-      this.conn.sendMessage(message)
+      this.unsentMessages[message.client_nonce] = message
+      this.conn.sendMessage(message, {
+        succeeded: function() {
+          delete this.unsentMessages[message.client_nonce]
+        }.bind(this),
+        failed: function() {
+          delete this.unsentMessages[message.client_nonce]
+        }.bind(this)
+      })
+    },
+
+    // resendUnsentMessages sends the messages that were not acknowledged
+    // again. The server returns the original for any that were posted.
+    resendUnsentMessages: function() {
+      Object.keys(this.unsentMessages).forEach(function(nonce) {
+        this.postMessage(this.unsentMessages[nonce])
+      }, this)
     },
 
     onChannelCreated: function(channel) {
@@ -83,10 +159,69 @@
       this.channels.sort(this.channels.alphaCmp)
     },
 
+    onChannelUpdated: function(channel) {
+      for(var i = 0; i < this.channels.length; i++) {
+        var c = this.channels[i]
+        if(channel.id == c.id) {
+          c.onUpdated(channel)
+          this.channels.sort(this.channels.alphaCmp)
+          return
+        }
+      }
+    },
+
+    removeChannel: function(channelID) {
+      for(var i = 0; i < this.channels.length; i++) {
+        var c = this.channels[i]
+        if(channelID == c.id) {
+          this.channels.splice(i, 1)
+          if(c == this.selectedChannel) {
+            this.changeChannel(this.channels[0])
+          }
+          return c
+        }
+      }
+    },
+
+    onChannelArchived: function(channel) {
+      var c = this.removeChannel(channel.id)
+      if(c) {
+        this.archivedChannels.push({id: c.id, name: c.name, owner_id: c.ownerID})
+      }
+    },
+
+    onChannelUnarchived: function(channel) {
+      this.archivedChannels = this.archivedChannels.filter(function(c) {
+        return c.id != channel.id
+      })
+
+      // Messages are not included in the notification -- they arrive on the next init_chat
+      channel.messages = []
+      var c = new App.Models.Channel(this, channel)
+      this.channels.push(c)
+      this.channels.sort(this.channels.alphaCmp)
+    },
+
+    onChannelDeleted: function(channel) {
+      this.removeChannel(channel.id)
+      this.archivedChannels = this.archivedChannels.filter(function(c) {
+        return c.id != channel.id
+      })
+    },
+
     onUserCreated: function(user) {
       this.users.push(user)
     },
 
+    onUserUpdated: function(user) {
+      for(var i = 0; i < this.users.length; i++) {
+        if(this.users[i].id == user.id) {
+          this.users[i].name = user.name
+          return
+        }
+      }
+    },
+
     onMessagePosted: function(message) {
       for(var i = 0; i < this.channels.length; i++) {
         var c = this.channels[i]
@@ -95,6 +230,16 @@
           return
         }
       }
+    },
+
+    onMessageUnfurled: function(unfurl) {
+      for(var i = 0; i < this.channels.length; i++) {
+        var c = this.channels[i]
+        if(unfurl.channel_id == c.id) {
+          c.onMessageUnfurled(unfurl)
+          return
+        }
+      }
     }
   }
 })();
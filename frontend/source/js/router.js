@@ -9,6 +9,9 @@
       register: "register",
       lostPassword: "lostPassword",
       resetPassword: "resetPassword",
+      verifyEmail: "verifyEmail",
+      unlockAccount: "unlockAccount",
+      confirmEmailChange: "confirmEmailChange",
       home: "home",
       channels: "channels"
     },
@@ -29,6 +32,18 @@
       this.changePage(App.Views.ResetPasswordPage);
     },
 
+    verifyEmail: function() {
+      this.changePage(App.Views.VerifyEmailPage);
+    },
+
+    unlockAccount: function() {
+      this.changePage(App.Views.UnlockAccountPage);
+    },
+
+    confirmEmailChange: function() {
+      this.changePage(App.Views.ConfirmEmailChangePage);
+    },
+
     home: function() {
       this.changePage(App.Views.HomePage, {chat: window.chat});
     },
@@ -0,0 +1,33 @@
+(function() {
+  "use strict"
+
+  App.Views.ConfirmEmailChangePage = function() {
+    view.View.call(this, "div")
+    this.el.className = "confirmEmailChange"
+    this.token = window.location.hash.split("=")[1]
+  }
+
+  App.Views.ConfirmEmailChangePage.prototype = Object.create(view.View.prototype)
+
+  var p = App.Views.ConfirmEmailChangePage.prototype
+  p.template = JST["templates/confirm_email_change_page"]
+
+  p.render = function() {
+    this.el.innerHTML = this.template()
+    conn.confirmEmailChange(this.token, {
+      succeeded: this.onConfirmSuccess,
+      failed: this.onConfirmFailure
+    })
+    return this.el
+  }
+
+  p.onConfirmSuccess = function(data) {
+    alert("Successfully changed email address")
+    window.router.navigate('login')
+  }
+
+  p.onConfirmFailure = function(response) {
+    alert("Failure confirming email address change")
+    window.router.navigate('login')
+  }
+})()
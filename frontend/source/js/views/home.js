@@ -255,13 +255,39 @@
     var attrs = {
       author_name: user.name,
       post_time: new Date(this.model.creation_time * 1000),
-      body: this.model.body.autoLink()
+      body: this.model.body_html
     }
 
     this.el.innerHTML = this.template(attrs)
+
+    var previews = this.model.link_previews || []
+    previews.forEach(function(p) {
+      this.el.appendChild(this.renderLinkPreview(p))
+    }, this)
+
     return this.el
   }
 
+  p.renderLinkPreview = function(preview) {
+    var el = document.createElement("a")
+    el.className = "linkPreview"
+    el.href = preview.url
+    el.target = "_blank"
+    el.rel = "nofollow noopener"
+
+    var fields = ["site_name", "title", "description"]
+    fields.forEach(function(f) {
+      if(preview[f]) {
+        var div = document.createElement("div")
+        div.className = f
+        div.textContent = preview[f]
+        el.appendChild(div)
+      }
+    })
+
+    return el
+  }
+
   App.Views.Composer = function(options) {
     view.View.call(this, "div")
     this.el.className = "composer"
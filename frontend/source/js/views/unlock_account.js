@@ -0,0 +1,33 @@
+(function() {
+  "use strict"
+
+  App.Views.UnlockAccountPage = function() {
+    view.View.call(this, "div")
+    this.el.className = "unlockAccount"
+    this.token = window.location.hash.split("=")[1]
+  }
+
+  App.Views.UnlockAccountPage.prototype = Object.create(view.View.prototype)
+
+  var p = App.Views.UnlockAccountPage.prototype
+  p.template = JST["templates/unlock_account_page"]
+
+  p.render = function() {
+    this.el.innerHTML = this.template()
+    conn.unlockAccount(this.token, {
+      succeeded: this.onConfirmSuccess,
+      failed: this.onConfirmFailure
+    })
+    return this.el
+  }
+
+  p.onConfirmSuccess = function(data) {
+    alert("Successfully unlocked account")
+    window.router.navigate('login')
+  }
+
+  p.onConfirmFailure = function(response) {
+    alert("Failure unlocking account")
+    window.router.navigate('login')
+  }
+})()
@@ -0,0 +1,33 @@
+(function() {
+  "use strict"
+
+  App.Views.VerifyEmailPage = function() {
+    view.View.call(this, "div")
+    this.el.className = "verifyEmail"
+    this.token = window.location.hash.split("=")[1]
+  }
+
+  App.Views.VerifyEmailPage.prototype = Object.create(view.View.prototype)
+
+  var p = App.Views.VerifyEmailPage.prototype
+  p.template = JST["templates/verify_email_page"]
+
+  p.render = function() {
+    this.el.innerHTML = this.template()
+    conn.verifyEmail(this.token, {
+      succeeded: this.onConfirmSuccess,
+      failed: this.onConfirmFailure
+    })
+    return this.el
+  }
+
+  p.onConfirmSuccess = function(data) {
+    alert("Successfully verified email address")
+    window.router.navigate('login')
+  }
+
+  p.onConfirmFailure = function(response) {
+    alert("Failure verifying email address")
+    window.router.navigate('login')
+  }
+})()